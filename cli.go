@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Balise42/marzipango/cluster"
+	"github.com/Balise42/marzipango/formats"
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/fractales/orbits"
+	"github.com/Balise42/marzipango/params"
+	"github.com/Balise42/marzipango/parsing"
+	"github.com/Balise42/marzipango/render"
+)
+
+// Exit codes of the render subcommand
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// queryParameters lists the query parameters accepted as flags by the render subcommand
+var queryParameters = []string{
+	"left", "right", "top", "bottom", "x", "y", "window", "width", "height", "size", "maxiter",
+	"palette", "palettesize", "coloring", "interior", "interiorpalette", "power", "type", "aa", "orbit", "trapwindow", "trap", "trapthreshold", "ifs", "transform", "seed", "spp", "budget", "accumulate",
+	"xform", "finalxform", "gamma", "vibrancy", "brightness", "estimator", "estimatormin", "estimatorcurve",
+	"format", "depth", "quality", "compression", "metadata",
+}
+
+// extensionFormats maps output file extensions to formats
+var extensionFormats = map[string]string{
+	".png":  formats.PNG,
+	".jpg":  formats.JPEG,
+	".jpeg": formats.JPEG,
+	".webp": formats.WebP,
+	".tif":  formats.TIFF,
+	".tiff": formats.TIFF,
+}
+
+// queryFlag is a flag adding its values to a query parameter
+type queryFlag struct {
+	values url.Values
+	name   string
+}
+
+func (f queryFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(f.values[f.name], " ")
+}
+
+func (f queryFlag) Set(value string) error {
+	f.values.Add(f.name, value)
+	return nil
+}
+
+// renderJob is one render of the render subcommand. Image parameters come from the render document if there is one, from the query otherwise;
+// encoding parameters always come from the query, the format defaulting to the one matching the output extension.
+type renderJob struct {
+	Output string          `json:"output"`
+	Query  string          `json:"query,omitempty"`
+	Render json.RawMessage `json:"render,omitempty"`
+	Video  bool            `json:"video,omitempty"`
+}
+
+// readJobs reads a JSON file holding either a render document, rendered to output, or an array of jobs
+func readJobs(path string, output string, query string, video bool) ([]renderJob, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := strings.TrimSpace(string(content))
+	if strings.HasPrefix(trimmed, "[") {
+		var jobs []renderJob
+		if err := json.Unmarshal(content, &jobs); err != nil {
+			return nil, err
+		}
+		for i, job := range jobs {
+			if job.Output == "" {
+				return nil, fmt.Errorf("job %d has no output", i+1)
+			}
+		}
+		return jobs, nil
+	}
+	return []renderJob{{Output: output, Query: query, Render: content, Video: video}}, nil
+}
+
+// runJob renders the job locally, or on the workers of the coordinator if there is one
+func runJob(job renderJob, coordinator *cluster.Coordinator, stripHeight int, progress func(format string, a ...interface{})) error {
+	values, err := url.ParseQuery(job.Query)
+	if err != nil {
+		return err
+	}
+
+	values, err = parsing.StoreTraps(values)
+	if err != nil {
+		return err
+	}
+	if err := parsing.CheckValues(values); err != nil {
+		return err
+	}
+	imageParams := parsing.ParseValues(values)
+	if len(job.Render) > 0 {
+		imageParams, err = parsing.ParseRenderDocument(job.Render)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dir := filepath.Dir(job.Output); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if job.Video {
+		if coordinator != nil {
+			return coordinator.Video(context.Background(), job.Output, imageParams)
+		}
+		return render.Video(context.Background(), job.Output, imageParams, render.WithProgress(func(frame int, total int) {
+			progress("frame %d/%d", frame+1, total)
+		}))
+	}
+
+	if values.Get("format") == "" {
+		if format, ok := extensionFormats[strings.ToLower(filepath.Ext(job.Output))]; ok {
+			values.Set("format", format)
+		}
+	}
+	if err := parsing.CheckOutputValues(values, ""); err != nil {
+		return err
+	}
+	outputParams := parsing.ParseOutputValues(values, "")
+
+	metadata := ""
+	if outputParams.Metadata {
+		metadata = imageParams.Describe().Values().Encode()
+	}
+
+	if stripHeight > 0 {
+		return writePoster(job.Output, imageParams, outputParams, metadata, stripHeight, progress)
+	}
+
+	var img image.Image
+	if coordinator != nil {
+		img, err = coordinator.Render(context.Background(), imageParams)
+	} else {
+		img, err = render.Render(context.Background(), imageParams)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(job.Output)
+	if err != nil {
+		return err
+	}
+	err = formats.Encode(f, img, outputParams, metadata)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writePoster renders the image strip by strip, streaming it to a PNG or TIFF file so that the whole image is never held in memory
+func writePoster(path string, imageParams params.ImageParams, outputParams params.OutputParams, metadata string, stripHeight int, progress func(format string, a ...interface{})) error {
+	if outputParams.Format != formats.PNG && outputParams.Format != formats.TIFF {
+		return fmt.Errorf("posters can only be written as PNG or TIFF, not %s", outputParams.Format)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = streamPoster(f, imageParams, outputParams, metadata, stripHeight, progress)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// streamPoster renders the poster strip by strip to the file
+func streamPoster(f *os.File, imageParams params.ImageParams, outputParams params.OutputParams, metadata string, stripHeight int, progress func(format string, a ...interface{})) error {
+	w := bufio.NewWriter(f)
+	var stream formats.RowStream
+	var err error
+	if outputParams.Format == formats.TIFF {
+		// TIFF streams buffer their output and seek back to their header when closed
+		stream, err = formats.NewTIFFStream(f, imageParams.Width, imageParams.Height, outputParams.Depth, outputParams.Compression, metadata)
+	} else {
+		stream, err = formats.NewPNGStream(w, imageParams.Width, imageParams.Height, outputParams.Depth, outputParams.Compression, metadata)
+	}
+	if err != nil {
+		return err
+	}
+	err = render.Poster(context.Background(), imageParams, stripHeight, func(img *image.RGBA64) error {
+		return stream.WriteRows(img)
+	}, render.WithProgress(func(rows int, total int) {
+		progress("row %d/%d", rows, total)
+	}))
+	if err != nil {
+		return err
+	}
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// runRender runs the render subcommand, writing images or videos to disk without going through HTTP, and returns the exit code
+func runRender(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: marzipango render [flags]")
+		fmt.Fprintln(stderr, "Renders an image or a video to disk. Every query parameter of the server is also a flag.")
+		flags.PrintDefaults()
+	}
+
+	values := url.Values{}
+	for _, name := range queryParameters {
+		flags.Var(queryFlag{values: values, name: name}, name, "same as the "+name+" query parameter")
+	}
+	output := flags.String("out", "", "output file (default fractale.png, or fractale.avi with -video)")
+	jsonFile := flags.String("json", "", "JSON render document, or batch file holding an array of {output, query, render, video} jobs")
+	video := flags.Bool("video", false, "render a zoom video instead of an image")
+	quiet := flags.Bool("quiet", false, "do not print progress")
+	workers := flags.String("workers", "", "comma-separated base URLs of marzipango servers to split the renders across")
+	tileSize := flags.Int("tile", 256, "size of the tiles sent to the workers")
+	stripHeight := flags.Int("strip", 0, "render images in strips of this many rows streamed to a PNG or TIFF file, for images too large to hold in memory")
+	flags.StringVar(&orbits.Traps.Dir, "trapstore", orbits.Traps.Dir, "directory of the uploaded trap images")
+	flags.StringVar(&orbits.Traps.Bundled, "traps", orbits.Traps.Bundled, "directory of the bundled trap images")
+	flags.StringVar(&fractales.IFSPresets, "presets", fractales.IFSPresets, "directory of the IFS presets")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		return exitUsage
+	}
+
+	if *output == "" {
+		*output = "fractale.png"
+		if *video {
+			*output = "fractale.avi"
+		}
+	}
+
+	jobs := []renderJob{{Output: *output, Query: values.Encode(), Video: *video}}
+	if *jsonFile != "" {
+		var err error
+		jobs, err = readJobs(*jsonFile, *output, values.Encode(), *video)
+		if err != nil {
+			fmt.Fprintf(stderr, "cannot read %s: %v\n", *jsonFile, err)
+			return exitUsage
+		}
+	}
+
+	failed := 0
+	for i, job := range jobs {
+		start := time.Now()
+		prefix := fmt.Sprintf("[%d/%d] %s: ", i+1, len(jobs), job.Output)
+		progress := func(format string, a ...interface{}) {
+			if !*quiet {
+				fmt.Fprintf(stderr, prefix+format+"\n", a...)
+			}
+		}
+
+		var coordinator *cluster.Coordinator
+		if *workers != "" {
+			coordinator = cluster.NewCoordinator(strings.Split(*workers, ","), cluster.WithTileSize(*tileSize), cluster.WithProgress(func(done int, total int) {
+				progress("part %d/%d", done, total)
+			}))
+		}
+
+		progress("rendering")
+		if err := runJob(job, coordinator, *stripHeight, progress); err != nil {
+			fmt.Fprintf(stderr, "%sfailed: %v\n", prefix, err)
+			failed++
+			continue
+		}
+		progress("done in %s", time.Since(start))
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(stderr, "%d of %d renders failed\n", failed, len(jobs))
+		return exitFailure
+	}
+	return exitSuccess
+}
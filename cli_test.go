@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	// posters may be written as TIFF
+	_ "golang.org/x/image/tiff"
+)
+
+func TestRenderImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "julia.png")
+	stderr := &bytes.Buffer{}
+	if code := runRender([]string{"-out", output, "-quiet", "-type", "julia", "-width", "16", "-height", "12", "-maxiter", "50"}, stderr); code != exitSuccess {
+		t.Fatalf("Render should succeed, got %d: %s", code, stderr)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Output should be a PNG image: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 16 || bounds.Dy() != 12 {
+		t.Errorf("Image should be 16x12, got %v", bounds)
+	}
+}
+
+func TestRenderVideo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	stderr := &bytes.Buffer{}
+	if code := runRender([]string{"-video", "-quiet", "-width", "8", "-height", "8", "-maxiter", "20"}, stderr); code != exitSuccess {
+		t.Fatalf("Render should succeed, got %d: %s", code, stderr)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "fractale.avi"))
+	if err != nil {
+		t.Fatalf("Video should be written to fractale.avi: %v", err)
+	}
+	if len(content) < 12 || string(content[:4]) != "RIFF" || string(content[8:12]) != "AVI " {
+		t.Errorf("Output should be an AVI video, got %q", content[:12])
+	}
+}
+
+func TestRenderUsage(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	if code := runRender([]string{"unexpected"}, stderr); code != exitUsage {
+		t.Errorf("Unexpected arguments should be a usage error, got %d", code)
+	}
+}
+
+func TestRenderPoster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"poster.png", "poster.tiff"} {
+		output := filepath.Join(dir, name)
+		stderr := &bytes.Buffer{}
+		if code := runRender([]string{"-out", output, "-quiet", "-strip", "5", "-width", "16", "-height", "12", "-maxiter", "50"}, stderr); code != exitSuccess {
+			t.Fatalf("Poster %s should succeed, got %d: %s", name, code, stderr)
+		}
+
+		f, err := os.Open(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Poster %s should decode: %v", name, err)
+		}
+		if bounds := img.Bounds(); bounds.Dx() != 16 || bounds.Dy() != 12 {
+			t.Errorf("Poster %s should be 16x12, got %v", name, bounds)
+		}
+	}
+
+	stderr := &bytes.Buffer{}
+	if code := runRender([]string{"-out", filepath.Join(dir, "poster.jpg"), "-quiet", "-strip", "5", "-width", "16", "-height", "12"}, stderr); code != exitFailure {
+		t.Errorf("JPEG posters should fail, got %d", code)
+	}
+}
@@ -0,0 +1,301 @@
+// Package cluster renders images and videos by splitting them across worker marzipango servers
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+	"github.com/Balise42/marzipango/render"
+	"github.com/icza/mjpeg"
+)
+
+// videoQuality is the JPEG quality of the frames of the videos, the default quality of image/jpeg used by render.Video
+const videoQuality = 75
+
+// maxWorkerFailures is the number of consecutive failures after which a worker is considered down
+const maxWorkerFailures = 3
+
+// ErrNoWorkers is returned when every worker is down before the render is complete
+var ErrNoWorkers = errors.New("no worker left to render")
+
+// Coordinator splits renders into tiles, or videos into frames, and sends them to the workers
+type Coordinator struct {
+	workers  []string
+	tileSize int
+	retries  int
+	parallel int
+	client   *http.Client
+	progress func(done int, total int)
+}
+
+// Option configures a Coordinator
+type Option func(*Coordinator)
+
+// WithTileSize sets the width and height of the tiles, 256 pixels by default
+func WithTileSize(tileSize int) Option {
+	return func(c *Coordinator) {
+		if tileSize > 0 {
+			c.tileSize = tileSize
+		}
+	}
+}
+
+// WithRetries sets how many times a failed tile or frame is sent again before the render fails, 3 by default
+func WithRetries(retries int) Option {
+	return func(c *Coordinator) {
+		if retries >= 0 {
+			c.retries = retries
+		}
+	}
+}
+
+// WithParallelism sets the number of requests sent to each worker at the same time, 2 by default
+func WithParallelism(parallel int) Option {
+	return func(c *Coordinator) {
+		if parallel > 0 {
+			c.parallel = parallel
+		}
+	}
+}
+
+// WithClient sets the HTTP client used to reach the workers
+func WithClient(client *http.Client) Option {
+	return func(c *Coordinator) {
+		c.client = client
+	}
+}
+
+// WithProgress sets a function called with the number of tiles (or frames) done so far and the total.
+// It can be called concurrently from several goroutines.
+func WithProgress(progress func(done int, total int)) Option {
+	return func(c *Coordinator) {
+		c.progress = progress
+	}
+}
+
+// NewCoordinator returns a Coordinator sending work to the marzipango servers at the given base URLs
+func NewCoordinator(workers []string, opts ...Option) *Coordinator {
+	c := &Coordinator{tileSize: 256, retries: 3, parallel: 2, client: http.DefaultClient}
+	for _, worker := range workers {
+		c.workers = append(c.workers, strings.TrimSuffix(worker, "/"))
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Render renders the image described by the parameters, each tile being a sub-viewport rendered by a worker
+func (c *Coordinator) Render(ctx context.Context, imageParams params.ImageParams) (image.Image, error) {
+	if err := splittable(imageParams); err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA64(image.Rect(0, 0, imageParams.Width, imageParams.Height))
+	tiles := Tiles(img.Bounds(), c.tileSize)
+
+	err := c.schedule(ctx, len(tiles), func(ctx context.Context, worker string, i int) error {
+		tile, err := c.fetch(ctx, worker, render.SubViewport(imageParams, tiles[i]), "format=png&depth=16")
+		if err != nil {
+			return err
+		}
+		defer tile.Close()
+
+		tileImg, err := png.Decode(tile)
+		if err != nil {
+			return err
+		}
+		if tileImg.Bounds().Size() != tiles[i].Size() {
+			return fmt.Errorf("worker %s sent a %v tile instead of %v", worker, tileImg.Bounds().Size(), tiles[i].Size())
+		}
+		draw.Draw(img, tiles[i], tileImg, tileImg.Bounds().Min, draw.Src)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Video renders the zoom video starting from the parameters to an MJPEG AVI file, each frame being rendered by a worker
+func (c *Coordinator) Video(ctx context.Context, path string, imageParams params.ImageParams) error {
+	frames := make([][]byte, render.VideoFrames)
+	err := c.schedule(ctx, render.VideoFrames, func(ctx context.Context, worker string, i int) error {
+		frame, err := c.fetch(ctx, worker, render.ZoomFrame(imageParams, i), fmt.Sprintf("format=jpeg&quality=%d", videoQuality))
+		if err != nil {
+			return err
+		}
+		defer frame.Close()
+
+		frames[i], err = ioutil.ReadAll(frame)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	aw, err := mjpeg.New(path, int32(imageParams.Width), int32(imageParams.Height), 25)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		err = aw.AddFrame(frame)
+		if err != nil {
+			aw.Close()
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// splittable tells why the image cannot be rendered as independent tiles, if it cannot
+func splittable(imageParams params.ImageParams) error {
+	switch imageParams.Type {
+	case "fern", "flame", "sierp", "ifs":
+		return fmt.Errorf("%s fractals are computed as a whole and cannot be split into tiles", imageParams.Type)
+	}
+	if imageParams.Palette.Coloring == palettes.ColoringHistogram {
+		return errors.New("histogram coloring depends on the whole image and cannot be split into tiles")
+	}
+	if imageParams.Palette.MaxValue == palettes.AutoSize {
+		return errors.New("automatic palette size depends on the whole image and cannot be split into tiles")
+	}
+	switch imageParams.AA.Mode {
+	case params.AAJitter:
+		return errors.New("jittered antialiasing is seeded by the position of the pixels in the image and cannot be split into tiles")
+	case params.AAAdaptive:
+		return errors.New("adaptive antialiasing compares pixels with their neighbors and cannot be split into tiles")
+	}
+	return nil
+}
+
+// Tiles splits the bounds into tiles of at most size x size pixels
+func Tiles(bounds image.Rectangle, size int) []image.Rectangle {
+	var tiles []image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += size {
+		for x := bounds.Min.X; x < bounds.Max.X; x += size {
+			tiles = append(tiles, image.Rect(x, y, x+size, y+size).Intersect(bounds))
+		}
+	}
+	return tiles
+}
+
+// fetch asks the worker for the image described by the parameters, encoded according to the output query
+func (c *Coordinator) fetch(ctx context.Context, worker string, imageParams params.ImageParams, output string) (io.ReadCloser, error) {
+	url := worker + "/?" + imageParams.Describe().Values().Encode() + "&" + output
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// workers explain why they reject the parameters, such as a trap image they do not have
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("worker %s answered %s: %s", worker, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, "image/") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("worker %s sent %s instead of an image", worker, contentType)
+	}
+	return resp.Body, nil
+}
+
+// schedule runs do for the n tasks across the workers, sending failed tasks again to any worker until they fail more than the allowed retries
+func (c *Coordinator) schedule(ctx context.Context, n int, do func(ctx context.Context, worker string, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan int, n)
+	for i := 0; i < n; i++ {
+		queue <- i
+	}
+	if n == 0 {
+		close(queue)
+	}
+
+	var mu sync.Mutex
+	attempts := make([]int, n)
+	remaining := n
+	var taskErr error
+
+	var wg sync.WaitGroup
+	for _, worker := range c.workers {
+		failures := 0
+		for p := 0; p < c.parallel; p++ {
+			wg.Add(1)
+			go func(worker string) {
+				defer wg.Done()
+				for {
+					mu.Lock()
+					down := failures >= maxWorkerFailures
+					mu.Unlock()
+					if down {
+						return
+					}
+
+					var i int
+					var ok bool
+					select {
+					case <-ctx.Done():
+						return
+					case i, ok = <-queue:
+						if !ok {
+							return
+						}
+					}
+
+					err := do(ctx, worker, i)
+
+					mu.Lock()
+					if err == nil {
+						failures = 0
+						remaining--
+						if c.progress != nil {
+							c.progress(n-remaining, n)
+						}
+						if remaining == 0 {
+							close(queue)
+						}
+					} else if ctx.Err() == nil {
+						failures++
+						attempts[i]++
+						if attempts[i] > c.retries {
+							taskErr = fmt.Errorf("part %d failed after %d attempts: %v", i, attempts[i], err)
+							cancel()
+						} else {
+							queue <- i
+						}
+					}
+					mu.Unlock()
+				}
+			}(worker)
+		}
+	}
+	wg.Wait()
+
+	if remaining == 0 {
+		return nil
+	}
+	if taskErr != nil {
+		return taskErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrNoWorkers
+}
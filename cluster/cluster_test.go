@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Balise42/marzipango/formats"
+	"github.com/Balise42/marzipango/fractales/orbits"
+	"github.com/Balise42/marzipango/parsing"
+	"github.com/Balise42/marzipango/render"
+)
+
+func worker() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := parsing.CheckValues(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		imageParams := parsing.ParseValues(r.URL.Query())
+		outputParams := parsing.ParseOutputValues(r.URL.Query(), "")
+		img, err := render.Render(r.Context(), imageParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", formats.ContentType(outputParams.Format))
+		formats.Encode(w, img, outputParams, "")
+	}))
+}
+
+func brokenWorker() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+}
+
+func testParams(t *testing.T) (url.Values, image.Image) {
+	values, _ := url.ParseQuery("width=100&height=70&type=julia&palettesize=20&orbit=point(0.3,0.6,20)@view&orbit=line(1,1,0,20)")
+	expected, err := render.Render(context.Background(), parsing.ParseValues(values))
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	return values, expected
+}
+
+func TestRenderTiles(t *testing.T) {
+	w1, w2, broken := worker(), worker(), brokenWorker()
+	defer w1.Close()
+	defer w2.Close()
+	defer broken.Close()
+
+	values, expected := testParams(t)
+	c := NewCoordinator([]string{w1.URL, broken.URL, w2.URL}, WithTileSize(32))
+	img, err := c.Render(context.Background(), parsing.ParseValues(values))
+	if err != nil {
+		t.Fatalf("Distributed render failed: %v", err)
+	}
+
+	bounds := expected.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if expected.At(x, y) != img.At(x, y) {
+				t.Fatalf("Pixel (%d, %d) should be %v, got %v", x, y, expected.At(x, y), img.At(x, y))
+			}
+		}
+	}
+}
+
+func TestRenderNoWorkers(t *testing.T) {
+	broken := brokenWorker()
+	defer broken.Close()
+
+	values, _ := testParams(t)
+	c := NewCoordinator([]string{broken.URL}, WithTileSize(32), WithRetries(10))
+	if _, err := c.Render(context.Background(), parsing.ParseValues(values)); err != ErrNoWorkers {
+		t.Errorf("Render without working workers should return ErrNoWorkers, got %v", err)
+	}
+}
+
+func TestRenderRetries(t *testing.T) {
+	broken := brokenWorker()
+	defer broken.Close()
+
+	values, _ := testParams(t)
+	c := NewCoordinator([]string{broken.URL}, WithTileSize(32), WithRetries(0))
+	if _, err := c.Render(context.Background(), parsing.ParseValues(values)); err == nil || err == ErrNoWorkers {
+		t.Errorf("Render should fail once a part exhausted its retries, got %v", err)
+	}
+}
+
+func TestRenderUnsplittable(t *testing.T) {
+	w := worker()
+	defer w.Close()
+
+	c := NewCoordinator([]string{w.URL}, WithTileSize(32))
+	for _, query := range []string{"type=fern", "coloring=histogram", "palettesize=auto", "aa=jitter2", "aa=adaptive"} {
+		values, _ := url.ParseQuery("width=64&height=64&" + query)
+		if _, err := c.Render(context.Background(), parsing.ParseValues(values)); err == nil {
+			t.Errorf("Render with %s should not be split into tiles", query)
+		}
+	}
+	values, _ := url.ParseQuery("width=64&height=64&aa=2")
+	if _, err := c.Render(context.Background(), parsing.ParseValues(values)); err != nil {
+		t.Errorf("Render with grid antialiasing should be split into tiles, got %v", err)
+	}
+}
+
+func TestRenderMissingTrap(t *testing.T) {
+	w := worker()
+	defer w.Close()
+
+	coordinatorStore, err := ioutil.TempDir("", "marzipango-traps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(coordinatorStore)
+	workerStore, err := ioutil.TempDir("", "marzipango-traps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workerStore)
+	defer func(store orbits.Store) { orbits.Traps = store }(orbits.Traps)
+
+	var trap bytes.Buffer
+	png.Encode(&trap, image.NewGray(image.Rect(0, 0, 4, 4)))
+	values := url.Values{"width": {"64"}, "height": {"64"}, "orbit": {"raster(data:image/png;base64," + base64.StdEncoding.EncodeToString(trap.Bytes()) + ",20)"}}
+	orbits.Traps = orbits.Store{Dir: coordinatorStore}
+	values, err = parsing.StoreTraps(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageParams := parsing.ParseValues(values)
+
+	// the trap image was only stored by the coordinator, which sends its name to the workers
+	orbits.Traps = orbits.Store{Dir: workerStore}
+	c := NewCoordinator([]string{w.URL}, WithTileSize(32), WithRetries(0))
+	if _, err := c.Render(context.Background(), imageParams); err == nil || !strings.Contains(err.Error(), "unknown trap image") {
+		t.Errorf("Workers without the trap image should fail the render, got %v", err)
+	}
+}
+
+func TestVideo(t *testing.T) {
+	w1 := worker()
+	defer w1.Close()
+
+	values, _ := url.ParseQuery("width=16&height=12&maxiter=20")
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "zoom.avi")
+	done := 0
+	c := NewCoordinator([]string{w1.URL}, WithProgress(func(d int, total int) {
+		done = d
+	}))
+	if err := c.Video(context.Background(), path, parsing.ParseValues(values)); err != nil {
+		t.Fatalf("Distributed video failed: %v", err)
+	}
+	if done != render.VideoFrames {
+		t.Errorf("Progress should reach %d frames, got %d", render.VideoFrames, done)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		t.Errorf("Video should be written, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package formats
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// Supported output formats, in order of preference when negotiating
+const (
+	PNG  = "png"
+	JPEG = "jpeg"
+	WebP = "webp"
+	TIFF = "tiff"
+)
+
+// Formats lists the supported output formats in order of preference
+var Formats = []string{PNG, JPEG, WebP, TIFF}
+
+// PNG compression levels
+var compressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// ContentType returns the MIME type of the format
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+// Encode writes the image to w in the format described by the output parameters.
+// If parameters is not empty, it is embedded in the file as PNG text, EXIF metadata or TIFF image description.
+func Encode(w io.Writer, img image.Image, output params.OutputParams, parameters string) error {
+	if output.Depth == 8 || output.Format == JPEG || output.Format == WebP {
+		img8 := image.NewNRGBA(img.Bounds())
+		draw.Draw(img8, img.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = img8
+	}
+
+	var exif []byte
+	if parameters != "" {
+		exif = exifPayload(parameters)
+	}
+
+	switch output.Format {
+	case TIFF:
+		return encodeTIFF(w, img, output, parameters)
+	case WebP:
+		return EncodeWebP(w, img, exif)
+	case JPEG:
+		buf := &bytes.Buffer{}
+		err := jpeg.Encode(buf, img, &jpeg.Options{Quality: output.Quality})
+		if err != nil {
+			return err
+		}
+		encoded := buf.Bytes()
+		if parameters != "" {
+			encoded, err = addJPEGExif(encoded, parameters)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = w.Write(encoded)
+		return err
+	}
+
+	encoder := png.Encoder{CompressionLevel: compressionLevels[output.Compression]}
+	if parameters == "" {
+		return encoder.Encode(w, img)
+	}
+
+	buf := &bytes.Buffer{}
+	err := encoder.Encode(buf, img)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(addPNGText(buf.Bytes(), parameters))
+	return err
+}
+
+// encodeTIFF writes the image as a deflated TIFF file through a TIFFStream, which seeks back to its header once complete
+func encodeTIFF(w io.Writer, img image.Image, output params.OutputParams, parameters string) error {
+	buf := &seekBuffer{}
+	stream, err := NewTIFFStream(buf, img.Bounds().Dx(), img.Bounds().Dy(), output.Depth, output.Compression, parameters)
+	if err != nil {
+		return err
+	}
+	if err := stream.WriteRows(img); err != nil {
+		return err
+	}
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.data)
+	return err
+}
+
+// seekBuffer is an in-memory io.WriteSeeker
+type seekBuffer struct {
+	data []byte
+	pos  int
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.pos + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	b.pos += copy(b.data[b.pos:], p)
+	return len(p), nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += int64(b.pos)
+	case io.SeekEnd:
+		pos += int64(len(b.data))
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.pos = int(pos)
+	return pos, nil
+}
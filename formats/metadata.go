@@ -0,0 +1,150 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// MetadataKey is the PNG text keyword under which the rendering parameters are stored
+const MetadataKey = "marzipango"
+
+const software = "marzipango"
+
+const (
+	exifTagImageDescription = 0x010e
+	exifTagSoftware         = 0x0131
+	exifTypeASCII           = 2
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// maxTextChunkLength is the length above which text chunks are skipped when reading metadata
+const maxTextChunkLength = 1 << 20
+
+// ErrNoMetadata is returned when a file holds no rendering parameters
+var ErrNoMetadata = errors.New("no rendering parameters found in the image")
+
+// pngIHDREnd is the offset of the end of the IHDR chunk, which is always the first chunk of a PNG file
+const pngIHDREnd = 8 + 4 + 4 + 13 + 4
+
+// addPNGText inserts tEXt chunks holding the software and the parameters right after the IHDR chunk of the encoded PNG
+func addPNGText(encoded []byte, parameters string) []byte {
+	res := make([]byte, 0, len(encoded)+len(parameters)+64)
+	res = append(res, encoded[:pngIHDREnd]...)
+	res = appendPNGChunk(res, "tEXt", []byte("Software\x00"+software))
+	res = appendPNGChunk(res, "tEXt", []byte(MetadataKey+"\x00"+parameters))
+	return append(res, encoded[pngIHDREnd:]...)
+}
+
+// ReadPNGMetadata returns the rendering parameters stored in the text chunks of a PNG file
+func ReadPNGMetadata(r io.Reader) (string, error) {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return "", err
+	}
+	if string(signature) != pngSignature {
+		return "", errors.New("not a PNG file")
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return "", err
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		chunkType := string(header[4:])
+
+		if chunkType == "IEND" {
+			return "", ErrNoMetadata
+		}
+
+		if chunkType == "tEXt" && length <= maxTextChunkLength {
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return "", err
+			}
+			if separator := bytes.IndexByte(data, 0); separator >= 0 && string(data[:separator]) == MetadataKey {
+				return string(data[separator+1:]), nil
+			}
+		} else if _, err := io.CopyN(ioutil.Discard, r, length); err != nil {
+			return "", err
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, r, 4); err != nil {
+			return "", err
+		}
+	}
+}
+
+func appendPNGChunk(dst []byte, chunkType string, data []byte) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	dst = append(dst, header...)
+	dst = append(dst, data...)
+	return append(dst, footer...)
+}
+
+// exifPayload returns a little-endian TIFF structure holding the parameters as image description and the software
+func exifPayload(parameters string) []byte {
+	values := []struct {
+		tag   uint16
+		value string
+	}{
+		{exifTagImageDescription, parameters},
+		{exifTagSoftware, software},
+	}
+
+	ifdSize := 2 + 12*len(values) + 4
+	payload := make([]byte, 8+ifdSize)
+	copy(payload, "II")
+	binary.LittleEndian.PutUint16(payload[2:], 42)
+	binary.LittleEndian.PutUint32(payload[4:], 8)
+	binary.LittleEndian.PutUint16(payload[8:], uint16(len(values)))
+
+	for i, v := range values {
+		entry := payload[10+12*i:]
+		data := append([]byte(v.value), 0)
+		binary.LittleEndian.PutUint16(entry, v.tag)
+		binary.LittleEndian.PutUint16(entry[2:], exifTypeASCII)
+		binary.LittleEndian.PutUint32(entry[4:], uint32(len(data)))
+		if len(data) <= 4 {
+			copy(entry[8:12], data)
+		} else {
+			binary.LittleEndian.PutUint32(entry[8:], uint32(len(payload)))
+			payload = append(payload, data...)
+			if len(payload)%2 == 1 {
+				payload = append(payload, 0)
+			}
+		}
+	}
+	return payload
+}
+
+// addJPEGExif inserts an APP1 segment holding the EXIF payload right after the start of image marker of the encoded JPEG
+func addJPEGExif(encoded []byte, parameters string) ([]byte, error) {
+	payload := append([]byte("Exif\x00\x00"), exifPayload(parameters)...)
+	if len(payload)+2 > 0xffff {
+		return nil, errors.New("parameters are too long to be stored as EXIF metadata")
+	}
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+
+	res := make([]byte, 0, len(encoded)+len(segment)+len(payload))
+	res = append(res, encoded[:2]...)
+	res = append(res, segment...)
+	res = append(res, payload...)
+	return append(res, encoded[2:]...), nil
+}
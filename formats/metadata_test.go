@@ -0,0 +1,39 @@
+package formats
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Balise42/marzipango/params"
+	"golang.org/x/image/tiff"
+)
+
+func TestPNGMetadataRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := Encode(buf, testImage(10, 10), params.OutputParams{Format: PNG, Depth: 8}, "type=julia&maxiter=300")
+	if err != nil {
+		t.Fatalf("Encoding failed: %v", err)
+	}
+
+	metadata, err := ReadPNGMetadata(buf)
+	if err != nil || metadata != "type=julia&maxiter=300" {
+		t.Errorf("Metadata should be type=julia&maxiter=300, got %s (%v)", metadata, err)
+	}
+}
+
+func TestTIFFMetadata(t *testing.T) {
+	for _, depth := range []int{8, 16} {
+		buf := &bytes.Buffer{}
+		err := Encode(buf, testImage(10, 10), params.OutputParams{Format: TIFF, Depth: depth}, "type=julia&maxiter=300")
+		if err != nil {
+			t.Fatalf("Encoding failed: %v", err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte("type=julia&maxiter=300\x00")) {
+			t.Errorf("TIFF images should describe their parameters")
+		}
+		img, err := tiff.Decode(buf)
+		if err != nil || img.Bounds().Dx() != 10 {
+			t.Errorf("TIFF image with metadata should decode, got %v", err)
+		}
+	}
+}
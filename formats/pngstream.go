@@ -0,0 +1,247 @@
+package formats
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// PNG filter types
+const (
+	filterNone = iota
+	filterSub
+	filterUp
+	filterAverage
+	filterPaeth
+)
+
+// idatSize is the size of the IDAT chunks written by PNGStream
+const idatSize = 1 << 16
+
+// zlib compression levels matching the PNG compression levels
+var zlibLevels = map[string]int{
+	"default": zlib.DefaultCompression,
+	"none":    zlib.NoCompression,
+	"speed":   zlib.BestSpeed,
+	"best":    zlib.BestCompression,
+}
+
+// ErrIncompleteImage is returned when closing a PNGStream before all the rows of the image were written
+var ErrIncompleteImage = errors.New("fewer rows written than the height of the image")
+
+// PNGStream encodes a non-interlaced RGBA PNG image row by row, so that the whole image never needs to be held in memory
+type PNGStream struct {
+	w      io.Writer
+	width  int
+	height int
+	depth  int
+	filter bool
+	rows   int
+
+	idat *bufio.Writer
+	zw   *zlib.Writer
+
+	previous []byte
+	current  []byte
+	filtered [5][]byte
+}
+
+// NewPNGStream writes the header of a width x height PNG image of the given depth (8 or 16 bits per channel) to w.
+// If parameters is not empty, it is embedded in the file as text metadata.
+func NewPNGStream(w io.Writer, width int, height int, depth int, compression string, parameters string) (*PNGStream, error) {
+	if width <= 0 || height <= 0 || width > 1<<31-1 || height > 1<<31-1 {
+		return nil, errors.New("invalid PNG image size")
+	}
+	if depth != 16 {
+		depth = 8
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = byte(depth)
+	ihdr[9] = 6 // truecolor with alpha
+
+	header := []byte(pngSignature)
+	header = appendPNGChunk(header, "IHDR", ihdr)
+	if parameters != "" {
+		header = appendPNGChunk(header, "tEXt", []byte("Software\x00"+software))
+		header = appendPNGChunk(header, "tEXt", []byte(MetadataKey+"\x00"+parameters))
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	level, ok := zlibLevels[compression]
+	if !ok {
+		level = zlib.DefaultCompression
+	}
+
+	rowSize := 1 + width*4*depth/8
+	s := &PNGStream{
+		w:        w,
+		width:    width,
+		height:   height,
+		depth:    depth,
+		filter:   level != zlib.NoCompression && level != zlib.BestSpeed,
+		previous: make([]byte, rowSize),
+		current:  make([]byte, rowSize),
+	}
+	for i := range s.filtered {
+		s.filtered[i] = make([]byte, rowSize)
+	}
+	s.idat = bufio.NewWriterSize(chunkWriter{w: w, chunkType: "IDAT"}, idatSize)
+	zw, err := zlib.NewWriterLevel(s.idat, level)
+	if err != nil {
+		return nil, err
+	}
+	s.zw = zw
+	return s, nil
+}
+
+// WriteRows appends the rows of the image to the PNG image. The image must be as wide as the PNG image.
+func (s *PNGStream) WriteRows(img image.Image) error {
+	bounds := img.Bounds()
+	if bounds.Dx() != s.width {
+		return errors.New("rows are not as wide as the PNG image")
+	}
+	if s.rows+bounds.Dy() > s.height {
+		return errors.New("more rows written than the height of the image")
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := s.current[1:]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := (x - bounds.Min.X) * 4 * s.depth / 8
+			if s.depth == 16 {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				binary.BigEndian.PutUint16(row[i:], c.R)
+				binary.BigEndian.PutUint16(row[i+2:], c.G)
+				binary.BigEndian.PutUint16(row[i+4:], c.B)
+				binary.BigEndian.PutUint16(row[i+6:], c.A)
+			} else {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				row[i], row[i+1], row[i+2], row[i+3] = c.R, c.G, c.B, c.A
+			}
+		}
+
+		if _, err := s.zw.Write(s.filterRow()); err != nil {
+			return err
+		}
+		s.previous, s.current = s.current, s.previous
+		s.rows++
+	}
+	return nil
+}
+
+// Close ends the compressed data and writes the end of the PNG image
+func (s *PNGStream) Close() error {
+	if s.rows != s.height {
+		return ErrIncompleteImage
+	}
+	if err := s.zw.Close(); err != nil {
+		return err
+	}
+	if err := s.idat.Flush(); err != nil {
+		return err
+	}
+	_, err := s.w.Write(appendPNGChunk(nil, "IEND", nil))
+	return err
+}
+
+// filterRow returns the current row filtered with the filter giving the smallest sum of absolute differences, as image/png does
+func (s *PNGStream) filterRow() []byte {
+	current := s.current
+	if !s.filter {
+		current[0] = filterNone
+		return current
+	}
+
+	bpp := 4 * s.depth / 8
+	previous := s.previous[1:]
+	row := current[1:]
+	best := filterNone
+	bestSum := sumAbs(row)
+	for filter := filterSub; filter <= filterPaeth; filter++ {
+		out := s.filtered[filter]
+		out[0] = byte(filter)
+		dst := out[1:]
+		for i := range row {
+			var left, up, upLeft byte
+			if i >= bpp {
+				left = row[i-bpp]
+				upLeft = previous[i-bpp]
+			}
+			up = previous[i]
+			switch filter {
+			case filterSub:
+				dst[i] = row[i] - left
+			case filterUp:
+				dst[i] = row[i] - up
+			case filterAverage:
+				dst[i] = row[i] - byte((int(left)+int(up))/2)
+			case filterPaeth:
+				dst[i] = row[i] - paeth(left, up, upLeft)
+			}
+		}
+		if sum := sumAbs(dst); sum < bestSum {
+			best, bestSum = filter, sum
+		}
+	}
+
+	if best == filterNone {
+		current[0] = filterNone
+		return current
+	}
+	return s.filtered[best]
+}
+
+func sumAbs(row []byte) int {
+	sum := 0
+	for _, b := range row {
+		if b < 128 {
+			sum += int(b)
+		} else {
+			sum += 256 - int(b)
+		}
+	}
+	return sum
+}
+
+func paeth(a byte, b byte, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa := abs(p - int(a))
+	pb := abs(p - int(b))
+	pc := abs(p - int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// chunkWriter writes each call to Write as a PNG chunk
+type chunkWriter struct {
+	w         io.Writer
+	chunkType string
+}
+
+func (c chunkWriter) Write(data []byte) (int, error) {
+	if _, err := c.w.Write(appendPNGChunk(nil, c.chunkType, data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
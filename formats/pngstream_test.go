@@ -0,0 +1,60 @@
+package formats
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestPNGStream(t *testing.T) {
+	img := testImage(37, 23)
+	for _, depth := range []int{8, 16} {
+		for _, compression := range []string{"none", "default"} {
+			buf := &bytes.Buffer{}
+			stream, err := NewPNGStream(buf, 37, 23, depth, compression, "type=fern")
+			if err != nil {
+				t.Fatalf("Creating the stream failed: %v", err)
+			}
+			for _, strip := range []image.Rectangle{image.Rect(0, 0, 37, 10), image.Rect(0, 10, 37, 23)} {
+				if err := stream.WriteRows(img.SubImage(strip)); err != nil {
+					t.Fatalf("Writing rows failed: %v", err)
+				}
+			}
+			if err := stream.Close(); err != nil {
+				t.Fatalf("Closing the stream failed: %v", err)
+			}
+
+			encoded := buf.Bytes()
+			decoded, err := png.Decode(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("Decoding the %d-bit image failed: %v", depth, err)
+			}
+			for y := 0; y < 23; y++ {
+				for x := 0; x < 37; x++ {
+					model := color.NRGBAModel
+					if depth == 16 {
+						model = color.NRGBA64Model
+					}
+					if model.Convert(img.At(x, y)) != model.Convert(decoded.At(x, y)) {
+						t.Fatalf("Pixel (%d, %d) should be %v, got %v", x, y, img.At(x, y), decoded.At(x, y))
+					}
+				}
+			}
+
+			metadata, err := ReadPNGMetadata(bytes.NewReader(encoded))
+			if err != nil || metadata != "type=fern" {
+				t.Errorf("Metadata should be type=fern, got %s (%v)", metadata, err)
+			}
+		}
+	}
+}
+
+func TestPNGStreamIncomplete(t *testing.T) {
+	stream, _ := NewPNGStream(&bytes.Buffer{}, 10, 10, 8, "default", "")
+	stream.WriteRows(testImage(10, 5))
+	if err := stream.Close(); err != ErrIncompleteImage {
+		t.Errorf("Closing an incomplete stream should return ErrIncompleteImage, got %v", err)
+	}
+}
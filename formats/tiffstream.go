@@ -0,0 +1,274 @@
+package formats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"sort"
+)
+
+// TIFF tags and field types written by TIFFStream
+const (
+	tiffTagImageWidth      = 256
+	tiffTagImageLength     = 257
+	tiffTagBitsPerSample   = 258
+	tiffTagCompression     = 259
+	tiffTagPhotometric     = 262
+	tiffTagStripOffsets    = 273
+	tiffTagSamplesPerPixel = 277
+	tiffTagRowsPerStrip    = 278
+	tiffTagStripByteCounts = 279
+	tiffTagPlanarConfig    = 284
+	tiffTagExtraSamples    = 338
+
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+
+	tiffCompressionNone    = 1
+	tiffCompressionDeflate = 8
+)
+
+// tiffStripSize is the approximate size of the uncompressed strips of the images written by TIFFStream
+const tiffStripSize = 1 << 16
+
+// RowStream encodes an image row by row, so that the whole image never needs to be held in memory
+type RowStream interface {
+	WriteRows(img image.Image) error
+	Close() error
+}
+
+// TIFFStream encodes an RGBA TIFF image with unassociated alpha row by row, in deflated strips. The directory of the image
+// is written after the strips, so the stream needs to seek back to the header to point to it once the image is complete.
+type TIFFStream struct {
+	w      io.WriteSeeker
+	buf    *bufio.Writer
+	width  int
+	height int
+	depth  int
+	level  int
+	rows   int
+
+	rowsPerStrip int
+	strip        []byte
+	compressed   bytes.Buffer
+	written      uint64
+	offsets      []uint32
+	counts       []uint32
+	parameters   string
+}
+
+// NewTIFFStream writes the header of a width x height TIFF image of the given depth (8 or 16 bits per channel) to w.
+// If parameters is not empty, it is embedded in the file as image description.
+func NewTIFFStream(w io.WriteSeeker, width int, height int, depth int, compression string, parameters string) (*TIFFStream, error) {
+	if width <= 0 || height <= 0 || width > 1<<31-1 || height > 1<<31-1 {
+		return nil, errors.New("invalid TIFF image size")
+	}
+	if depth != 16 {
+		depth = 8
+	}
+
+	level, ok := zlibLevels[compression]
+	if !ok {
+		level = zlib.DefaultCompression
+	}
+
+	rowSize := width * 4 * depth / 8
+	rowsPerStrip := tiffStripSize / rowSize
+	if rowsPerStrip < 1 {
+		rowsPerStrip = 1
+	}
+
+	s := &TIFFStream{
+		w:            w,
+		buf:          bufio.NewWriter(w),
+		width:        width,
+		height:       height,
+		depth:        depth,
+		level:        level,
+		rowsPerStrip: rowsPerStrip,
+		strip:        make([]byte, 0, rowsPerStrip*rowSize),
+		parameters:   parameters,
+	}
+
+	// the offset of the directory is filled in when closing the stream
+	header := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	if err := s.write(header); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// write appends the data to the file, which classic TIFF files limit to 4 GB
+func (s *TIFFStream) write(data []byte) error {
+	if s.written+uint64(len(data)) > math.MaxUint32 {
+		return errors.New("TIFF images are limited to 4 GB")
+	}
+	_, err := s.buf.Write(data)
+	s.written += uint64(len(data))
+	return err
+}
+
+// WriteRows appends the rows of the image to the TIFF image. The image must be as wide as the TIFF image.
+func (s *TIFFStream) WriteRows(img image.Image) error {
+	bounds := img.Bounds()
+	if bounds.Dx() != s.width {
+		return errors.New("rows are not as wide as the TIFF image")
+	}
+	if s.rows+bounds.Dy() > s.height {
+		return errors.New("more rows written than the height of the image")
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if s.depth == 16 {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				for _, v := range []uint16{c.R, c.G, c.B, c.A} {
+					s.strip = append(s.strip, byte(v), byte(v>>8))
+				}
+			} else {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				s.strip = append(s.strip, c.R, c.G, c.B, c.A)
+			}
+		}
+		s.rows++
+
+		if s.rows%s.rowsPerStrip == 0 || s.rows == s.height {
+			if err := s.writeStrip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeStrip compresses and writes the rows of the current strip
+func (s *TIFFStream) writeStrip() error {
+	data := s.strip
+	if s.level != zlib.NoCompression {
+		s.compressed.Reset()
+		zw, err := zlib.NewWriterLevel(&s.compressed, s.level)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(s.strip); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = s.compressed.Bytes()
+	}
+
+	s.offsets = append(s.offsets, uint32(s.written))
+	s.counts = append(s.counts, uint32(len(data)))
+	s.strip = s.strip[:0]
+	return s.write(data)
+}
+
+// tiffEntry is an entry of a TIFF image file directory with its value
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count int
+	value []byte
+}
+
+func shortsEntry(tag uint16, values ...uint16) tiffEntry {
+	value := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(value[2*i:], v)
+	}
+	return tiffEntry{tag: tag, typ: tiffTypeShort, count: len(values), value: value}
+}
+
+func longsEntry(tag uint16, values ...uint32) tiffEntry {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(value[4*i:], v)
+	}
+	return tiffEntry{tag: tag, typ: tiffTypeLong, count: len(values), value: value}
+}
+
+// Close writes the image file directory at the end of the TIFF image and points the header to it
+func (s *TIFFStream) Close() error {
+	if s.rows != s.height {
+		return ErrIncompleteImage
+	}
+
+	compression := uint16(tiffCompressionDeflate)
+	if s.level == zlib.NoCompression {
+		compression = tiffCompressionNone
+	}
+	depth := uint16(s.depth)
+	entries := []tiffEntry{
+		longsEntry(tiffTagImageWidth, uint32(s.width)),
+		longsEntry(tiffTagImageLength, uint32(s.height)),
+		shortsEntry(tiffTagBitsPerSample, depth, depth, depth, depth),
+		shortsEntry(tiffTagCompression, compression),
+		shortsEntry(tiffTagPhotometric, 2),
+		longsEntry(tiffTagStripOffsets, s.offsets...),
+		shortsEntry(tiffTagSamplesPerPixel, 4),
+		longsEntry(tiffTagRowsPerStrip, uint32(s.rowsPerStrip)),
+		longsEntry(tiffTagStripByteCounts, s.counts...),
+		shortsEntry(tiffTagPlanarConfig, 1),
+		shortsEntry(tiffTagExtraSamples, 2),
+	}
+	if s.parameters != "" {
+		for _, text := range []struct {
+			tag   uint16
+			value string
+		}{{exifTagImageDescription, s.parameters}, {exifTagSoftware, software}} {
+			entries = append(entries, tiffEntry{tag: text.tag, typ: exifTypeASCII, count: len(text.value) + 1, value: append([]byte(text.value), 0)})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	// directories start on a word boundary
+	if s.written%2 == 1 {
+		if err := s.write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	ifdOffset := s.written
+	ifd := make([]byte, 2+12*len(entries)+4)
+	binary.LittleEndian.PutUint16(ifd, uint16(len(entries)))
+	var values []byte
+	for i, e := range entries {
+		entry := ifd[2+12*i:]
+		binary.LittleEndian.PutUint16(entry, e.tag)
+		binary.LittleEndian.PutUint16(entry[2:], e.typ)
+		binary.LittleEndian.PutUint32(entry[4:], uint32(e.count))
+		if len(e.value) <= 4 {
+			copy(entry[8:12], e.value)
+			continue
+		}
+		binary.LittleEndian.PutUint32(entry[8:], uint32(ifdOffset+uint64(len(ifd)+len(values))))
+		values = append(values, e.value...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	if err := s.write(append(ifd, values...)); err != nil {
+		return err
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := s.w.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	offset := make([]byte, 4)
+	binary.LittleEndian.PutUint32(offset, uint32(ifdOffset))
+	if _, err := s.w.Write(offset); err != nil {
+		return err
+	}
+	_, err := s.w.Seek(0, io.SeekEnd)
+	return err
+}
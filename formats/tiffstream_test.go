@@ -0,0 +1,72 @@
+package formats
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestTIFFStream(t *testing.T) {
+	img := testImage(300, 123)
+	for _, depth := range []int{8, 16} {
+		for _, compression := range []string{"none", "default"} {
+			f, err := ioutil.TempFile("", "stream-*.tiff")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			stream, err := NewTIFFStream(f, 300, 123, depth, compression, "type=fern")
+			if err != nil {
+				t.Fatalf("Creating the stream failed: %v", err)
+			}
+			for _, strip := range []image.Rectangle{image.Rect(0, 0, 300, 50), image.Rect(0, 50, 300, 123)} {
+				if err := stream.WriteRows(img.SubImage(strip)); err != nil {
+					t.Fatalf("Writing rows failed: %v", err)
+				}
+			}
+			if err := stream.Close(); err != nil {
+				t.Fatalf("Closing the stream failed: %v", err)
+			}
+
+			if _, err := f.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := tiff.Decode(f)
+			if err != nil {
+				t.Fatalf("Decoding the %d-bit %s image failed: %v", depth, compression, err)
+			}
+			model := color.NRGBAModel
+			if depth == 16 {
+				model = color.NRGBA64Model
+			}
+			for y := 0; y < 123; y++ {
+				for x := 0; x < 300; x++ {
+					if model.Convert(img.At(x, y)) != model.Convert(decoded.At(x, y)) {
+						t.Fatalf("Pixel (%d, %d) should be %v, got %v", x, y, img.At(x, y), decoded.At(x, y))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTIFFStreamIncomplete(t *testing.T) {
+	f, err := ioutil.TempFile("", "stream-*.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stream, _ := NewTIFFStream(f, 10, 10, 8, "default", "")
+	stream.WriteRows(testImage(10, 5))
+	if err := stream.Close(); err != ErrIncompleteImage {
+		t.Errorf("Closing an incomplete stream should return ErrIncompleteImage, got %v", err)
+	}
+}
@@ -0,0 +1,500 @@
+package formats
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// Lossless WebP (VP8L) encoder, following https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+// It uses the subtract green and predictor transforms and one set of prefix codes for the whole image, without backward references.
+
+const (
+	vp8lSignature       = 0x2f
+	vp8lMaxSize         = 1 << 14
+	predictorSizeBits   = 4
+	transformPredictor  = 0
+	transformSubtractGr = 2
+	numLengthCodes      = 24
+	numDistanceCodes    = 40
+	maxCodeLength       = 15
+	maxCodeLengthLength = 7
+)
+
+var codeLengthCodeOrder = []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// predictor modes tried for each block of the predictor transform
+var predictorModes = []uint32{1, 2, 12}
+
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) writeBits(value uint32, n uint) {
+	w.acc |= uint64(value) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc = 0
+		w.nbits = 0
+	}
+	return w.buf
+}
+
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (c prefixCode) writeSymbol(w *bitWriter, symbol uint32) {
+	w.writeBits(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// EncodeWebP writes the image as a lossless WebP file. The exif payload, if not empty, is added as an EXIF chunk.
+func EncodeWebP(w io.Writer, img image.Image, exif []byte) error {
+	bounds := img.Bounds()
+	if bounds.Dx() < 1 || bounds.Dy() < 1 || bounds.Dx() > vp8lMaxSize || bounds.Dy() > vp8lMaxSize {
+		return errors.New("webp images must be between 1 and 16384 pixels wide and high")
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	bitstream, hasAlpha := encodeVP8L(nrgba)
+
+	var chunks []byte
+	if len(exif) > 0 {
+		flags := byte(0x08)
+		if hasAlpha {
+			flags |= 0x10
+		}
+		vp8x := make([]byte, 10)
+		vp8x[0] = flags
+		putUint24(vp8x[4:], uint32(bounds.Dx()-1))
+		putUint24(vp8x[7:], uint32(bounds.Dy()-1))
+		chunks = appendChunk(chunks, "VP8X", vp8x)
+		chunks = appendChunk(chunks, "VP8L", bitstream)
+		chunks = appendChunk(chunks, "EXIF", exif)
+	} else {
+		chunks = appendChunk(chunks, "VP8L", bitstream)
+	}
+
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+len(chunks)))
+	copy(header[8:], "WEBP")
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(chunks)
+	return err
+}
+
+func appendChunk(dst []byte, fourCC string, data []byte) []byte {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(data)))
+	dst = append(dst, fourCC...)
+	dst = append(dst, size...)
+	dst = append(dst, data...)
+	if len(data)%2 == 1 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+func encodeVP8L(img *image.NRGBA) ([]byte, bool) {
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := img.Pix[y*img.Stride+4*x:]
+			argb[y*width+x] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+			if p[3] != 0xff {
+				hasAlpha = true
+			}
+		}
+	}
+
+	w := &bitWriter{}
+	w.writeBits(vp8lSignature, 8)
+	w.writeBits(uint32(width-1), 14)
+	w.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 3)
+
+	w.writeBits(1, 1)
+	w.writeBits(transformSubtractGr, 2)
+	subtractGreen(argb)
+
+	w.writeBits(1, 1)
+	w.writeBits(transformPredictor, 2)
+	w.writeBits(predictorSizeBits-2, 3)
+	modes, blocksWidth, blocksHeight := choosePredictors(argb, width, height)
+	writeEntropyCodedImage(w, modes, blocksWidth*blocksHeight, false)
+	residuals := predict(argb, width, height, modes, blocksWidth)
+
+	w.writeBits(0, 1)
+	writeEntropyCodedImage(w, residuals, width*height, true)
+
+	return w.bytes(), hasAlpha
+}
+
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := ((p >> 16) - g) & 0xff
+		b := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// subPixels subtracts b from a on each channel, modulo 256
+func subPixels(a uint32, b uint32) uint32 {
+	var res uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		res |= (((a >> shift) - (b >> shift)) & 0xff) << shift
+	}
+	return res
+}
+
+func clampAddSubtractFull(l uint32, t uint32, tl uint32) uint32 {
+	var res uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := int((l>>shift)&0xff) + int((t>>shift)&0xff) - int((tl>>shift)&0xff)
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+		res |= uint32(v) << shift
+	}
+	return res
+}
+
+func predictor(argb []uint32, width int, x int, y int, mode uint32) uint32 {
+	if x == 0 && y == 0 {
+		return 0xff000000
+	} else if y == 0 {
+		return argb[y*width+x-1]
+	} else if x == 0 {
+		return argb[(y-1)*width+x]
+	}
+
+	l := argb[y*width+x-1]
+	t := argb[(y-1)*width+x]
+	switch mode {
+	case 1:
+		return l
+	case 2:
+		return t
+	}
+	return clampAddSubtractFull(l, t, argb[(y-1)*width+x-1])
+}
+
+// residualCost estimates how expensive a residual is to encode as the sum of its channels seen as signed values
+func residualCost(residual uint32) int {
+	cost := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := int(int8(residual >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// choosePredictors picks for each block the predictor mode giving the smallest residuals and returns them as the predictor sub-image
+func choosePredictors(argb []uint32, width int, height int) ([]uint32, int, int) {
+	blockSize := 1 << predictorSizeBits
+	blocksWidth := (width + blockSize - 1) / blockSize
+	blocksHeight := (height + blockSize - 1) / blockSize
+	modes := make([]uint32, blocksWidth*blocksHeight)
+
+	for by := 0; by < blocksHeight; by++ {
+		for bx := 0; bx < blocksWidth; bx++ {
+			bestMode := predictorModes[0]
+			bestCost := -1
+			for _, mode := range predictorModes {
+				cost := 0
+				for y := by * blockSize; y < (by+1)*blockSize && y < height; y++ {
+					for x := bx * blockSize; x < (bx+1)*blockSize && x < width; x++ {
+						cost += residualCost(subPixels(argb[y*width+x], predictor(argb, width, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode = mode
+					bestCost = cost
+				}
+			}
+			modes[by*blocksWidth+bx] = 0xff000000 | bestMode<<8
+		}
+	}
+	return modes, blocksWidth, blocksHeight
+}
+
+func predict(argb []uint32, width int, height int, modes []uint32, blocksWidth int) []uint32 {
+	residuals := make([]uint32, len(argb))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mode := (modes[(y>>predictorSizeBits)*blocksWidth+(x>>predictorSizeBits)] >> 8) & 0xff
+			residuals[y*width+x] = subPixels(argb[y*width+x], predictor(argb, width, x, y, mode))
+		}
+	}
+	return residuals
+}
+
+// writeEntropyCodedImage writes the pixels with one prefix code group, without color cache nor backward references
+func writeEntropyCodedImage(w *bitWriter, argb []uint32, numPixels int, isMain bool) {
+	w.writeBits(0, 1)
+	if isMain {
+		w.writeBits(0, 1)
+	}
+
+	green := make([]uint32, 256+numLengthCodes)
+	red := make([]uint32, 256)
+	blue := make([]uint32, 256)
+	alpha := make([]uint32, 256)
+	for _, p := range argb[:numPixels] {
+		green[(p>>8)&0xff]++
+		red[(p>>16)&0xff]++
+		blue[p&0xff]++
+		alpha[p>>24]++
+	}
+
+	greenCode := writePrefixCode(w, green)
+	redCode := writePrefixCode(w, red)
+	blueCode := writePrefixCode(w, blue)
+	alphaCode := writePrefixCode(w, alpha)
+	writePrefixCode(w, make([]uint32, numDistanceCodes))
+
+	for _, p := range argb[:numPixels] {
+		greenCode.writeSymbol(w, (p>>8)&0xff)
+		redCode.writeSymbol(w, (p>>16)&0xff)
+		blueCode.writeSymbol(w, p&0xff)
+		alphaCode.writeSymbol(w, p>>24)
+	}
+}
+
+// writePrefixCode writes the description of a prefix code fitted to the symbol counts and returns it
+func writePrefixCode(w *bitWriter, counts []uint32) prefixCode {
+	var symbols []uint32
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, uint32(s))
+		}
+	}
+
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		code := prefixCode{lengths: make([]uint8, len(counts)), codes: make([]uint32, len(counts))}
+		if len(symbols) == 0 {
+			symbols = []uint32{0}
+		}
+		w.writeBits(1, 1)
+		w.writeBits(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.writeBits(0, 1)
+			w.writeBits(symbols[0], 1)
+		} else {
+			w.writeBits(1, 1)
+			w.writeBits(symbols[0], 8)
+		}
+		if len(symbols) == 2 {
+			w.writeBits(symbols[1], 8)
+			code.lengths[symbols[0]] = 1
+			code.lengths[symbols[1]] = 1
+			code.codes = canonicalCodes(code.lengths)
+		}
+		return code
+	}
+
+	w.writeBits(0, 1)
+	lengths := huffmanLengths(counts, maxCodeLength)
+
+	codeLengthCounts := make([]uint32, len(codeLengthCodeOrder))
+	for _, l := range lengths {
+		codeLengthCounts[l]++
+	}
+	ensureTwoSymbols(codeLengthCounts)
+	codeLengthLengths := huffmanLengths(codeLengthCounts, maxCodeLengthLength)
+	codeLengthCode := prefixCode{lengths: codeLengthLengths, codes: canonicalCodes(codeLengthLengths)}
+
+	numCodeLengths := 4
+	for i, s := range codeLengthCodeOrder {
+		if codeLengthLengths[s] > 0 && i+1 > numCodeLengths {
+			numCodeLengths = i + 1
+		}
+	}
+	w.writeBits(uint32(numCodeLengths-4), 4)
+	for _, s := range codeLengthCodeOrder[:numCodeLengths] {
+		w.writeBits(uint32(codeLengthLengths[s]), 3)
+	}
+
+	w.writeBits(0, 1)
+	for _, l := range lengths {
+		codeLengthCode.writeSymbol(w, uint32(l))
+	}
+
+	return prefixCode{lengths: lengths, codes: canonicalCodes(lengths)}
+}
+
+func ensureTwoSymbols(counts []uint32) {
+	used := 0
+	for _, c := range counts {
+		if c > 0 {
+			used++
+		}
+	}
+	for s := range counts {
+		if used >= 2 {
+			return
+		}
+		if counts[s] == 0 {
+			counts[s] = 1
+			used++
+		}
+	}
+}
+
+type huffmanNode struct {
+	count  uint64
+	symbol int
+	left   int
+	right  int
+}
+
+type nodeHeap struct {
+	indices []int
+	nodes   *[]huffmanNode
+}
+
+func (h nodeHeap) Len() int { return len(h.indices) }
+func (h nodeHeap) Less(i, j int) bool {
+	a := (*h.nodes)[h.indices[i]]
+	b := (*h.nodes)[h.indices[j]]
+	if a.count != b.count {
+		return a.count < b.count
+	}
+	return h.indices[i] < h.indices[j]
+}
+func (h nodeHeap) Swap(i, j int)       { h.indices[i], h.indices[j] = h.indices[j], h.indices[i] }
+func (h *nodeHeap) Push(x interface{}) { h.indices = append(h.indices, x.(int)) }
+func (h *nodeHeap) Pop() interface{} {
+	last := h.indices[len(h.indices)-1]
+	h.indices = h.indices[:len(h.indices)-1]
+	return last
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for the counts, no longer than maxLength.
+// Small counts are raised until the tree is shallow enough.
+func huffmanLengths(counts []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(counts))
+	for countMin := uint64(1); ; countMin *= 2 {
+		nodes := make([]huffmanNode, 0, 2*len(counts))
+		h := &nodeHeap{nodes: &nodes}
+		for s, c := range counts {
+			lengths[s] = 0
+			if c > 0 {
+				count := uint64(c)
+				if count < countMin {
+					count = countMin
+				}
+				nodes = append(nodes, huffmanNode{count: count, symbol: s, left: -1, right: -1})
+				h.indices = append(h.indices, len(nodes)-1)
+			}
+		}
+		if len(nodes) == 1 {
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+
+		heap.Init(h)
+		for h.Len() > 1 {
+			a := heap.Pop(h).(int)
+			b := heap.Pop(h).(int)
+			nodes = append(nodes, huffmanNode{count: nodes[a].count + nodes[b].count, symbol: -1, left: a, right: b})
+			heap.Push(h, len(nodes)-1)
+		}
+
+		maxDepth := 0
+		var walk func(node int, depth int)
+		walk = func(node int, depth int) {
+			if nodes[node].symbol >= 0 {
+				lengths[nodes[node].symbol] = uint8(depth)
+				if depth > maxDepth {
+					maxDepth = depth
+				}
+				return
+			}
+			walk(nodes[node].left, depth+1)
+			walk(nodes[node].right, depth+1)
+		}
+		walk(len(nodes)-1, 0)
+
+		if maxDepth <= maxLength {
+			return lengths
+		}
+	}
+}
+
+// canonicalCodes returns the canonical codes for the lengths, bit-reversed to be written least significant bit first
+func canonicalCodes(lengths []uint8) []uint32 {
+	var lengthCounts [maxCodeLength + 1]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			lengthCounts[l]++
+		}
+	}
+
+	var nextCode [maxCodeLength + 1]uint32
+	code := uint32(0)
+	for bits := 1; bits <= maxCodeLength; bits++ {
+		code = (code + lengthCounts[bits-1]) << 1
+		nextCode[bits] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for s, l := range lengths {
+		if l > 0 {
+			codes[s] = reverseBits(nextCode[l], l)
+			nextCode[l]++
+		}
+	}
+	return codes
+}
+
+func reverseBits(code uint32, length uint8) uint32 {
+	var res uint32
+	for i := uint8(0); i < length; i++ {
+		res = res<<1 | code&1
+		code >>= 1
+	}
+	return res
+}
@@ -0,0 +1,52 @@
+package formats
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func testImage(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(x * y), B: uint8(255 - y*3), A: uint8(128 + x%128)})
+		}
+	}
+	return img
+}
+
+func TestWebPLosslessRoundTrip(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {3, 2}, {37, 50}, {300, 200}} {
+		img := testImage(size.X, size.Y)
+		buf := &bytes.Buffer{}
+		if err := EncodeWebP(buf, img, nil); err != nil {
+			t.Fatalf("Encoding %v failed: %v", size, err)
+		}
+		decoded, err := webp.Decode(buf)
+		if err != nil {
+			t.Fatalf("Decoding %v failed: %v", size, err)
+		}
+		for x := 0; x < size.X; x++ {
+			for y := 0; y < size.Y; y++ {
+				if got := color.NRGBAModel.Convert(decoded.At(x, y)); got != img.At(x, y) {
+					t.Fatalf("Pixel (%d, %d) of %v is %v, wanted %v", x, y, size, got, img.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestWebPExifIsReadable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := EncodeWebP(buf, testImage(20, 10), exifPayload("type=julia")); err != nil {
+		t.Fatalf("Encoding failed: %v", err)
+	}
+	config, err := webp.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil || config.Width != 20 || config.Height != 10 {
+		t.Errorf("Decoding the configuration failed: %v, %v", config, err)
+	}
+}
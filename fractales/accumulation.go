@@ -0,0 +1,140 @@
+package fractales
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// accumulationCacheSize is the number of images whose chaos game is kept for progressive accumulation
+const accumulationCacheSize = 16
+
+// accumulationCacheBytes is the number of bytes the chaos games kept for progressive accumulation may hold
+const accumulationCacheBytes = 1 << 30
+
+// accumulation is the chaos game of an image accumulated over its renders
+type accumulation struct {
+	mu     sync.Mutex
+	passes int64
+	result interface{}
+	size   int64
+}
+
+// accumulated is the result of a chaos game which may be accumulated, knowing how many bytes it holds
+type accumulated interface {
+	memorySize() int64
+}
+
+var (
+	accumulationsMu   sync.Mutex
+	accumulations     = make(map[string]*accumulation)
+	accumulationOrder []string
+)
+
+// accumulationKey returns the key of the image in the accumulation cache, ignoring the parameters which only change how many points are drawn
+func accumulationKey(imageParams params.ImageParams) string {
+	values := imageParams.Describe().Values()
+	for _, key := range []string{"spp", "budget", "seed", "accumulate"} {
+		values.Del(key)
+	}
+	return values.Encode()
+}
+
+// lookupAccumulation returns the accumulation of the image, creating it and evicting the least recently used ones if needed
+func lookupAccumulation(imageParams params.ImageParams) *accumulation {
+	key := accumulationKey(imageParams)
+	accumulationsMu.Lock()
+	defer accumulationsMu.Unlock()
+
+	for i, k := range accumulationOrder {
+		if k == key {
+			accumulationOrder = append(accumulationOrder[:i], accumulationOrder[i+1:]...)
+			break
+		}
+	}
+	accumulationOrder = append(accumulationOrder, key)
+
+	acc, ok := accumulations[key]
+	if !ok {
+		acc = &accumulation{}
+		accumulations[key] = acc
+		evictAccumulations(accumulationCacheSize, accumulationCacheBytes)
+	}
+	return acc
+}
+
+// resizeAccumulation records the number of bytes held by the accumulation, evicting the least recently used accumulations if needed
+func resizeAccumulation(acc *accumulation, size int64) {
+	accumulationsMu.Lock()
+	defer accumulationsMu.Unlock()
+	acc.size = size
+	evictAccumulations(accumulationCacheSize, accumulationCacheBytes)
+}
+
+// evictAccumulations removes the least recently used accumulations until at most maxEntries of them hold at most maxBytes.
+// An accumulation larger than maxBytes is removed as well. accumulationsMu must be held.
+func evictAccumulations(maxEntries int, maxBytes int64) {
+	size := int64(0)
+	for _, acc := range accumulations {
+		size += acc.size
+	}
+	for len(accumulationOrder) > 0 && (len(accumulationOrder) > maxEntries || size > maxBytes) {
+		size -= accumulations[accumulationOrder[0]].size
+		delete(accumulations, accumulationOrder[0])
+		accumulationOrder = accumulationOrder[1:]
+	}
+}
+
+// accumulate plays a chaos game with create, given the seed to play it with, and, if the parameters ask for progressive accumulation,
+// merges it with the ones of the previous renders of the image, the seed being offset by the number of previous renders so that each render draws new points.
+// merge must add the previous result to the new one, which is never shared. Interrupted chaos games are not accumulated.
+// The accumulation is only locked to reserve the seed and to merge the chaos game, so that concurrent renders of the image play theirs in parallel.
+func accumulate(ctx context.Context, imageParams params.ImageParams, create func(seed int64) interface{}, merge func(previous interface{}, next interface{}) interface{}) interface{} {
+	if !imageParams.Accumulate {
+		return create(imageParams.Seed)
+	}
+
+	acc := lookupAccumulation(imageParams)
+	acc.mu.Lock()
+	pass := acc.passes
+	acc.passes++
+	acc.mu.Unlock()
+
+	result := create(imageParams.Seed + pass)
+	if ctx.Err() != nil {
+		return result
+	}
+
+	acc.mu.Lock()
+	if acc.result != nil {
+		result = merge(acc.result, result)
+	}
+	acc.result = result
+	acc.mu.Unlock()
+
+	resizeAccumulation(acc, result.(accumulated).memorySize())
+	return result
+}
+
+// accumulateHistogram returns the histogram given by create, accumulated over the renders of the image if the parameters ask for it
+func accumulateHistogram(ctx context.Context, imageParams params.ImageParams, create func(seed int64) ifsHistogram) ifsHistogram {
+	return accumulate(ctx, imageParams, func(seed int64) interface{} {
+		return create(seed)
+	}, func(previous interface{}, next interface{}) interface{} {
+		histogram := next.(ifsHistogram)
+		histogram.merge(previous.(ifsHistogram))
+		return histogram
+	}).(ifsHistogram)
+}
+
+// accumulateFlame returns the flame accumulator given by create, accumulated over the renders of the image if the parameters ask for it
+func accumulateFlame(ctx context.Context, imageParams params.ImageParams, create func(seed int64) flameAccumulator) flameAccumulator {
+	return accumulate(ctx, imageParams, func(seed int64) interface{} {
+		return create(seed)
+	}, func(previous interface{}, next interface{}) interface{} {
+		acc := next.(flameAccumulator)
+		acc.merge(previous.(flameAccumulator))
+		return acc
+	}).(flameAccumulator)
+}
@@ -0,0 +1,82 @@
+package fractales
+
+import (
+	"context"
+	"image/color"
+	"testing"
+
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+func resetAccumulations() {
+	accumulationsMu.Lock()
+	defer accumulationsMu.Unlock()
+	accumulations = make(map[string]*accumulation)
+	accumulationOrder = nil
+}
+
+func accumulationParams(width int) params.ImageParams {
+	palette := palettes.Colors{Divergence: palettes.Black, ListColors: []color.Color{palettes.White}}
+	return params.ImageParams{Width: width, Height: 1, Palette: palette, Seed: 7, Accumulate: true}
+}
+
+func TestAccumulate(t *testing.T) {
+	resetAccumulations()
+	defer resetAccumulations()
+
+	imageParams := accumulationParams(2)
+	var seeds []int64
+	create := func(seed int64) ifsHistogram {
+		seeds = append(seeds, seed)
+		histogram := newIFSHistogram(imageParams)
+		histogram.Counts[0] = 1
+		return histogram
+	}
+
+	accumulateHistogram(context.Background(), imageParams, create)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	accumulateHistogram(cancelled, imageParams, create)
+	histogram := accumulateHistogram(context.Background(), imageParams, create)
+
+	if len(seeds) != 3 || seeds[0] != 7 || seeds[1] != 8 || seeds[2] != 9 {
+		t.Errorf("Each render should draw new points, got seeds %v", seeds)
+	}
+	if histogram.Counts[0] != 2 {
+		t.Errorf("Interrupted chaos games should not be accumulated, got %d points", histogram.Counts[0])
+	}
+	if acc := lookupAccumulation(imageParams); acc.size != 8 {
+		t.Errorf("The accumulation should hold 8 bytes, got %d", acc.size)
+	}
+}
+
+func TestEvictAccumulations(t *testing.T) {
+	resetAccumulations()
+	defer resetAccumulations()
+
+	for width := 1; width <= 3; width++ {
+		lookupAccumulation(accumulationParams(width)).size = 40
+	}
+	accumulationsMu.Lock()
+	evictAccumulations(accumulationCacheSize, 100)
+	accumulationsMu.Unlock()
+	if len(accumulations) != 2 || lookupAccumulation(accumulationParams(2)).size != 40 {
+		t.Errorf("The least recently used accumulation should be evicted, got %v", accumulationOrder)
+	}
+
+	lookupAccumulation(accumulationParams(3)).size = 200
+	accumulationsMu.Lock()
+	evictAccumulations(accumulationCacheSize, 100)
+	accumulationsMu.Unlock()
+	if len(accumulations) != 0 {
+		t.Errorf("Accumulations larger than the cache should be evicted, got %v", accumulationOrder)
+	}
+
+	for width := 1; width <= 20; width++ {
+		lookupAccumulation(accumulationParams(width))
+	}
+	if len(accumulations) != accumulationCacheSize {
+		t.Errorf("The cache should hold at most %d accumulations, got %d", accumulationCacheSize, len(accumulations))
+	}
+}
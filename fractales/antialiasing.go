@@ -0,0 +1,126 @@
+package fractales
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"sync"
+
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// adaptiveThreshold is the difference on a color channel with a neighbouring pixel above which a pixel is refined
+const adaptiveThreshold = 0x1000
+
+// CreateAntialiasedComputer returns a Computation taking several samples per pixel and averaging their colors
+func CreateAntialiasedComputer(computeValue ValueComputation, colorPixel palettes.ColoringFunction, imageParams params.ImageParams) Computation {
+	colorAt := valueColor(computeValue, colorPixel)
+
+	if imageParams.AA.Mode == params.AAAdaptive {
+		lookup := ComputeValueGrid(computeValue, imageParams, 1).Lookup()
+		return createAdaptiveComputer(func(x int, y int) color.RGBA64 {
+			return colorPixel(lookup(float64(x), float64(y)))
+		}, colorAt, imageParams)
+	}
+	return createSampledComputer(colorAt, imageParams)
+}
+
+// valueColor returns the ColorComputation coloring the values of computeValue with colorPixel
+func valueColor(computeValue ValueComputation, colorPixel palettes.ColoringFunction) ColorComputation {
+	return func(x float64, y float64) color.RGBA64 {
+		return colorPixel(computeValue(x, y))
+	}
+}
+
+// createSampledComputer returns a Computation averaging samples x samples colors of each pixel, on a regular grid or jittered
+func createSampledComputer(colorAt ColorComputation, imageParams params.ImageParams) Computation {
+	samples := imageParams.AA.Samples
+
+	return func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup) {
+		for y := ymin; y < ymax; y++ {
+			var rng *rand.Rand
+			if imageParams.AA.Mode == params.AAJitter {
+				rng = rand.New(newPixelSource(x, y))
+			}
+			img.SetRGBA64(x, y, samplePixel(colorAt, x, y, samples, rng))
+		}
+		wg.Done()
+	}
+}
+
+// pixelSource is a random source seeded by the position of a pixel, so that the jittered samples of a pixel do not depend on the order the pixels are computed in
+type pixelSource struct {
+	state uint64
+}
+
+func newPixelSource(x int, y int) *pixelSource {
+	return &pixelSource{state: uint64(x)<<32 ^ uint64(uint32(y))}
+}
+
+// Uint64 returns the next number of the splitmix64 sequence
+func (s *pixelSource) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *pixelSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *pixelSource) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+// createAdaptiveComputer returns a Computation sampling each pixel once and only supersampling the pixels whose color, given by centerColor, differs strongly from one of their neighbours
+func createAdaptiveComputer(centerColor func(x int, y int) color.RGBA64, colorAt ColorComputation, imageParams params.ImageParams) Computation {
+	return func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup) {
+		for y := ymin; y < ymax; y++ {
+			c := centerColor(x, y)
+			if (x > 0 && differs(c, centerColor(x-1, y))) ||
+				(x < imageParams.Width-1 && differs(c, centerColor(x+1, y))) ||
+				(y > 0 && differs(c, centerColor(x, y-1))) ||
+				(y < imageParams.Height-1 && differs(c, centerColor(x, y+1))) {
+				c = samplePixel(colorAt, x, y, imageParams.AA.Samples, nil)
+			}
+			img.SetRGBA64(x, y, c)
+		}
+		wg.Done()
+	}
+}
+
+// samplePixel averages the colors of samples x samples points of pixel (x, y), on a regular grid or jittered inside each grid cell if rng is set
+func samplePixel(colorAt ColorComputation, x int, y int, samples int, rng *rand.Rand) color.RGBA64 {
+	var r, g, b, a uint64
+	for i := 0; i < samples; i++ {
+		for j := 0; j < samples; j++ {
+			dx, dy := 0.5, 0.5
+			if rng != nil {
+				dx, dy = rng.Float64(), rng.Float64()
+			}
+			c := colorAt(float64(x)+(float64(i)+dx)/float64(samples), float64(y)+(float64(j)+dy)/float64(samples))
+			r += uint64(c.R)
+			g += uint64(c.G)
+			b += uint64(c.B)
+			a += uint64(c.A)
+		}
+	}
+
+	count := uint64(samples * samples)
+	return color.RGBA64{R: uint16(r / count), G: uint16(g / count), B: uint16(b / count), A: uint16(a / count)}
+}
+
+func differs(c1 color.RGBA64, c2 color.RGBA64) bool {
+	return channelDiff(c1.R, c2.R) > adaptiveThreshold || channelDiff(c1.G, c2.G) > adaptiveThreshold ||
+		channelDiff(c1.B, c2.B) > adaptiveThreshold || channelDiff(c1.A, c2.A) > adaptiveThreshold
+}
+
+func channelDiff(c1 uint16, c2 uint16) uint16 {
+	if c1 > c2 {
+		return c1 - c2
+	}
+	return c2 - c1
+}
@@ -2,6 +2,7 @@ package fractales
 
 import (
 	"image"
+	"image/color"
 	"math/big"
 	"sync"
 
@@ -9,22 +10,22 @@ import (
 	"github.com/Balise42/marzipango/params"
 )
 
-func scale(x int, y int, pos params.ImageParams) complex128 {
-	re := pos.Left + float64(x)/float64(pos.Width)*(pos.Right-pos.Left)
-	im := pos.Top + float64(y)/float64(pos.Height)*(pos.Bottom-pos.Top)
+func scale(x float64, y float64, pos params.ImageParams) complex128 {
+	re := pos.Left + x/float64(pos.Width)*(pos.Right-pos.Left)
+	im := pos.Top + y/float64(pos.Height)*(pos.Bottom-pos.Top)
 
 	return complex(re, im)
 }
 
-func scaleHigh(x int, y int, pos params.ImageParams) LargeComplex {
-	ratioX := float64(x) / float64(pos.Width)
+func scaleHigh(x float64, y float64, pos params.ImageParams) LargeComplex {
+	ratioX := x / float64(pos.Width)
 
 	re := big.NewFloat(0)
 	re.Sub(big.NewFloat(pos.Right), big.NewFloat(pos.Left))
 	re.Mul(big.NewFloat(float64(ratioX)), re)
 	re.Add(re, big.NewFloat(pos.Left))
 
-	ratioY := float64(y) / float64(pos.Height)
+	ratioY := y / float64(pos.Height)
 
 	im := big.NewFloat(0)
 	im.Sub(big.NewFloat(pos.Bottom), big.NewFloat(pos.Top))
@@ -37,14 +38,42 @@ func scaleHigh(x int, y int, pos params.ImageParams) LargeComplex {
 // Computation fills in image pixels according to parameters
 type Computation func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup)
 
-// ValueComputation is a value computation function
-type ValueComputation func(x int, y int) (float64, bool)
+// StripComputation returns the Computation filling in the rows from top to bottom of an image, as an image of bottom - top rows
+type StripComputation func(top int, bottom int) Computation
+
+// BandValueComputation returns the ValueComputation of the rows from top to bottom of an image, at positions in pixels of the whole image
+type BandValueComputation func(top int, bottom int) ValueComputation
+
+// ValueComputation is a value computation function at a position in pixels, the center of pixel (x, y) being (x + 0.5, y + 0.5). It returns the value of the point, whether the point escaped, and the interior coloring value of the point if it did not.
+type ValueComputation func(x float64, y float64) (float64, bool, float64)
+
+// ColorComputation is a color computation function at a position in pixels, for fractals whose points are not all colored from a value
+type ColorComputation func(x float64, y float64) color.RGBA64
+
+// CreateColorComputer returns a Computation filling in the pixels with the colors of the ColorComputation, sampled according to the antialiasing mode
+func CreateColorComputer(colorAt ColorComputation, imageParams params.ImageParams) Computation {
+	switch imageParams.AA.Mode {
+	case params.AANone:
+		return func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup) {
+			for y := ymin; y < ymax; y++ {
+				img.SetRGBA64(x, y, colorAt(float64(x)+0.5, float64(y)+0.5))
+			}
+			wg.Done()
+		}
+	case params.AAAdaptive:
+		centers := ComputeColorGrid(colorAt, imageParams)
+		return createAdaptiveComputer(func(x int, y int) color.RGBA64 {
+			return centers[y*imageParams.Width+x]
+		}, colorAt, imageParams)
+	}
+	return createSampledComputer(colorAt, imageParams)
+}
 
 func CreateComputer(computeValue ValueComputation, colorPixel palettes.ColoringFunction, params params.ImageParams) Computation {
 	return func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup) {
 		for y := ymin; y < ymax; y++ {
-			value, converge := computeValue(x, y)
-			colorPixel(img, x, y, value, converge)
+			value, converge, interior := computeValue(float64(x)+0.5, float64(y)+0.5)
+			img.SetRGBA64(x, y, colorPixel(value, converge, interior))
 		}
 		wg.Done()
 	}
@@ -1,80 +1,95 @@
 package fractales
 
 import (
-	"github.com/Balise42/marzipango/fractales/orbits"
-	"github.com/Balise42/marzipango/params"
+	"context"
 	"math/rand"
+
+	"github.com/Balise42/marzipango/params"
 )
 
+// fernWindow is the window of the plane holding the fern
+var fernWindow = ifsWindow{Left: -2.1820, Right: 2.6558, Top: 9.9983, Bottom: 0}
 
+// fernIterations is the number of iterations of the chaos game drawing the fern
+const fernIterations = 100000000
 
-func FernValueComputeLow(params params.ImageParams) ValueComputation {
-	ifsMap := createFernMap(params)
-	
-	return func(x int, y int) (float64, bool) {
-		val, ok := ifsMap[orbits.Coords{int64(x), int64(y)}]
-		if ok {
-			return float64(val), true
-		}
-		return float64(0), false
+func FernValueComputeLow(ctx context.Context, params params.ImageParams, progress ProgressFunction) ValueComputation {
+	histogram := accumulateHistogram(ctx, params, func(seed int64) ifsHistogram {
+		pass := params
+		pass.Seed = seed
+		return createFernHistogram(ctx, pass, chaosGameIterations(params, fernIterations), 0, params.Height, progress)
+	})
+
+	return func(x float64, y float64) (float64, bool, float64) {
+		val, ok := histogram.value(x, y)
+		return val, ok, 0
 	}
 }
 
-func createFernMap(params params.ImageParams) map[orbits.Coords]int {
-	res := make(map[orbits.Coords]int)
-	x := float64(0)
-	y := float64(0)
-	res[scaleFern(x, y, params)] = 1
+// FernBandValueComputer returns a BandValueComputation playing the chaos game of the fern again for each band of rows of the image,
+// keeping only the points falling in it, so that the histogram of a band holding at most maxBytes is kept rather than the one of the whole image
+func FernBandValueComputer(ctx context.Context, params params.ImageParams, maxBytes int64) BandValueComputation {
+	iterations := chaosGameIterations(params, fernIterations)
+	return bandHistograms(params, iterations, maxBytes, func(top int, bottom int) ifsHistogram {
+		return createFernHistogram(ctx, params, iterations, top, bottom, nil)
+	})
+}
+
+func createFernHistogram(ctx context.Context, params params.ImageParams, iterations int, top int, bottom int, progress ProgressFunction) ifsHistogram {
+	ctx, cancel := withBudget(ctx, params)
+	defer cancel()
 
-	for i := 0; i < 100000000; i++ {
-		rule := rand.Float32()
-		var a, b, c, d, e, f float64
-		if rule < 0.05 {
-			a = 0
-			b = 0
-			c = 0
-			d = 0.16
-			e = 0
-			f = 0
-		} else if rule < 0.86 {
-			a = 0.85
-			b = 0.04
-			c = -0.04
-			d = 0.85
-			e = 0
-			f = 1.6
-		} else if rule < 0.93 {
-			a = -0.15
-			b = 0.28
-			c = 0.26
-			d = 0.24
-			e = 0
-			f = 0.44
-		} else {
-			a = 0.20
-			b = -0.26
-			c = 0.23
-			d = 0.22
-			e = 0
-			f = 1.6
-		}
-		x1 := a * x + b * y + e
-		y1 := c * x + d * y + f
-		coords := scaleFern(x1, y1, params)
-		_, ok := res[coords]
-		if !ok {
-			res[coords] = 1
-		} else {
-			res[coords] = res[coords] + 1
+	histograms := newIFSHistograms(params, parallelWorkers(iterations), top, bottom)
+	parallelChaosGame(ctx, iterations, params.Seed, progress, func(worker int, rnd *rand.Rand, iterations int, next func(i int) bool) {
+		res := histograms[worker]
+		x := float64(0)
+		y := float64(0)
+
+		for i := 0; next(i); i++ {
+			rule := rnd.Float32()
+			var a, b, c, d, e, f float64
+			if rule < 0.05 {
+				a = 0
+				b = 0
+				c = 0
+				d = 0.16
+				e = 0
+				f = 0
+			} else if rule < 0.86 {
+				a = 0.85
+				b = 0.04
+				c = -0.04
+				d = 0.85
+				e = 0
+				f = 1.6
+			} else if rule < 0.93 {
+				a = -0.15
+				b = 0.28
+				c = 0.26
+				d = 0.24
+				e = 0
+				f = 0.44
+			} else {
+				a = 0.20
+				b = -0.26
+				c = 0.23
+				d = 0.22
+				e = 0
+				f = 1.6
+			}
+			x1 := a * x + b * y + e
+			y1 := c * x + d * y + f
+			if index, ok := fernWindow.index(x1, y1, params); ok {
+				res.add(index)
+			}
+			x = x1
+			y = y1
 		}
-		x = x1
-		y = y1
-	}
-	return res
-}
+	})
 
-func scaleFern(x1 float64, y1 float64, imageParams params.ImageParams) orbits.Coords {
-	x := (x1 + 2.1820) * float64(imageParams.Width) / (2.1820 + 2.6558)
-	y := (9.9983 - y1) * float64(imageParams.Height) / 9.9983
-	return orbits.Coords{int64(x), int64(y)}
+	histogram := mergeHistograms(histograms)
+	if index, ok := fernWindow.index(0, 0, params); ok {
+		histogram.add(index)
+	}
+	return histogram
 }
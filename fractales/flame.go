@@ -1,174 +1,406 @@
 package fractales
 
 import (
-	"github.com/Balise42/marzipango/fractales/orbits"
-	"github.com/Balise42/marzipango/params"
+	"context"
 	"image"
 	"image/color"
 	"math"
 	"math/rand"
+	"sort"
 	"sync"
+
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
 )
 
-func CreateFlameComputer(params params.ImageParams) Computation {
-	flameFuncs := createFlameFuncs()
-	ifsMap := createFlameMap(params, flameFuncs)
+// flameIterations is the number of iterations of the chaos game drawing the flame
+const flameIterations = 500000000
 
-	comp := func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup) {
-		for y := ymin; y < ymax; y++ {
-			val, ok := ifsMap[orbits.Coords{int64(x), int64(y)}]
-			if ok {
-				img.Set(x, y, val)
-			} else {
-				img.Set(x, y, params.Palette.Divergence)
-			}
+// flamePaletteSize is the number of colors the palette of a flame is sampled to
+const flamePaletteSize = 256
+
+// FlameLeft, FlameRight, FlameTop and FlameBottom are the window of the plane showing the default flame
+const (
+	FlameLeft   = -1.0
+	FlameRight  = 0.0
+	FlameTop    = -1.0
+	FlameBottom = 0.0
+)
+
+// DefaultFlame returns the flame drawn when none is given, with the tone mapping and density estimation defaults of flam3
+func DefaultFlame() params.Flame {
+	return params.Flame{
+		Transforms: []params.FlameTransform{
+			{Weight: 0.08, Color: 0, Affine: params.AffineTransform{A: -0.98, B: -0.12, C: -0.6, D: 0.01, E: -0.028, F: 0.07}, Variations: map[string]float64{"horseshoe": 1}},
+			{Weight: 0.72, Color: 0.25, Affine: params.AffineTransform{A: -0.5, B: 0.43, C: -0.06, D: -0.44, E: -0.09, F: -0.88}, Variations: map[string]float64{"cylinder": 1}},
+			{Weight: 0.05, Color: 0.5, Affine: params.AffineTransform{A: 0.18, B: -0.12, C: -0.18, D: 0.04, E: 0.18, F: 0.40}, Variations: map[string]float64{"spiral": 1}},
+			{Weight: 0.02, Color: 0.75, Affine: params.AffineTransform{A: 1.62, B: 1.03, C: 0.59, D: -0.66, E: 0.25, F: -0.72}, Variations: map[string]float64{"bent": 1}},
+			{Weight: 0.13, Color: 1, Affine: params.AffineTransform{A: 0.02, B: 0.13, C: -1.17, D: -1.44, E: -0.17, F: -0.14}, Variations: map[string]float64{"diamond": 1}},
+		},
+		Gamma:          4,
+		Vibrancy:       1,
+		Brightness:     4,
+		Estimator:      9,
+		EstimatorMin:   0,
+		EstimatorCurve: 0.4,
+	}
+}
+
+// compiledTransform is a flame transform with its variations looked up
+type compiledTransform struct {
+	color      float64
+	affine     params.AffineTransform
+	variations []variation
+	weights    []float64
+	post       *params.AffineTransform
+}
+
+func compileTransform(t params.FlameTransform) compiledTransform {
+	compiled := compiledTransform{color: t.Color, affine: t.Affine, post: t.Post}
+	// variations drawing random numbers must always be applied in the same order for a seed to always give the same flame
+	names := make([]string, 0, len(t.Variations))
+	for name := range t.Variations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v, weight := Variations[name], t.Variations[name]; v != nil && weight != 0 {
+			compiled.variations = append(compiled.variations, v)
+			compiled.weights = append(compiled.weights, weight)
 		}
-		wg.Done()
 	}
+	return compiled
+}
+
+// apply returns the point and color coordinate moved by the transform
+func (t *compiledTransform) apply(x float64, y float64, c float64, rnd *rand.Rand) (float64, float64, float64) {
+	a := t.affine
+	ax, ay := a.A*x+a.B*y+a.E, a.C*x+a.D*y+a.F
+
+	nx, ny := 0.0, 0.0
+	for i, v := range t.variations {
+		vx, vy := v(ax, ay, a, rnd)
+		nx += t.weights[i] * vx
+		ny += t.weights[i] * vy
+	}
+	if t.post != nil {
+		p := t.post
+		nx, ny = p.A*nx+p.B*ny+p.E, p.C*nx+p.D*ny+p.F
+	}
+	return nx, ny, (c + t.color) / 2
+}
 
-	return comp
+// flameAccumulator sums the 16 bit colors of the points falling on each pixel of the rows of the image from Top, as many as Values holds, with their count,
+// as four values per pixel. Integer sums do not depend on the order of the points, so that a seed always gives the same flame.
+type flameAccumulator struct {
+	Width      int
+	Height     int
+	Top        int
+	Values     []uint64
+	Iterations int
 }
 
-type ifsFunc func(float64, float64) (float64, float64)
+// newFlameAccumulator returns an accumulator of the rows from top to bottom of the image
+func newFlameAccumulator(imageParams params.ImageParams, top int, bottom int) flameAccumulator {
+	return flameAccumulator{Width: imageParams.Width, Height: imageParams.Height, Top: top, Values: make([]uint64, 4*imageParams.Width*(bottom-top))}
+}
 
-func createFlameFuncs() []ifsFunc {
-	V0 := func(x float64, y float64) (float64, float64) {
-		sqr := math.Sqrt(x*x + y*y)
-		return 1/sqr * ((x-y)*(x+y)), 1/sqr * 2*x*y
+// bottom returns the row of the image below the rows of the accumulator
+func (a flameAccumulator) bottom() int {
+	if a.Width == 0 {
+		return a.Top
 	}
+	return a.Top + len(a.Values)/(4*a.Width)
+}
 
-	V1 := func(x float64, y float64) (float64, float64) {
-		return math.Sin(x), y
+// add sums a point of the color on the pixel of the given index in the image, if the accumulator holds its row
+func (a flameAccumulator) add(index int, col [3]uint64) {
+	if i := 4 * (index - a.Top*a.Width); i >= 0 && i < len(a.Values) {
+		a.Values[i] += col[0]
+		a.Values[i+1] += col[1]
+		a.Values[i+2] += col[2]
+		a.Values[i+3]++
 	}
+}
 
-	V2 := func(x float64, y float64) (float64, float64) {
-		sqr := math.Sqrt(x*x + y*y)
-		theta := math.Atan(x / y)
-		return 1/sqr * (math.Cos(theta) + math.Sin(sqr)), 1/sqr * (math.Sin(theta) - math.Cos(sqr))
+// merge adds the sums of the other accumulator, of the same rows, to the accumulator
+func (a *flameAccumulator) merge(other flameAccumulator) {
+	for i, value := range other.Values {
+		a.Values[i] += value
 	}
+	a.Iterations += other.Iterations
+}
+
+// memorySize returns the number of bytes held by the accumulator
+func (a flameAccumulator) memorySize() int64 {
+	return 8 * int64(len(a.Values))
+}
 
-	V3 := func(x float64, y float64) (float64, float64) {
-		if x >= 0 && y >= 0 {
-			return x, y
-		} else if x < 0 && y >= 0 {
-			return 2*x, y
-		} else if x >= 0 && y < 0 {
-			return x, y/2
-		} else {
-			return 2*x, y/2
+// flameDensities holds the summed colors from 0 to 1 and the counts of the points on each pixel after density estimation, as four values per pixel,
+// and the number of iterations giving them
+type flameDensities struct {
+	Width      int
+	Height     int
+	Values     []float64
+	Iterations int
+}
+
+// flamePalette samples the colors of the palette as 16 bit red, green and blue
+func flamePalette(colors []color.Color) [][3]uint64 {
+	palette := make([][3]uint64, flamePaletteSize)
+	if len(colors) == 0 {
+		colors = []color.Color{palettes.White}
+	}
+	for i := range palette {
+		c := palettes.ColorFromGradient(float64(i)/float64(flamePaletteSize-1), colors)
+		palette[i] = [3]uint64{uint64(c.R), uint64(c.G), uint64(c.B)}
+	}
+	return palette
+}
+
+func CreateFlameComputer(ctx context.Context, params params.ImageParams, progress ProgressFunction) Computation {
+	acc := accumulateFlame(ctx, params, func(seed int64) flameAccumulator {
+		pass := params
+		pass.Seed = seed
+		return createFlameAccumulator(ctx, pass, chaosGameIterations(params, flameIterations), 0, params.Height, progress)
+	})
+	return acc.computer(params, 0, params.Height)
+}
+
+// CreateFlameStripComputer returns a StripComputation playing the chaos game of the flame again for each band of rows of the image, keeping only the points
+// falling in it or close enough to be blurred into it, so that the accumulator of a band holding at most maxBytes is kept rather than the one of the whole image.
+// The rows of each strip are then density estimated and tone mapped. Only the accumulator of the last band is kept, so the strips must be asked for from top to bottom.
+func CreateFlameStripComputer(ctx context.Context, params params.ImageParams, maxBytes int64) StripComputation {
+	iterations := chaosGameIterations(params, flameIterations)
+	rows := bandRows(params, iterations, 32, maxBytes)
+	margin := densityMargin(params.Flame)
+	var acc flameAccumulator
+	played := false
+
+	return func(top int, bottom int) Computation {
+		from, to := top-margin, bottom+margin
+		if from < 0 {
+			from = 0
+		}
+		if to > params.Height {
+			to = params.Height
 		}
+		if !played || from < acc.Top || to > acc.bottom() {
+			acc = createFlameAccumulator(ctx, params, iterations, from, bandEnd(params, from, to, rows), nil)
+			played = true
+		}
+		return acc.computer(params, top, bottom)
 	}
+}
 
-	V4 := func(x float64, y float64) (float64, float64) {
-		sqr := math.Sqrt(x*x + y*y)
-		theta := math.Atan(x / y)
-		return math.Sin(theta) * math.Cos(sqr), math.Cos(theta) * math.Sin(sqr)
-	}
-
-	return []ifsFunc{V0, V1, V2, V3, V4}
-}
-
-type triplet struct {
-	R float64
-	G float64
-	B float64
-	A float64
-}
-
-func createFlameMap(params params.ImageParams, funcs []ifsFunc) map[orbits.Coords]color.NRGBA {
-	imgRes := make(map[orbits.Coords]color.NRGBA)
-	x := float64(0)
-	y := float64(0)
-	rf := []float64{1.0, 1.0, 1.0, 1.0, 1.0}
-	gf := []float64{0.0, 0.1, 0.2, 0.3, 0.4}
-	bf := []float64{0, 0, 0, 0, 0}
-
-	histo := make(map[orbits.Coords]int)
-	cols := make(map[orbits.Coords]triplet)
-	col := triplet{1.0, 0, 0, 0}
-
-	maxValue := 0
-
-	for i := 0; i < 500000000; i++ {
-		rule := rand.Float32()
-		var a, b, c, d, e, f float64
-		var funcIndex int
-		if rule < 0.08 {
-			a = -0.98
-			b = -0.12
-			c = -0.6
-			d = 0.01
-			e = -0.028
-			f = 0.07
-			funcIndex = 0
-		} else if rule < 0.8 {
-			a = -0.5
-			b = 0.43
-			c = -0.06
-			d = -0.44
-			e = -0.09
-			f = -0.88
-			funcIndex = 1
-		} else if rule < 0.85 {
-			a = 0.18
-			b = -0.12
-			c = -0.18
-			d = 0.04
-			e = 0.18
-			f = 0.40
-			funcIndex = 2
-		} else if rule < 0.87 {
-			a = 1.62
-			b = 1.03
-			c = 0.59
-			d = -0.66
-			e = 0.25
-			f = -0.72
-			funcIndex = 3
-		} else {
-			a = 0.02
-			b = 0.13
-			c = -1.17
-			d = -1.44
-			e = -0.17
-			f = -0.14
-			funcIndex = 4
+// computer returns the Computation filling in the rows from top to bottom of the image, as an image of bottom - top rows, with the density estimated
+// and tone mapped pixels of the accumulator
+func (a flameAccumulator) computer(params params.ImageParams, top int, bottom int) Computation {
+	pixels := a.estimateDensity(params.Flame, top, bottom).toneMap(params)
+	return func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup) {
+		for y := ymin; y < ymax; y++ {
+			img.SetRGBA64(x, y, pixels[y*a.Width+x])
 		}
-		x1 := a*x + b*y + e
-		y1 := c*x + d*y + f
-		x1, y1 = funcs[funcIndex](x1, y1)
-
-		coords := scaleFlame(x1, y1, params)
-		//col := cols[coords]
-		col = triplet{ (col.R + rf[funcIndex]) / 2, col.G + gf[funcIndex], col.B + bf[funcIndex], 1.0 }
-		cols[coords] = col
-		if i > 20 {
-			histo[coords] = histo[coords] + 1
-			cols[coords] = col
-			if histo[coords] > maxValue {
-				maxValue = histo[coords]
+		wg.Done()
+	}
+}
+
+// createFlameAccumulator plays the chaos game of the flame of the parameters into an accumulator of the rows from top to bottom of the image
+func createFlameAccumulator(ctx context.Context, params params.ImageParams, iterations int, top int, bottom int, progress ProgressFunction) flameAccumulator {
+	flame := params.Flame
+	if len(flame.Transforms) == 0 {
+		return newFlameAccumulator(params, top, bottom)
+	}
+
+	transforms := make([]compiledTransform, len(flame.Transforms))
+	weights := make([]float64, len(flame.Transforms))
+	for i, t := range flame.Transforms {
+		transforms[i] = compileTransform(t)
+		weights[i] = t.Weight
+	}
+	var final *compiledTransform
+	if flame.Final != nil {
+		compiled := compileTransform(*flame.Final)
+		final = &compiled
+	}
+	pick := weightedPicker(weights)
+	palette := flamePalette(params.Palette.ListColors)
+	ctx, cancel := withBudget(ctx, params)
+	defer cancel()
+
+	accumulators := make([]flameAccumulator, parallelWorkers(iterations))
+	for i := range accumulators {
+		accumulators[i] = newFlameAccumulator(params, top, bottom)
+	}
+	played := parallelChaosGame(ctx, iterations, params.Seed, progress, func(worker int, rnd *rand.Rand, iterations int, next func(i int) bool) {
+		res := accumulators[worker]
+		x, y, c := rnd.Float64()*2-1, rnd.Float64()*2-1, rnd.Float64()
+		skip := ifsTransient
+
+		for i := 0; next(i); i++ {
+			x, y, c = transforms[pick(rnd)].apply(x, y, c, rnd)
+			if math.IsNaN(x) || math.IsNaN(y) || math.Abs(x) > 1e10 || math.Abs(y) > 1e10 {
+				x, y, c = rnd.Float64()*2-1, rnd.Float64()*2-1, rnd.Float64()
+				skip = ifsTransient
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			px, py, pc := x, y, c
+			if final != nil {
+				px, py, pc = final.apply(x, y, c, rnd)
+			}
+			if index, ok := planeIndex(px, py, params); ok {
+				res.add(index, palette[int(math.Max(0, math.Min(pc, 1))*(flamePaletteSize-1))])
 			}
 		}
-		x = x1
-		y = y1
+	})
+
+	for _, other := range accumulators[1:] {
+		accumulators[0].merge(other)
 	}
+	accumulators[0].Iterations = played
+	return accumulators[0]
+}
+
+// densityMargin returns the number of rows around a pixel that the density estimation of the flame may blur it into, the kernels being the widest on pixels with a single point
+func densityMargin(flame params.Flame) int {
+	return int(math.Ceil(math.Max(flame.Estimator, flame.EstimatorMin))) + 1
+}
+
+// estimateDensity returns the densities of the rows from top to bottom of the image, which the accumulator must hold with their margin, blurring each pixel with a Gaussian kernel whose radius shrinks
+// as the number of points on the pixel grows, smoothing the sparse areas of the flame while keeping the dense ones sharp.
+// The pixels around the rows whose kernels reach them are blurred into them too, so that strips of an image join without seams.
+func (a flameAccumulator) estimateDensity(flame params.Flame, top int, bottom int) flameDensities {
+	kernels := make(map[int][]float64)
+	res := flameDensities{Width: a.Width, Height: bottom - top, Values: make([]float64, 4*a.Width*(bottom-top)), Iterations: a.Iterations}
 
+	margin := densityMargin(flame)
+	from, to := top-margin, bottom+margin
+	if from < a.Top {
+		from = a.Top
+	}
+	if to > a.bottom() {
+		to = a.bottom()
+	}
+	for y := from; y < to; y++ {
+		for x := 0; x < a.Width; x++ {
+			index := 4 * ((y-a.Top)*a.Width + x)
+			if a.Values[index+3] == 0 {
+				continue
+			}
+			count := float64(a.Values[index+3])
+			values := [4]float64{float64(a.Values[index]) / 0xffff, float64(a.Values[index+1]) / 0xffff, float64(a.Values[index+2]) / 0xffff, count}
 
-	for k, col := range cols {
-		alpha := math.Log(float64(histo[k]) + 1) / math.Log(float64(maxValue) + 1)
-		if alpha < 0 {
-			alpha = 0
+			radius := 0.0
+			if flame.Estimator > 0 {
+				radius = math.Max(flame.Estimator/math.Pow(count, flame.EstimatorCurve), flame.EstimatorMin)
+			}
+			if radius < 0.5 {
+				if y >= top && y < bottom {
+					target := 4 * ((y-top)*a.Width + x)
+					for i, value := range values {
+						res.Values[target+i] += value
+					}
+				}
+				continue
+			}
+
+			step := int(math.Round(radius * 2))
+			kernel, ok := kernels[step]
+			if !ok {
+				kernel = gaussianKernel(float64(step) / 2)
+				kernels[step] = kernel
+			}
+			size := int(math.Sqrt(float64(len(kernel))))
+			half := size / 2
+			for ky := 0; ky < size; ky++ {
+				ty := y + ky - half
+				if ty < top || ty >= bottom {
+					continue
+				}
+				for kx := 0; kx < size; kx++ {
+					tx := x + kx - half
+					if tx < 0 || tx >= a.Width {
+						continue
+					}
+					weight := kernel[ky*size+kx]
+					target := 4 * ((ty-top)*a.Width + tx)
+					for i, value := range values {
+						res.Values[target+i] += weight * value
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+// gaussianKernel returns a normalized square Gaussian kernel covering the radius, with a standard deviation of half the radius
+func gaussianKernel(radius float64) []float64 {
+	half := int(math.Ceil(radius))
+	size := 2*half + 1
+	sigma := radius / 2
+	kernel := make([]float64, size*size)
+	total := 0.0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x-half), float64(y-half)
+			if dx*dx+dy*dy > radius*radius {
+				continue
+			}
+			kernel[y*size+x] = math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+			total += kernel[y*size+x]
 		}
-		tmpR := col.R//math.Pow(col.R * alpha, 0.5)
-		tmpG := col.G//math.Pow(col.G * alpha, 0.5)
-		tmpB := col.B//math.Pow(col.B * alpha, 0.5)
-		imgRes[k] = color.NRGBA{R: uint8(tmpR * 255), G: uint8(tmpG * 255), B: uint8(tmpB * 255), A: uint8((alpha) * 255)}
 	}
-	return imgRes
+	for i := range kernel {
+		kernel[i] /= total
+	}
+	return kernel
 }
 
-func scaleFlame(x1 float64, y1 float64, imageParams params.ImageParams) orbits.Coords {
-	x := (x1 + 1.0) * float64(imageParams.Width)
-	y := (y1 + 1.0) * float64(imageParams.Height)
-	return orbits.Coords{int64(x), int64(y)}
+// toneMap returns the colors of the pixels from the log of their density, normalized by the number of iterations per unit of area of the plane
+// so that it does not depend on the size or the zoom of the image, corrected by gamma and vibrancy and laid on the background
+func (a flameDensities) toneMap(imageParams params.ImageParams) []color.RGBA64 {
+	flame := imageParams.Flame
+	pixelArea := math.Abs((imageParams.Right-imageParams.Left)*(imageParams.Bottom-imageParams.Top)) / float64(imageParams.Width*imageParams.Height)
+	k1 := flame.Brightness * 268 / 256 / 10
+	k2 := 1 / (math.Max(float64(a.Iterations), 1) * pixelArea)
+
+	gamma := flame.Gamma
+	if gamma <= 0 {
+		gamma = 1
+	}
+	br, bg, bb, ba := imageParams.Palette.Divergence.RGBA()
+	background := [4]float64{float64(br) / 0xffff, float64(bg) / 0xffff, float64(bb) / 0xffff, float64(ba) / 0xffff}
+
+	pixels := make([]color.RGBA64, a.Width*a.Height)
+	for i := range pixels {
+		count := a.Values[4*i+3]
+		alpha := 0.0
+		var channels [3]float64
+		if count > 0 {
+			alpha = k1 * math.Log(1+count*k2)
+			gammaAlpha := math.Pow(alpha, 1/gamma)
+			for c := 0; c < 3; c++ {
+				average := a.Values[4*i+c] / count
+				channels[c] = flame.Vibrancy*average*gammaAlpha + (1-flame.Vibrancy)*math.Pow(average*alpha, 1/gamma)
+			}
+			alpha = math.Min(gammaAlpha, 1)
+		}
+
+		var out [4]float64
+		for c := 0; c < 3; c++ {
+			out[c] = math.Min(math.Min(channels[c], 1)+background[c]*(1-alpha), 1)
+		}
+		out[3] = alpha + background[3]*(1-alpha)
+		for c := 0; c < 3; c++ {
+			out[c] = math.Min(out[c], out[3])
+		}
+		pixels[i] = color.RGBA64{R: uint16(out[0] * 0xffff), G: uint16(out[1] * 0xffff), B: uint16(out[2] * 0xffff), A: uint16(out[3] * 0xffff)}
+	}
+	return pixels
 }
@@ -0,0 +1,128 @@
+package fractales
+
+import (
+	"context"
+	"image/color"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+func TestVariations(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	affine := params.AffineTransform{A: 1, D: 1}
+	if x, y := Variations["linear"](0.3, -0.4, affine, rnd); x != 0.3 || y != -0.4 {
+		t.Errorf("Linear should be the identity, got %v, %v", x, y)
+	}
+	if x, y := Variations["spherical"](2, 0, affine, rnd); math.Abs(x-0.5) > 1e-9 || y != 0 {
+		t.Errorf("Spherical should invert the point, got %v, %v", x, y)
+	}
+	for name, v := range Variations {
+		if x, y := v(0, 0, affine, rnd); math.IsNaN(x) || math.IsNaN(y) {
+			t.Errorf("Variation %s should be defined at the origin, got %v, %v", name, x, y)
+		}
+	}
+}
+
+func TestDensityEstimationKeepsTotal(t *testing.T) {
+	acc := flameAccumulator{Width: 20, Height: 20, Values: make([]uint64, 4*20*20)}
+	acc.Values[4*(10*20+10)+3] = 3
+	acc.Values[4*(10*20+10)] = 3 * 0xffff
+	filtered := acc.estimateDensity(params.Flame{Estimator: 5, EstimatorCurve: 0.4}, 0, acc.Height)
+
+	count, red, spread := 0.0, 0.0, 0
+	for i := 0; i < len(filtered.Values); i += 4 {
+		red += filtered.Values[i]
+		count += filtered.Values[i+3]
+		if filtered.Values[i+3] > 0 {
+			spread++
+		}
+	}
+	if math.Abs(count-3) > 1e-9 || math.Abs(red-3) > 1e-9 {
+		t.Errorf("Density estimation should keep the totals, got %v points and %v red", count, red)
+	}
+	if spread < 2 {
+		t.Errorf("Density estimation should spread a lone pixel")
+	}
+}
+
+func TestDensityEstimationStrips(t *testing.T) {
+	acc := flameAccumulator{Width: 20, Height: 20, Values: make([]uint64, 4*20*20)}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 30; i++ {
+		index := 4 * rnd.Intn(20*20)
+		acc.Values[index] += 0xffff
+		acc.Values[index+3]++
+	}
+	flame := params.Flame{Estimator: 5, EstimatorMin: 1, EstimatorCurve: 0.4}
+	whole := acc.estimateDensity(flame, 0, acc.Height)
+
+	var strips []float64
+	for _, rows := range [][2]int{{0, 7}, {7, 8}, {8, 20}} {
+		strip := acc.estimateDensity(flame, rows[0], rows[1])
+		if strip.Height != rows[1]-rows[0] {
+			t.Fatalf("Strip should have %d rows, got %d", rows[1]-rows[0], strip.Height)
+		}
+		strips = append(strips, strip.Values...)
+	}
+	for i, value := range whole.Values {
+		if math.Abs(value-strips[i]) > 1e-12 {
+			t.Fatalf("Strips should join without seams, value %d is %v instead of %v", i, strips[i], value)
+		}
+	}
+}
+
+func TestFlameBackground(t *testing.T) {
+	imageParams := params.ImageParams{Left: FlameLeft, Right: FlameRight, Top: FlameTop, Bottom: FlameBottom, Width: 40, Height: 30, Flame: DefaultFlame()}
+	imageParams.Flame.Estimator = 0
+	imageParams.Palette = palettes.Colors{Divergence: palettes.Black, ListColors: []color.Color{palettes.Red, palettes.White}}
+	acc := createFlameAccumulator(context.Background(), imageParams, 100000, 0, imageParams.Height, nil)
+	pixels := acc.estimateDensity(imageParams.Flame, 0, acc.Height).toneMap(imageParams)
+
+	lit := 0
+	for i, pixel := range pixels {
+		if acc.Values[4*i+3] == 0 && pixel != (color.RGBA64{A: 0xffff}) {
+			t.Fatalf("Empty pixels should show the background, got %v", pixel)
+		}
+		if pixel.R > pixel.A || pixel.G > pixel.A || pixel.B > pixel.A {
+			t.Fatalf("Pixels should be premultiplied, got %v", pixel)
+		}
+		if pixel.R > 0 {
+			lit++
+		}
+	}
+	if lit == 0 {
+		t.Errorf("The flame should light some pixels")
+	}
+}
+
+func TestFlameSeed(t *testing.T) {
+	imageParams := params.ImageParams{Left: FlameLeft, Right: FlameRight, Top: FlameTop, Bottom: FlameBottom, Width: 40, Height: 30, Flame: DefaultFlame(), Seed: 42}
+	imageParams.Palette = palettes.Colors{Divergence: palettes.Black, ListColors: []color.Color{palettes.Red, palettes.White}}
+	first := createFlameAccumulator(context.Background(), imageParams, 100000, 0, imageParams.Height, nil)
+	second := createFlameAccumulator(context.Background(), imageParams, 100000, 0, imageParams.Height, nil)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("The same seed should give the same flame")
+	}
+
+	imageParams.Seed = 43
+	if reflect.DeepEqual(first, createFlameAccumulator(context.Background(), imageParams, 100000, 0, imageParams.Height, nil)) {
+		t.Errorf("Another seed should give another flame")
+	}
+
+	// random variations make the order in which the variations of a transform are applied matter
+	variations := map[string]float64{"julia": 0.4, "blur": 0.1, "spherical": 0.3, "swirl": 0.2, "linear": 0.5}
+	for i := range imageParams.Flame.Transforms {
+		imageParams.Flame.Transforms[i].Variations = variations
+	}
+	first = createFlameAccumulator(context.Background(), imageParams, 100000, 0, imageParams.Height, nil)
+	for i := 0; i < 5; i++ {
+		if !reflect.DeepEqual(first, createFlameAccumulator(context.Background(), imageParams, 100000, 0, imageParams.Height, nil)) {
+			t.Fatalf("The same seed should give the same flame with several variations per transform")
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package fractales
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// ifsWindow is the window of the plane of an IFS fractal shown by the default viewport of the image parameters
+type ifsWindow struct {
+	Left   float64
+	Right  float64
+	Top    float64
+	Bottom float64
+}
+
+// index returns the index of the pixel of the image showing the point of the IFS plane, and whether it is inside the image
+func (w ifsWindow) index(x float64, y float64, imageParams params.ImageParams) (int, bool) {
+	re := params.Left + (x-w.Left)/(w.Right-w.Left)*(params.Right-params.Left)
+	im := params.Top + (y-w.Top)/(w.Bottom-w.Top)*(params.Bottom-params.Top)
+
+	return planeIndex(re, im, imageParams)
+}
+
+// planeIndex returns the index of the pixel of the image showing the point of the complex plane, and whether it is inside the image
+func planeIndex(re float64, im float64, imageParams params.ImageParams) (int, bool) {
+	px := math.Floor((re - imageParams.Left) / (imageParams.Right - imageParams.Left) * float64(imageParams.Width))
+	py := math.Floor((im - imageParams.Top) / (imageParams.Bottom - imageParams.Top) * float64(imageParams.Height))
+	if !(px >= 0 && px < float64(imageParams.Width) && py >= 0 && py < float64(imageParams.Height)) {
+		return 0, false
+	}
+	return int(py)*imageParams.Width + int(px), true
+}
+
+// ifsHistogram counts the points of a chaos game falling on each pixel of the rows of the image from Top, as many as Counts holds
+type ifsHistogram struct {
+	Width  int
+	Height int
+	Top    int
+	Counts []uint32
+}
+
+func newIFSHistogram(imageParams params.ImageParams) ifsHistogram {
+	return newIFSBandHistogram(imageParams, 0, imageParams.Height)
+}
+
+// newIFSBandHistogram returns a histogram of the rows from top to bottom of the image
+func newIFSBandHistogram(imageParams params.ImageParams, top int, bottom int) ifsHistogram {
+	return ifsHistogram{Width: imageParams.Width, Height: imageParams.Height, Top: top, Counts: make([]uint32, imageParams.Width*(bottom-top))}
+}
+
+// bottom returns the row of the image below the rows of the histogram
+func (h ifsHistogram) bottom() int {
+	if h.Width == 0 {
+		return h.Top
+	}
+	return h.Top + len(h.Counts)/h.Width
+}
+
+// add counts a point on the pixel of the given index in the image, if the histogram holds its row
+func (h ifsHistogram) add(index int) {
+	if i := index - h.Top*h.Width; i >= 0 && i < len(h.Counts) {
+		h.Counts[i]++
+	}
+}
+
+// merge adds the counts of the other histogram, of the same rows, to the histogram
+func (h ifsHistogram) merge(other ifsHistogram) {
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+}
+
+// memorySize returns the number of bytes held by the histogram
+func (h ifsHistogram) memorySize() int64 {
+	return 4 * int64(len(h.Counts))
+}
+
+// value returns the number of points on the pixel holding the point in pixel coordinates of the image, and whether there is any
+func (h ifsHistogram) value(x float64, y float64) (float64, bool) {
+	if x < 0 || y < float64(h.Top) || x >= float64(h.Width) || y >= float64(h.bottom()) {
+		return 0, false
+	}
+	count := h.Counts[(int(y)-h.Top)*h.Width+int(x)]
+	return float64(count), count > 0
+}
+
+// newIFSHistograms returns a histogram of the rows from top to bottom of the image for each goroutine of a chaos game
+func newIFSHistograms(imageParams params.ImageParams, workers int, top int, bottom int) []ifsHistogram {
+	histograms := make([]ifsHistogram, workers)
+	for i := range histograms {
+		histograms[i] = newIFSBandHistogram(imageParams, top, bottom)
+	}
+	return histograms
+}
+
+// mergeHistograms returns the sum of the histograms, reusing the first one
+func mergeHistograms(histograms []ifsHistogram) ifsHistogram {
+	for _, other := range histograms[1:] {
+		histograms[0].merge(other)
+	}
+	return histograms[0]
+}
+
+// chaosGameStreams is the number of random streams a chaos game is split into whatever the number of CPUs,
+// so that a seed always gives the same points
+const chaosGameStreams = 64
+
+// parallelWorkers returns the number of goroutines sharing a chaos game of the given number of iterations
+func parallelWorkers(iterations int) int {
+	workers := runtime.NumCPU()
+	if workers > chaosGameStreams {
+		workers = chaosGameStreams
+	}
+	if workers > iterations {
+		workers = 1
+	}
+	return workers
+}
+
+// streamSeed returns the seed of a random stream of a chaos game, mixing the seed of the render with the index of the stream
+func streamSeed(seed int64, stream int) int64 {
+	z := uint64(seed) + uint64(stream+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
+}
+
+// chaosGameIterations returns the number of iterations of a chaos game: the samples per pixel of the parameters times the number of pixels,
+// or the default number of iterations of the fractal without samples per pixel
+func chaosGameIterations(imageParams params.ImageParams, defaultIterations int) int {
+	if imageParams.Samples > 0 {
+		return imageParams.Samples * imageParams.Width * imageParams.Height
+	}
+	return defaultIterations
+}
+
+// withBudget returns a context done when the time budget of the parameters is spent, so that a chaos game stops early
+func withBudget(ctx context.Context, imageParams params.ImageParams) (context.Context, context.CancelFunc) {
+	if imageParams.Budget > 0 {
+		return context.WithTimeout(ctx, imageParams.Budget)
+	}
+	return context.WithCancel(ctx)
+}
+
+// bandRows returns the number of rows of the bands of the image whose chaos game, played in the given number of iterations,
+// holds at most maxBytes when each of its goroutines holds bytesPerPixel bytes per pixel of the band
+func bandRows(imageParams params.ImageParams, iterations int, bytesPerPixel int, maxBytes int64) int {
+	rows := maxBytes / (int64(parallelWorkers(iterations)) * int64(imageParams.Width) * int64(bytesPerPixel))
+	if rows < 1 {
+		return 1
+	}
+	if rows > int64(imageParams.Height) {
+		return imageParams.Height
+	}
+	return int(rows)
+}
+
+// bandEnd returns the row ending the band of the given number of rows starting from top, which must cover the rows down to bottom
+func bandEnd(imageParams params.ImageParams, top int, bottom int, rows int) int {
+	end := top + rows
+	if end < bottom {
+		end = bottom
+	}
+	if end > imageParams.Height {
+		end = imageParams.Height
+	}
+	return end
+}
+
+// bandHistograms returns a BandValueComputation reading the histograms of bands of the image played with create, each of them holding at most maxBytes.
+// Only the histogram of the last band is kept, the next one being played when a band asked for is not in it, so the bands must be asked for from top to bottom.
+func bandHistograms(imageParams params.ImageParams, iterations int, maxBytes int64, create func(top int, bottom int) ifsHistogram) BandValueComputation {
+	rows := bandRows(imageParams, iterations, 4, maxBytes)
+	var histogram ifsHistogram
+	played := false
+
+	return func(top int, bottom int) ValueComputation {
+		if !played || top < histogram.Top || bottom > histogram.bottom() {
+			histogram = create(top, bandEnd(imageParams, top, bottom, rows))
+			played = true
+		}
+		band := histogram
+		return func(x float64, y float64) (float64, bool, float64) {
+			val, ok := band.value(x, y)
+			return val, ok, 0
+		}
+	}
+}
+
+// parallelChaosGame splits the iterations of a chaos game in chaosGameStreams streams played by parallelWorkers goroutines.
+// play is called for each stream with the index of the goroutine playing it, the random source of the stream seeded from seed and the share of
+// the iterations of the stream; play must call next before each iteration with the number of iterations done so far and stop when it returns false,
+// which happens when the share is done or the context is done. The results of a goroutine must be accumulated so that the order of the streams
+// does not matter, for instance in integer counts. It returns the number of iterations played.
+func parallelChaosGame(ctx context.Context, iterations int, seed int64, progress ProgressFunction, play func(worker int, rnd *rand.Rand, iterations int, next func(i int) bool)) int {
+	workers := parallelWorkers(iterations)
+	streams := chaosGameStreams
+	if streams > iterations {
+		streams = 1
+	}
+
+	var mu sync.Mutex
+	done := 0
+	report := func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		done += n
+		if progress != nil {
+			progress(done, iterations)
+		}
+	}
+
+	pending := make(chan int, streams)
+	for stream := 0; stream < streams; stream++ {
+		pending <- stream
+	}
+	close(pending)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for worker := 0; worker < workers; worker++ {
+		go func(worker int) {
+			defer wg.Done()
+			for stream := range pending {
+				if ctx.Err() != nil {
+					continue
+				}
+				share := iterations / streams
+				if stream < iterations%streams {
+					share++
+				}
+				rnd := rand.New(rand.NewSource(streamSeed(seed, stream)))
+
+				reported := 0
+				play(worker, rnd, share, func(i int) bool {
+					if i%progressInterval != 0 && i != share {
+						return true
+					}
+					report(i - reported)
+					reported = i
+					return i < share && ctx.Err() == nil
+				})
+			}
+		}(worker)
+	}
+	wg.Wait()
+	return done
+}
+
+// ifsIterations is the number of iterations of the chaos game drawing an IFS given by its transforms
+const ifsIterations = 100000000
+
+// ifsTransient is the number of points of the chaos game skipped before reaching the attractor
+const ifsTransient = 20
+
+// IFSPreset is an iterated function system stored in a preset file, with the window of the plane showing it
+type IFSPreset struct {
+	Left       float64                  `json:"left"`
+	Right      float64                  `json:"right"`
+	Top        float64                  `json:"top"`
+	Bottom     float64                  `json:"bottom"`
+	Transforms []params.AffineTransform `json:"transforms"`
+}
+
+// LoadIFSPreset reads an IFS preset from a JSON file
+func LoadIFSPreset(path string) (IFSPreset, error) {
+	var preset IFSPreset
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return preset, err
+	}
+	err = json.Unmarshal(content, &preset)
+	return preset, err
+}
+
+// IFSPresets is the directory the named IFS presets are loaded from
+var IFSPresets = "fractales/presets"
+
+// LoadNamedIFSPreset reads the IFS preset of the name from IFSPresets
+func LoadNamedIFSPreset(name string) (IFSPreset, error) {
+	if name == "" || strings.ContainsAny(name, "/\\.") {
+		return IFSPreset{}, fmt.Errorf("invalid IFS preset name %q", name)
+	}
+	preset, err := LoadIFSPreset(filepath.Join(IFSPresets, name+".json"))
+	if os.IsNotExist(err) {
+		return preset, fmt.Errorf("unknown IFS preset %s", name)
+	}
+	return preset, err
+}
+
+// weightedPicker returns a function picking an index with a probability proportional to its weight
+func weightedPicker(weights []float64) func(rnd *rand.Rand) int {
+	total := 0.0
+	for _, weight := range weights {
+		total += math.Max(0, weight)
+	}
+
+	return func(rnd *rand.Rand) int {
+		r := rnd.Float64() * total
+		for i, weight := range weights {
+			if weight <= 0 {
+				continue
+			}
+			if r < weight {
+				return i
+			}
+			r -= weight
+		}
+		return len(weights) - 1
+	}
+}
+
+// transformPicker returns a function picking a transform with a probability proportional to its weight.
+// Transforms without a weight are weighted by the area they map the unit square to.
+func transformPicker(transforms []params.AffineTransform) func(rnd *rand.Rand) params.AffineTransform {
+	weights := make([]float64, len(transforms))
+	for i, t := range transforms {
+		weights[i] = t.Weight
+		if weights[i] <= 0 {
+			weights[i] = math.Max(0.01, math.Abs(t.A*t.D-t.B*t.C))
+		}
+	}
+
+	pick := weightedPicker(weights)
+	return func(rnd *rand.Rand) params.AffineTransform {
+		return transforms[pick(rnd)]
+	}
+}
+
+// FitIFS returns a window of the plane framing the attractor of the transforms, with the given width to height ratio and the y axis pointing up
+func FitIFS(transforms []params.AffineTransform, aspect float64) (float64, float64, float64, float64) {
+	if len(transforms) == 0 {
+		return params.Left, params.Right, params.Top, params.Bottom
+	}
+
+	pick := transformPicker(transforms)
+	rnd := rand.New(rand.NewSource(1))
+	minX, maxX, minY, maxY := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	x, y := 0.0, 0.0
+	for i := 0; i < 100000; i++ {
+		t := pick(rnd)
+		x, y = t.A*x+t.B*y+t.E, t.C*x+t.D*y+t.F
+		if i < ifsTransient || math.IsNaN(x) || math.IsNaN(y) || math.IsInf(x, 0) || math.IsInf(y, 0) {
+			continue
+		}
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	if minX > maxX {
+		return params.Left, params.Right, params.Top, params.Bottom
+	}
+
+	width := math.Max(maxX-minX, 1e-9) * 1.1
+	height := math.Max(maxY-minY, 1e-9) * 1.1
+	if width/height < aspect {
+		width = height * aspect
+	} else {
+		height = width / aspect
+	}
+	centerX, centerY := (minX+maxX)/2, (minY+maxY)/2
+	return centerX - width/2, centerX + width/2, centerY + height/2, centerY - height/2
+}
+
+// IFSValueComputeLow returns the number of points of the chaos game of the IFS of the parameters falling on each pixel of the viewport
+func IFSValueComputeLow(ctx context.Context, params params.ImageParams, progress ProgressFunction) ValueComputation {
+	histogram := accumulateHistogram(ctx, params, func(seed int64) ifsHistogram {
+		pass := params
+		pass.Seed = seed
+		return createIFSHistogram(ctx, pass, chaosGameIterations(params, ifsIterations), 0, params.Height, progress)
+	})
+
+	return func(x float64, y float64) (float64, bool, float64) {
+		val, ok := histogram.value(x, y)
+		return val, ok, 0
+	}
+}
+
+// IFSBandValueComputer returns a BandValueComputation playing the chaos game of the IFS of the parameters again for each band of rows of the image,
+// keeping only the points falling in it, so that the histogram of a band holding at most maxBytes is kept rather than the one of the whole image
+func IFSBandValueComputer(ctx context.Context, params params.ImageParams, maxBytes int64) BandValueComputation {
+	iterations := chaosGameIterations(params, ifsIterations)
+	return bandHistograms(params, iterations, maxBytes, func(top int, bottom int) ifsHistogram {
+		return createIFSHistogram(ctx, params, iterations, top, bottom, nil)
+	})
+}
+
+// createIFSHistogram plays the chaos game of the IFS of the parameters into a histogram of the rows from top to bottom of the image
+func createIFSHistogram(ctx context.Context, params params.ImageParams, iterations int, top int, bottom int, progress ProgressFunction) ifsHistogram {
+	if len(params.IFS.Transforms) == 0 {
+		return newIFSBandHistogram(params, top, bottom)
+	}
+	ctx, cancel := withBudget(ctx, params)
+	defer cancel()
+
+	pick := transformPicker(params.IFS.Transforms)
+	histograms := newIFSHistograms(params, parallelWorkers(iterations), top, bottom)
+	parallelChaosGame(ctx, iterations, params.Seed, progress, func(worker int, rnd *rand.Rand, iterations int, next func(i int) bool) {
+		res := histograms[worker]
+		x := float64(0)
+		y := float64(0)
+
+		for i := 0; next(i); i++ {
+			t := pick(rnd)
+			x, y = t.A*x+t.B*y+t.E, t.C*x+t.D*y+t.F
+			if i < ifsTransient {
+				continue
+			}
+			if index, ok := planeIndex(x, y, params); ok {
+				res.add(index)
+			}
+		}
+	})
+	return mergeHistograms(histograms)
+}
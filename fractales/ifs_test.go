@@ -0,0 +1,184 @@
+package fractales
+
+import (
+	"context"
+	"image/color"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Balise42/marzipango/fractales/orbits"
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// benchmarkIterations is the number of chaos game iterations of the benchmarks
+const benchmarkIterations = 1 << 22
+
+func benchmarkParams() params.ImageParams {
+	return params.ImageParams{Left: params.Left, Right: params.Right, Top: params.Top, Bottom: params.Bottom, Width: params.Width, Height: params.Height}
+}
+
+func TestParallelChaosGame(t *testing.T) {
+	var mu sync.Mutex
+	played := 0
+	lastDone := 0
+	parallelChaosGame(context.Background(), 3*progressInterval+7, 1, func(done int, total int) {
+		lastDone = done
+	}, func(worker int, rnd *rand.Rand, iterations int, next func(i int) bool) {
+		n := 0
+		for i := 0; next(i); i++ {
+			n++
+		}
+		mu.Lock()
+		played += n
+		mu.Unlock()
+	})
+	if played != 3*progressInterval+7 || lastDone != played {
+		t.Errorf("Chaos game should play and report %d iterations, played %d and reported %d", 3*progressInterval+7, played, lastDone)
+	}
+}
+
+func TestFernHistogramDropsOutside(t *testing.T) {
+	imageParams := benchmarkParams()
+	imageParams.Right = 0
+	histogram := createFernHistogram(context.Background(), imageParams, 1000, 0, imageParams.Height, nil)
+	total := uint32(0)
+	for _, count := range histogram.Counts {
+		total += count
+	}
+	if len(histogram.Counts) != imageParams.Width*imageParams.Height || total == 0 || total >= 1000 {
+		t.Errorf("Histogram should count the points of the left half of the fern only, got %d points", total)
+	}
+}
+
+func BenchmarkFernHistogram(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		createFernHistogram(context.Background(), benchmarkParams(), benchmarkIterations, 0, benchmarkParams().Height, nil)
+	}
+}
+
+// BenchmarkFernMap accumulates the same chaos game in a map, as the IFS fractals used to
+func BenchmarkFernMap(b *testing.B) {
+	imageParams := benchmarkParams()
+	rules := [][6]float64{{0, 0, 0, 0.16, 0, 0}, {0.85, 0.04, -0.04, 0.85, 0, 1.6}, {-0.15, 0.28, 0.26, 0.24, 0, 0.44}, {0.20, -0.26, 0.23, 0.22, 0, 1.6}}
+	for n := 0; n < b.N; n++ {
+		res := make(map[orbits.Coords]int)
+		x, y := 0.0, 0.0
+		for i := 0; i < benchmarkIterations; i++ {
+			rule := rand.Float32()
+			r := rules[3]
+			if rule < 0.05 {
+				r = rules[0]
+			} else if rule < 0.86 {
+				r = rules[1]
+			} else if rule < 0.93 {
+				r = rules[2]
+			}
+			x, y = r[0]*x+r[1]*y+r[4], r[2]*x+r[3]*y+r[5]
+			if index, ok := fernWindow.index(x, y, imageParams); ok {
+				res[orbits.Coords{X: int64(index % imageParams.Width), Y: int64(index / imageParams.Width)}]++
+			}
+		}
+	}
+}
+
+func BenchmarkSierpHistogram(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		createSierpHistogram(context.Background(), benchmarkParams(), createSierpFuncs(), benchmarkIterations, 0, benchmarkParams().Height, nil)
+	}
+}
+
+func BenchmarkFlameAccumulator(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		imageParams := params.ImageParams{Left: FlameLeft, Right: FlameRight, Top: FlameTop, Bottom: FlameBottom, Width: params.Width, Height: params.Height, Flame: DefaultFlame()}
+		createFlameAccumulator(context.Background(), imageParams, benchmarkIterations, 0, imageParams.Height, nil)
+	}
+}
+
+func TestIFSPresets(t *testing.T) {
+	paths, _ := filepath.Glob("presets/*.json")
+	if len(paths) == 0 {
+		t.Fatalf("No IFS preset found")
+	}
+	for _, path := range paths {
+		preset, err := LoadIFSPreset(path)
+		if err != nil || len(preset.Transforms) == 0 {
+			t.Errorf("Preset %s should hold transforms, got %v (%v)", path, preset.Transforms, err)
+		}
+		if preset.Left >= preset.Right || preset.Top == preset.Bottom {
+			t.Errorf("Preset %s should have a window, got %v", path, preset)
+		}
+	}
+}
+
+func TestChaosGameIterations(t *testing.T) {
+	imageParams := benchmarkParams()
+	if n := chaosGameIterations(imageParams, 1000); n != 1000 {
+		t.Errorf("Without samples per pixel, the default iterations should be played, got %d", n)
+	}
+	imageParams.Samples = 3
+	if n := chaosGameIterations(imageParams, 1000); n != 3*params.Width*params.Height {
+		t.Errorf("Samples per pixel should scale with the image, got %d", n)
+	}
+}
+
+func TestChaosGameBudget(t *testing.T) {
+	imageParams := benchmarkParams()
+	imageParams.Budget = 50 * time.Millisecond
+	start := time.Now()
+	histogram := createFernHistogram(context.Background(), imageParams, 1<<40, 0, imageParams.Height, nil)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Chaos game should stop when its budget is spent, took %s", elapsed)
+	}
+	total := uint64(0)
+	for _, count := range histogram.Counts {
+		total += uint64(count)
+	}
+	if total == 0 {
+		t.Errorf("Chaos game should draw points until its budget is spent")
+	}
+}
+
+func TestAccumulateHistogram(t *testing.T) {
+	imageParams := benchmarkParams()
+	imageParams.Width, imageParams.Height = 30, 20
+	imageParams.Palette = palettes.Colors{Divergence: palettes.Black, ListColors: []color.Color{palettes.White}}
+	imageParams.Accumulate = true
+	imageParams.Seed = 12
+
+	var seeds []int64
+	create := func(seed int64) ifsHistogram {
+		seeds = append(seeds, seed)
+		pass := imageParams
+		pass.Seed = seed
+		return createFernHistogram(context.Background(), pass, 10000, 0, pass.Height, nil)
+	}
+	first := accumulateHistogram(context.Background(), imageParams, create)
+	firstTotal := uint32(0)
+	for _, count := range first.Counts {
+		firstTotal += count
+	}
+
+	imageParams.Samples = 7
+	second := accumulateHistogram(context.Background(), imageParams, create)
+	secondTotal := uint32(0)
+	for _, count := range second.Counts {
+		secondTotal += count
+	}
+	if !reflect.DeepEqual(seeds, []int64{12, 13}) {
+		t.Errorf("Each render should draw new points, got seeds %v", seeds)
+	}
+	if secondTotal <= firstTotal {
+		t.Errorf("Second render should add its points to the first one, got %d then %d points", firstTotal, secondTotal)
+	}
+
+	imageParams.Accumulate = false
+	accumulateHistogram(context.Background(), imageParams, create)
+	if len(seeds) != 3 || seeds[2] != 12 {
+		t.Errorf("Renders without accumulation should use their own seed, got %v", seeds)
+	}
+}
@@ -0,0 +1,78 @@
+package fractales
+
+import (
+	"math"
+	"math/cmplx"
+
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// minPeriodTolerance and maxPeriodTolerance bound the distance under which two points of an orbit are considered equal when looking for a cycle:
+// points closer than a pixel cannot be told apart, but double precision cannot tell apart points much closer than minPeriodTolerance either
+const (
+	minPeriodTolerance = 1e-12
+	maxPeriodTolerance = 1e-3
+)
+
+// periodTolerance returns the distance under which two points of an orbit are considered equal when looking for a cycle, the size of a pixel of the image
+func periodTolerance(params params.ImageParams) float64 {
+	pixel := math.Abs(params.Right-params.Left) / float64(params.Width)
+	return math.Max(minPeriodTolerance, math.Min(pixel, maxPeriodTolerance))
+}
+
+// interiorValue returns the interior coloring value of a point whose orbit under z -> z^power + c ended on z without escaping
+func interiorValue(z complex128, c complex128, power float64, maxiter int, method string, tolerance float64) float64 {
+	switch method {
+	case palettes.InteriorModulus:
+		return cmplx.Abs(z)
+	case palettes.InteriorPeriod:
+		period, _ := findCycle(z, c, power, maxiter, tolerance)
+		return float64(period)
+	case palettes.InteriorMultiplier:
+		_, multiplier := findCycle(z, c, power, maxiter, tolerance)
+		return cmplx.Abs(multiplier)
+	}
+	return 0
+}
+
+// iterate returns the image of z under z -> z^power + c
+func iterate(z complex128, c complex128, power float64) complex128 {
+	if power == 2 {
+		return z*z + c
+	}
+	return cmplx.Pow(z, complex(power, 0)) + c
+}
+
+// findCycle looks for the cycle the orbit of z is attracted to with Brent's algorithm and returns its period and multiplier,
+// or 0 if no cycle is found within maxiter iterations
+func findCycle(z complex128, c complex128, power float64, maxiter int, tolerance float64) (int, complex128) {
+	// the tortoise stays on the orbit while the hare runs ahead, and jumps to the hare after runs of increasing powers of two;
+	// the points of orbits that escaped are not numbers and never come close
+	tortoise, hare := z, iterate(z, c, power)
+	period, run := 1, 1
+	for steps := 1; !(cmplx.Abs(tortoise-hare) < tolerance); steps++ {
+		if steps >= maxiter {
+			return 0, 0
+		}
+		if period == run {
+			tortoise = hare
+			run *= 2
+			period = 0
+		}
+		hare = iterate(hare, c, power)
+		period++
+	}
+
+	multiplier := complex(1, 0)
+	for i := 0; i < period; i++ {
+		if power == 2 {
+			multiplier *= 2 * hare
+		} else {
+			p := complex(power, 0)
+			multiplier *= p * cmplx.Pow(hare, p-1)
+		}
+		hare = iterate(hare, c, power)
+	}
+	return period, multiplier
+}
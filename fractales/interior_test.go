@@ -0,0 +1,25 @@
+package fractales
+
+import (
+	"math/cmplx"
+	"testing"
+)
+
+func TestFindCycle(t *testing.T) {
+	for _, tc := range []struct {
+		c      complex128
+		period int
+	}{{-0.1 + 0.1i, 1}, {-1, 2}, {-0.122 + 0.745i, 3}, {-1.31, 4}, {0.3, 0}} {
+		z := 0 + 0i
+		for i := 0; i < 500 && cmplx.Abs(z) < 4; i++ {
+			z = z*z + tc.c
+		}
+		period, multiplier := findCycle(z, tc.c, 2, 1000, 1e-4)
+		if period != tc.period {
+			t.Errorf("Period of %v should be %d, got %d", tc.c, tc.period, period)
+		}
+		if period > 0 && cmplx.Abs(multiplier) >= 1 {
+			t.Errorf("Cycle of %v should be attracting, got a multiplier of %v", tc.c, multiplier)
+		}
+	}
+}
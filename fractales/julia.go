@@ -5,72 +5,72 @@ import (
 	"math/big"
 	"math/cmplx"
 
+	"github.com/Balise42/marzipango/palettes"
 	"github.com/Balise42/marzipango/params"
 )
 
 // JuliaContinuousValueLow returns the fractional number of iterations corresponding to a complex in the Julia set in low precision
-func JuliaContinuousValueLow(z complex128, maxiter int) (float64, bool) {
+func JuliaContinuousValueLow(z complex128, maxiter int, interior string, tolerance float64) (float64, bool, float64) {
 	c := -0.4 + 0.6i
 	for i := 0; i < maxiter; i++ {
 		z = z*z + c
 		if absz := cmplx.Abs(z); absz > r {
-			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true
+			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true, 0
 		}
 	}
-	return math.MaxInt64, false
+	return math.MaxInt64, false, interiorValue(z, c, 2, maxiter, interior, tolerance)
 }
 
 // JuliaContinuousValueComputerLow returns a ValueComputation for the julia set with low precision input
 func JuliaContinuousValueComputerLow(params params.ImageParams) ValueComputation {
-	return func(x int, y int) (float64, bool) {
-		return JuliaContinuousValueLow(scale(x, y, params), params.MaxIter)
+	return func(x float64, y float64) (float64, bool, float64) {
+		return JuliaContinuousValueLow(scale(x, y, params), params.MaxIter, params.Palette.Interior, periodTolerance(params))
 	}
 }
 
 // JuliaContinuousValueHigh returns the fractional number of iterations corresponding to a complex in the Julia set in high precision
-func JuliaContinuousValueHigh(z LargeComplex, maxiter int) (float64, bool) {
+func JuliaContinuousValueHigh(z LargeComplex, maxiter int, interior string, tolerance float64) (float64, bool, float64) {
 	c := LargeComplex{big.NewFloat(-0.4), big.NewFloat(0.6)}
 	for i := 0; i < maxiter; i++ {
 		z = z.Square().Add(&c)
 		if absz := z.Abs64(); absz > r {
-			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true
+			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true, 0
 		}
 	}
-	return math.MaxInt64, false
+	return math.MaxInt64, false, interiorValue(z.Complex128(), c.Complex128(), 2, maxiter, interior, tolerance)
 }
 
 // JuliaContinuousValueComputerHigh returns a ValueComputation for the julia set with high precision input
 func JuliaContinuousValueComputerHigh(params params.ImageParams) ValueComputation {
-	return func(x int, y int) (float64, bool) {
-		return JuliaContinuousValueHigh(scaleHigh(x, y, params), params.MaxIter)
+	return func(x float64, y float64) (float64, bool, float64) {
+		return JuliaContinuousValueHigh(scaleHigh(x, y, params), params.MaxIter, params.Palette.Interior, periodTolerance(params))
 	}
 }
 
-// JuliaOrbitValueLow returns the distance to the closest orbit hit by the computation of iterations corresponding to a complex in the Julia set in low precision
-func JuliaOrbitValueLow(z complex128, maxiter int, orbits []params.Orbit) (float64, bool) {
-	dist := math.MaxFloat64
+// JuliaOrbitValueLow returns the value given by the trap mode to the orbit of the computation of iterations corresponding to a complex in the Julia set in low precision
+func JuliaOrbitValueLow(z complex128, maxiter int, orbits []params.Orbit, trap params.Trapping, interior string, tolerance float64) (float64, bool, float64) {
+	traps := newTrapAggregator(orbits, trap)
+	return juliaTraps(z, maxiter, &traps, interior, tolerance)
+}
 
+// juliaTraps iterates the orbit of a complex in the Julia set, accounting for its points in traps
+func juliaTraps(z complex128, maxiter int, traps *trapAggregator, interior string, tolerance float64) (float64, bool, float64) {
 	c := -0.4 + 0.6i
 
-	i := 0
-	for i < maxiter && cmplx.Abs(z) < 4 {
-		z = z*z + c
-		for _, orbit := range orbits {
-			dist = math.Min(dist, orbit.GetOrbitValue(orbit.GetOrbitFastValue(z)))
+	z, escaped := iterateTraps(z, c, maxiter, traps)
+	if !escaped {
+		if interior == palettes.InteriorOrbit {
+			return math.MaxFloat64, false, traps.value()
 		}
-		i++
-	}
-
-	if i == maxiter {
-		return math.MaxFloat64, false
+		return math.MaxFloat64, false, interiorValue(z, c, 2, maxiter, interior, tolerance)
 	}
 
-	return dist, true
+	return traps.value(), true, 0
 }
 
 // JuliaOrbitValueComputerLow returns a ValueComputation for the julia set with orbit trapping
 func JuliaOrbitValueComputerLow(params params.ImageParams, orbits []params.Orbit) ValueComputation {
-	return func(x int, y int) (float64, bool) {
-		return JuliaOrbitValueLow(scale(x, y, params), params.MaxIter, orbits)
+	return func(x float64, y float64) (float64, bool, float64) {
+		return JuliaOrbitValueLow(scale(x, y, params), params.MaxIter, orbits, params.Trap, params.Palette.Interior, periodTolerance(params))
 	}
 }
@@ -29,6 +29,12 @@ func (z LargeComplex) Add(c *LargeComplex) LargeComplex {
 	return LargeComplex{newReal.Add(z.real, c.real), newImag.Add(z.imag, c.imag)}
 }
 
+func (z LargeComplex) Complex128() complex128 {
+	re, _ := z.real.Float64()
+	im, _ := z.imag.Float64()
+	return complex(re, im)
+}
+
 func (z LargeComplex) Abs64() float64 {
 	realSquare := big.NewFloat(0)
 	realSquare.Mul(z.real, z.real)
@@ -5,80 +5,79 @@ import (
 	"math/big"
 	"math/cmplx"
 
+	"github.com/Balise42/marzipango/palettes"
 	"github.com/Balise42/marzipango/params"
 )
 
 const r = 1000
 
 // MandelbrotContinuousValueLow returns the fractional number of iterations corresponding to a complex in the Mandelbrot set with low precision input
-func MandelbrotContinuousValueLow(c complex128, maxiter int) (float64, bool) {
+func MandelbrotContinuousValueLow(c complex128, maxiter int, interior string, tolerance float64) (float64, bool, float64) {
 	z := 0 + 0i
 	for i := 0; i < maxiter; i++ {
 		z = z*z + c
 		if absz := cmplx.Abs(z); absz > r {
-			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true
+			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true, 0
 		}
 	}
-	return math.MaxInt64, false
+	return math.MaxInt64, false, interiorValue(z, c, 2, maxiter, interior, tolerance)
 }
 
 // MandelbrotContinuousValueComputerLow returns a ValueComputation for the mandelbrot set with low precision input
 func MandelbrotContinuousValueComputerLow(params params.ImageParams) ValueComputation {
-	return func(x int, y int) (float64, bool) {
-		return MandelbrotContinuousValueLow(scale(x, y, params), params.MaxIter)
+	return func(x float64, y float64) (float64, bool, float64) {
+		return MandelbrotContinuousValueLow(scale(x, y, params), params.MaxIter, params.Palette.Interior, periodTolerance(params))
 	}
 }
 
 // MandelbrotContinuousValueHigh returns the number of iterations corresponding to a complex in the Mandelbrot set with high precision input
-func MandelbrotContinuousValueHigh(c *LargeComplex, maxiter int) (float64, bool) {
+func MandelbrotContinuousValueHigh(c *LargeComplex, maxiter int, interior string, tolerance float64) (float64, bool, float64) {
 	z := LargeComplex{big.NewFloat(0), big.NewFloat(0)}
 	for i := 0; i < maxiter; i++ {
 		z = z.Square().Add(c)
 		if absz := z.Abs64(); absz > r {
-			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true
+			return (float64(i) + 1 - math.Log2(math.Log2(absz))), true, 0
 		}
 	}
-	return math.MaxInt64, false
+	return math.MaxInt64, false, interiorValue(z.Complex128(), c.Complex128(), 2, maxiter, interior, tolerance)
 }
 
 // MandelbrotContinuousValueComputerHigh returns a ValueComputation for the mandelbrot set with high precision input
 func MandelbrotContinuousValueComputerHigh(params params.ImageParams) ValueComputation {
-	return func(x int, y int) (float64, bool) {
+	return func(x float64, y float64) (float64, bool, float64) {
 		z := scaleHigh(x, y, params)
-		return MandelbrotContinuousValueHigh(&z, params.MaxIter)
+		return MandelbrotContinuousValueHigh(&z, params.MaxIter, params.Palette.Interior, periodTolerance(params))
 	}
 }
 
-// MandelbrotOrbitValueLow returns the distance to the closest orbit hit by the computation of iterations corresponding to a complex in the Mandelbrot set in low precision
-func MandelbrotOrbitValueLow(c complex128, maxiter int, orbits []params.Orbit) (float64, bool) {
-	dist := math.MaxFloat64
+// MandelbrotOrbitValueLow returns the value given by the trap mode to the orbit of the computation of iterations corresponding to a complex in the Mandelbrot set in low precision
+func MandelbrotOrbitValueLow(c complex128, maxiter int, orbits []params.Orbit, trap params.Trapping, interior string, tolerance float64) (float64, bool, float64) {
+	traps := newTrapAggregator(orbits, trap)
+	return mandelbrotTraps(c, maxiter, &traps, interior, tolerance)
+}
 
-	var z complex128
-	i := 0
-	for i < maxiter && cmplx.Abs(z) < 4 {
-		z = z*z + c
-		for _, orbit := range orbits {
-			dist = math.Min(dist, orbit.GetOrbitValue(orbit.GetOrbitFastValue(z)))
+// mandelbrotTraps iterates the orbit of a complex in the Mandelbrot set, accounting for its points in traps
+func mandelbrotTraps(c complex128, maxiter int, traps *trapAggregator, interior string, tolerance float64) (float64, bool, float64) {
+	z, escaped := iterateTraps(0, c, maxiter, traps)
+	if !escaped {
+		if interior == palettes.InteriorOrbit {
+			return math.MaxFloat64, false, traps.value()
 		}
-		i++
-	}
-
-	if i == maxiter {
-		return math.MaxFloat64, false
+		return math.MaxFloat64, false, interiorValue(z, c, 2, maxiter, interior, tolerance)
 	}
 
-	return dist, true
+	return traps.value(), true, 0
 }
 
 // MandelbrotOrbitValueComputerLow returns a ValueComputation for the julia set with orbit trapping
 func MandelbrotOrbitValueComputerLow(params params.ImageParams, orbits []params.Orbit) ValueComputation {
-	return func(x int, y int) (float64, bool) {
-		return MandelbrotOrbitValueLow(scale(x, y, params), params.MaxIter, orbits)
+	return func(x float64, y float64) (float64, bool, float64) {
+		return MandelbrotOrbitValueLow(scale(x, y, params), params.MaxIter, orbits, params.Trap, params.Palette.Interior, periodTolerance(params))
 	}
 }
 
 // MultibrotContinuousValueLow returns the number of iterations corresponding to a complex in the Multibrot set (with d > 2)
-func MultibrotContinuousValueLow(c complex128, maxiter int, power complex128) (float64, bool) {
+func MultibrotContinuousValueLow(c complex128, maxiter int, power complex128, interior string, tolerance float64) (float64, bool, float64) {
 
 	B := math.Pow(2, 1/(real(power)-1))
 
@@ -86,15 +85,15 @@ func MultibrotContinuousValueLow(c complex128, maxiter int, power complex128) (f
 	for i := 0; i < maxiter; i++ {
 		z = cmplx.Pow(z, power) + c
 		if absz := cmplx.Abs(z); absz > r {
-			return (float64(i) + 1 - (math.Log(math.Log(absz)/math.Log(B)) / math.Log2(real(power)))), true
+			return (float64(i) + 1 - (math.Log(math.Log(absz)/math.Log(B)) / math.Log2(real(power)))), true, 0
 		}
 	}
-	return math.MaxInt64, false
+	return math.MaxInt64, false, interiorValue(z, c, real(power), maxiter, interior, tolerance)
 }
 
 // MultibrotContinuousValueComputerLow returns a ValueComputation for the Multibrot set
 func MultibrotContinuousValueComputerLow(params params.ImageParams) ValueComputation {
-	return func(x int, y int) (float64, bool) {
-		return MultibrotContinuousValueLow(scale(x, y, params), params.MaxIter, complex(params.Power, 0.0))
+	return func(x float64, y float64) (float64, bool, float64) {
+		return MultibrotContinuousValueLow(scale(x, y, params), params.MaxIter, complex(params.Power, 0.0), params.Palette.Interior, periodTolerance(params))
 	}
 }
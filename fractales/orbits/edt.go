@@ -0,0 +1,204 @@
+package orbits
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// edtInfinity is the squared distance of the pixels with no edge pixel in their row or column, larger than any squared distance in an image
+const edtInfinity = 1e20
+
+// DefaultThreshold is the coverage from which the pixels of a trap image are inside its shape
+const DefaultThreshold = 0.5
+
+// DistanceField holds the signed distance of each pixel of a padded trap image to the edge of its shape, negative inside it, row by row
+type DistanceField struct {
+	Width   int
+	Height  int
+	Padding int
+	Values  []float32
+}
+
+// coverage returns how much the pixel is covered by the shape of a trap image, from 0 for white or transparent pixels to 1 for opaque black ones
+func coverage(c color.Color) float32 {
+	r, g, b, a := c.RGBA()
+	// the channels are premultiplied by alpha
+	luminance := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+	return float32(math.Max(0, math.Min(1, (float64(a)-luminance)/0xffff)))
+}
+
+// edgeOffset returns the estimated distance from the center of a pixel of the edge of the shape to the edge, given by how far its coverage is from the threshold,
+// half a pixel for fully covered or uncovered pixels
+func edgeOffset(c float64, threshold float64) float64 {
+	if c >= threshold {
+		return 0.5 * (c - threshold) / math.Max(1-threshold, 1e-9)
+	}
+	return 0.5 * (threshold - c) / threshold
+}
+
+// edtScratch holds the buffers of the one-dimensional distance transform of a line of the field
+type edtScratch struct {
+	f []float64
+	d []float64
+	v []int
+	z []float64
+}
+
+func newEdtScratch(n int) *edtScratch {
+	return &edtScratch{f: make([]float64, n), d: make([]float64, n), v: make([]int, n), z: make([]float64, n+1)}
+}
+
+// transform computes in s.d the squared distance transform of the sampled function s.f, the lower envelope of the parabolas rooted at its samples.
+// Distance field computation from https://prideout.net/blog/distance_fields/ and Felzenszwalb and Huttenlocher, Distance Transforms of Sampled Functions.
+func (s *edtScratch) transform(n int) {
+	f, d, v, z := s.f[:n], s.d[:n], s.v, s.z
+	k := 0
+	v[0] = 0
+	z[0] = math.Inf(-1)
+	z[1] = math.Inf(1)
+
+	for q := 1; q < n; q++ {
+		var intersection float64
+		for {
+			p := v[k]
+			intersection = ((f[q] + float64(q*q)) - (f[p] + float64(p*p))) / float64(2*q-2*p)
+			if intersection > z[k] {
+				break
+			}
+			k--
+		}
+		k++
+		v[k] = q
+		z[k] = intersection
+		z[k+1] = math.Inf(1)
+	}
+
+	k = 0
+	for q := 0; q < n; q++ {
+		for z[k+1] < float64(q) {
+			k++
+		}
+		dx := q - v[k]
+		d[q] = float64(dx*dx) + f[v[k]]
+	}
+}
+
+// parallelLines calls line for the lines from 0 to n on all the CPUs, with scratch buffers for lines of length size
+func parallelLines(n int, size int, line func(i int, scratch *edtScratch)) {
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			scratch := newEdtScratch(size)
+			for i := w; i < n; i += workers {
+				line(i, scratch)
+			}
+			wg.Done()
+		}(w)
+	}
+	wg.Wait()
+}
+
+// computeEdt returns the signed Euclidean distance transform of the shape of the image, made of the pixels covered at least up to the threshold,
+// padded by padding pixels on each side. The pixels of the edge, which have a neighbour on the other side of it, seed the transform with their
+// sub-pixel distance to the edge, and the rows and then the columns are transformed in parallel.
+func computeEdt(img image.Image, padding int, threshold float64) DistanceField {
+	bounds := img.Bounds()
+	width := bounds.Dx() + 2*padding
+	height := bounds.Dy() + 2*padding
+	field := DistanceField{Width: width, Height: height, Padding: padding, Values: make([]float32, width*height)}
+
+	covered := make([]float32, width*height)
+	parallelLines(bounds.Dy(), 0, func(y int, s *edtScratch) {
+		for x := 0; x < bounds.Dx(); x++ {
+			covered[(y+padding)*width+x+padding] = coverage(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	})
+	inside := func(x int, y int) bool {
+		return x >= 0 && x < width && y >= 0 && y < height && float64(covered[y*width+x]) >= threshold
+	}
+
+	parallelLines(height, width, func(y int, s *edtScratch) {
+		for x := 0; x < width; x++ {
+			s.f[x] = edtInfinity
+			in := inside(x, y)
+			if in != inside(x-1, y) || in != inside(x+1, y) || in != inside(x, y-1) || in != inside(x, y+1) {
+				offset := edgeOffset(float64(covered[y*width+x]), threshold)
+				s.f[x] = offset * offset
+			}
+		}
+		s.transform(width)
+		row := field.Values[y*width : (y+1)*width]
+		for x, d := range s.d[:width] {
+			row[x] = float32(d)
+		}
+	})
+
+	parallelLines(width, height, func(x int, s *edtScratch) {
+		for y := 0; y < height; y++ {
+			s.f[y] = float64(field.Values[y*width+x])
+		}
+		s.transform(height)
+		for y, d := range s.d[:height] {
+			dist := float32(math.Sqrt(d))
+			if inside(x, y) {
+				dist = -dist
+			}
+			field.Values[y*width+x] = dist
+		}
+	})
+
+	return field
+}
+
+// Range returns the smallest and largest distances of the field
+func (f DistanceField) Range() (float64, float64) {
+	min, max := float32(math.MaxFloat32), float32(-math.MaxFloat32)
+	for _, v := range f.Values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return float64(min), float64(max)
+}
+
+// At returns the distance at the position of the image in pixels, 0,0 being its top left corner, interpolated between the centers of the four closest pixels,
+// and whether the position is covered by the field
+func (f DistanceField) At(x float64, y float64) (float64, bool) {
+	fx := x + float64(f.Padding) - 0.5
+	fy := y + float64(f.Padding) - 0.5
+	if !(fx >= -0.5 && fx < float64(f.Width)-0.5 && fy >= -0.5 && fy < float64(f.Height)-0.5) {
+		return 0, false
+	}
+
+	x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+	tx, ty := fx-float64(x0), fy-float64(y0)
+	// the half pixels on the border of the field are given the value of the border pixels
+	x1, y1 := x0+1, y0+1
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 >= f.Width {
+		x1 = f.Width - 1
+	}
+	if y1 >= f.Height {
+		y1 = f.Height - 1
+	}
+
+	top := float64(f.Values[y0*f.Width+x0])*(1-tx) + float64(f.Values[y0*f.Width+x1])*tx
+	bottom := float64(f.Values[y1*f.Width+x0])*(1-tx) + float64(f.Values[y1*f.Width+x1])*tx
+	return top*(1-ty) + bottom*ty, true
+}
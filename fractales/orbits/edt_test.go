@@ -0,0 +1,151 @@
+package orbits
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// randomTrapImage returns a white image with a few random black pixels
+func randomTrapImage(width int, height int, blacks int, seed int64) *image.Gray {
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for i := 0; i < blacks; i++ {
+		img.SetGray(rnd.Intn(width), rnd.Intn(height), color.Gray{})
+	}
+	return img
+}
+
+func TestComputeEdt(t *testing.T) {
+	img := randomTrapImage(23, 17, 6, 1)
+	padding := 3
+	field := computeEdt(img, padding, DefaultThreshold)
+	if field.Width != 29 || field.Height != 23 {
+		t.Fatalf("Field should cover the padded image, got %dx%d", field.Width, field.Height)
+	}
+
+	black := func(x int, y int) bool {
+		return x >= 0 && x < 23 && y >= 0 && y < 17 && img.GrayAt(x, y).Y == 0
+	}
+	for y := -padding; y < 17+padding; y++ {
+		for x := -padding; x < 23+padding; x++ {
+			// black pixels and their white neighbours are half a pixel away from the edge
+			expected := math.MaxFloat64
+			for by := -padding; by < 17+padding; by++ {
+				for bx := -padding; bx < 23+padding; bx++ {
+					b := black(bx, by)
+					if b != black(bx-1, by) || b != black(bx+1, by) || b != black(bx, by-1) || b != black(bx, by+1) {
+						expected = math.Min(expected, math.Sqrt(float64((x-bx)*(x-bx)+(y-by)*(y-by))+0.25))
+					}
+				}
+			}
+			if black(x, y) {
+				expected = -expected
+			}
+			if got := float64(field.Values[(y+padding)*field.Width+x+padding]); math.Abs(got-expected) > 1e-4 {
+				t.Errorf("Distance at %d,%d should be %v, got %v", x, y, expected, got)
+			}
+		}
+	}
+}
+
+func TestComputeEdtSubpixelEdge(t *testing.T) {
+	// the shape covers the columns up to three quarters of the fourth one
+	img := image.NewGray(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x, c := range []uint8{0, 0, 0, 0x40, 0xff, 0xff, 0xff, 0xff} {
+			img.SetGray(x, y, color.Gray{Y: c})
+		}
+	}
+
+	field := computeEdt(img, 0, DefaultThreshold)
+	inside, _ := field.At(3, 2)
+	outside, _ := field.At(4.5, 2)
+	if inside >= 0 || outside <= 0 {
+		t.Fatalf("Shape should be negative inside and positive outside, got %v and %v", inside, outside)
+	}
+	edge := 3.0
+	for x := 3.0; x < 5; x += 0.01 {
+		if d, _ := field.At(x, 2); d < 0 {
+			edge = x
+		}
+	}
+	if edge < 3.6 || edge > 3.9 {
+		t.Errorf("Edge should be close to 3.75, got %v", edge)
+	}
+
+	binary := computeEdt(img, 0, 0.8)
+	if d, _ := binary.At(3.5, 2); d <= 0 {
+		t.Errorf("Partially covered column should be outside with a higher threshold, got %v", d)
+	}
+}
+
+func TestDistanceFieldAt(t *testing.T) {
+	field := DistanceField{Width: 2, Height: 2, Padding: 0, Values: []float32{0, 1, 2, 3}}
+	for _, c := range []struct{ x, y, expected float64 }{{0.5, 0.5, 0}, {1.5, 1.5, 3}, {1, 0.5, 0.5}, {1, 1, 1.5}, {0.1, 0.1, 0}, {1.9, 0.5, 1}} {
+		if got, ok := field.At(c.x, c.y); !ok || math.Abs(got-c.expected) > 1e-9 {
+			t.Errorf("Distance at %v,%v should be %v, got %v", c.x, c.y, c.expected, got)
+		}
+	}
+	for _, c := range [][2]float64{{-0.1, 1}, {1, 2}, {math.NaN(), 1}} {
+		if _, ok := field.At(c[0], c[1]); ok {
+			t.Errorf("Distance at %v should not be covered", c)
+		}
+	}
+}
+
+func BenchmarkComputeEdt(b *testing.B) {
+	img := randomTrapImage(512, 512, 100, 1)
+	for i := 0; i < b.N; i++ {
+		computeEdt(img, 100, DefaultThreshold)
+	}
+}
+
+// benchmarkTrapLookups looks up the distances of a grid of points over the image and its padding
+func benchmarkTrapLookups(b *testing.B, orbit params.Orbit) {
+	for i := 0; i < b.N; i++ {
+		for x := -0.2; x < 1.2; x += 0.001 {
+			for y := -0.2; y < 1.2; y += 0.01 {
+				orbit.GetOrbitFastValue(complex(x, y))
+			}
+		}
+	}
+}
+
+func BenchmarkImageOrbit(b *testing.B) {
+	img := randomTrapImage(512, 512, 100, 1)
+	orbit := ImageOrbit{PlaneRect: params.Window{Left: 0, Right: 1, Top: 0, Bottom: 1}, Distances: computeEdt(img, 100, DefaultThreshold), Width: 512, Height: 512}
+	benchmarkTrapLookups(b, orbit)
+}
+
+// mapOrbit looks up its distances in a map, as the raster traps used to
+type mapOrbit struct {
+	ImageOrbit
+	distances map[Coords]float64
+}
+
+func (m mapOrbit) GetOrbitFastValue(z complex128) float64 {
+	x := math.Floor(real(z) * float64(m.Width))
+	y := math.Floor(imag(z) * float64(m.Height))
+	if dist, ok := m.distances[Coords{int64(x), int64(y)}]; ok {
+		return dist
+	}
+	return math.MaxInt64
+}
+
+func BenchmarkImageOrbitMap(b *testing.B) {
+	img := randomTrapImage(512, 512, 100, 1)
+	field := computeEdt(img, 100, DefaultThreshold)
+	distances := make(map[Coords]float64)
+	for i, v := range field.Values {
+		distances[Coords{int64(i%field.Width - 100), int64(i/field.Width - 100)}] = math.Max(float64(v), 0)
+	}
+	benchmarkTrapLookups(b, mapOrbit{ImageOrbit: ImageOrbit{Width: 512, Height: 512}, distances: distances})
+}
@@ -3,16 +3,24 @@ package orbits
 import (
 	"image"
 	"image/color"
-	"image/png"
 	"math"
-	"os"
 
 	"github.com/Balise42/marzipango/params"
 )
 
+// Trap coordinates: in the complex plane, or as fractions of the trap window, 0,0 being its top left corner and 1,1 its bottom right one
+const (
+	CoordsPlane = ""
+	CoordsView  = "view"
+)
+
 type PointOrbit struct {
 	X           float64
 	Y           float64
+	MaxValue    float64
+	Coords      string
+	PlaneX      float64
+	PlaneY      float64
 	Translation float64
 	Factor      float64
 }
@@ -21,6 +29,11 @@ type LineOrbit struct {
 	A           float64
 	B           float64
 	C           float64
+	MaxValue    float64
+	Coords      string
+	PlaneA      float64
+	PlaneB      float64
+	PlaneC      float64
 	Sqrtab      float64
 	Translation float64
 	Factor      float64
@@ -31,38 +44,57 @@ type Coords struct {
 	Y int64
 }
 
-type coordsFloat struct {
-	X float64
-	Y float64
-}
-
 type ImageOrbit struct {
-	Distances   map[Coords]float64
+	Name        string
+	MaxValue    float64
+	Threshold   float64
+	Outline     bool
+	Coords      string
+	Rect        []float64
+	PlaneRect   params.Window
+	Distances   DistanceField
 	Translation float64
 	Factor      float64
 	Width       int
 	Height      int
+	Texture     image.Image
 }
 
-func CreatePointOrbit(x float64, y float64, maxvalue float64) PointOrbit {
-	orbit := PointOrbit{X: x, Y: y}
-	minDist := 0.0
-	maxDist := orbit.squaredDistance(-2 - 1i)
+// toPlane returns the point of the complex plane at the coordinates
+func toPlane(x float64, y float64, coords string, window params.Window) (float64, float64) {
+	if coords == CoordsView {
+		return window.Left + x*(window.Right-window.Left), window.Top + y*(window.Bottom-window.Top)
+	}
+	return x, y
+}
 
-	maxDist = math.Max(maxDist, orbit.squaredDistance(-2+1i))
-	maxDist = math.Max(maxDist, orbit.squaredDistance(1+1i))
-	maxDist = math.Max(maxDist, orbit.squaredDistance(1-1i))
+// corners returns the corners of the window
+func corners(window params.Window) []complex128 {
+	return []complex128{complex(window.Left, window.Top), complex(window.Right, window.Top), complex(window.Right, window.Bottom), complex(window.Left, window.Bottom)}
+}
 
-	minDist = math.Min(minDist, orbit.squaredDistance(-2+1i))
-	minDist = math.Min(minDist, orbit.squaredDistance(1+1i))
-	minDist = math.Min(minDist, orbit.squaredDistance(1-1i))
+// normalization returns the translation and factor mapping the distances from minDist to maxDist to values from 0 to maxvalue
+func normalization(minDist float64, maxDist float64, maxvalue float64) (float64, float64) {
+	if maxDist <= minDist {
+		return minDist, 0
+	}
+	return minDist, maxvalue / (maxDist - minDist)
+}
 
-	maxDist = math.Sqrt(maxDist)
-	minDist = math.Sqrt(minDist)
+// CreatePointOrbit returns a trap at the point, whose distances are normalized so that the points of the window range from 0 to maxvalue
+func CreatePointOrbit(x float64, y float64, maxvalue float64, coords string, window params.Window) PointOrbit {
+	orbit := PointOrbit{X: x, Y: y, MaxValue: maxvalue, Coords: coords}
+	orbit.PlaneX, orbit.PlaneY = toPlane(x, y, coords, window)
 
-	orbit.Factor = (maxvalue - minDist) / (maxDist - minDist)
-	orbit.Translation = minDist
+	maxDist := 0.0
+	for _, corner := range corners(window) {
+		maxDist = math.Max(maxDist, orbit.squaredDistance(corner))
+	}
+	nearestX := math.Max(math.Min(window.Left, window.Right), math.Min(orbit.PlaneX, math.Max(window.Left, window.Right)))
+	nearestY := math.Max(math.Min(window.Top, window.Bottom), math.Min(orbit.PlaneY, math.Max(window.Top, window.Bottom)))
+	minDist := math.Sqrt(orbit.squaredDistance(complex(nearestX, nearestY)))
 
+	orbit.Translation, orbit.Factor = normalization(minDist, math.Sqrt(maxDist), maxvalue)
 	return orbit
 }
 
@@ -71,202 +103,97 @@ func (p PointOrbit) GetOrbitFastValue(z complex128) float64 {
 }
 
 func (p PointOrbit) GetOrbitValue(v float64) float64 {
-	return (math.Sqrt(v) - p.Translation) * p.Factor
+	return math.Max(0, math.Sqrt(v)-p.Translation) * p.Factor
 }
 
-func (p PointOrbit) squaredDistance(z complex128) float64 {
-	return (real(z)-p.X)*(real(z)-p.X) + (imag(z)-p.Y)*(imag(z)-p.Y)
+func (p PointOrbit) Describe() params.OrbitDescription {
+	return params.OrbitDescription{Type: "point", Args: []float64{p.X, p.Y, p.MaxValue}, Coords: p.Coords}
 }
 
-func CreateLineOrbit(a float64, b float64, c float64, maxvalue float64) LineOrbit {
-	orbit := LineOrbit{A: a, B: b, C: c}
-	orbit.Sqrtab = math.Sqrt(a*a + b*b)
-
-	minDist := 0.0
-	maxDist := orbit.GetOrbitFastValue(-2 - 1i)
-
-	maxDist = math.Max(maxDist, orbit.GetOrbitFastValue(-2+1i))
-	maxDist = math.Max(maxDist, orbit.GetOrbitFastValue(1+1i))
-	maxDist = math.Max(maxDist, orbit.GetOrbitFastValue(1-1i))
-
-	minDist = math.Min(minDist, orbit.GetOrbitFastValue(-2+1i))
-	minDist = math.Min(minDist, orbit.GetOrbitFastValue(1+1i))
-	minDist = math.Min(minDist, orbit.GetOrbitFastValue(1-1i))
-
-	maxDist = math.Sqrt(maxDist) / orbit.Sqrtab
-	minDist = math.Sqrt(minDist) / orbit.Sqrtab
+func (p PointOrbit) squaredDistance(z complex128) float64 {
+	return (real(z)-p.PlaneX)*(real(z)-p.PlaneX) + (imag(z)-p.PlaneY)*(imag(z)-p.PlaneY)
+}
 
-	orbit.Factor = (maxvalue - minDist) / (maxDist - minDist)
-	orbit.Translation = minDist
+// CreateLineOrbit returns a trap on the line a x + b y + c = 0, whose distances are normalized so that the points of the window range from 0 to maxvalue
+func CreateLineOrbit(a float64, b float64, c float64, maxvalue float64, coords string, window params.Window) LineOrbit {
+	orbit := LineOrbit{A: a, B: b, C: c, MaxValue: maxvalue, Coords: coords, PlaneA: a, PlaneB: b, PlaneC: c}
+	if coords == CoordsView {
+		width, height := window.Right-window.Left, window.Bottom-window.Top
+		orbit.PlaneA, orbit.PlaneB = a/width, b/height
+		orbit.PlaneC = c - a*window.Left/width - b*window.Top/height
+	}
+	orbit.Sqrtab = math.Sqrt(orbit.PlaneA*orbit.PlaneA + orbit.PlaneB*orbit.PlaneB)
+
+	minDist, maxDist := math.MaxFloat64, 0.0
+	positive, negative := false, false
+	for _, corner := range corners(window) {
+		side := orbit.PlaneA*real(corner) + orbit.PlaneB*imag(corner) + orbit.PlaneC
+		positive = positive || side >= 0
+		negative = negative || side <= 0
+		dist := math.Abs(side) / orbit.Sqrtab
+		minDist = math.Min(minDist, dist)
+		maxDist = math.Max(maxDist, dist)
+	}
+	if positive && negative {
+		minDist = 0
+	}
 
+	orbit.Translation, orbit.Factor = normalization(minDist, maxDist, maxvalue)
 	return orbit
 }
 
 func (l LineOrbit) GetOrbitFastValue(z complex128) float64 {
-	lineCoeff := l.A*real(z) + l.B*imag(z) + l.C
+	lineCoeff := l.PlaneA*real(z) + l.PlaneB*imag(z) + l.PlaneC
 	return lineCoeff * lineCoeff
 }
 
 func (l LineOrbit) GetOrbitValue(v float64) float64 {
-	return (math.Sqrt(v)/l.Sqrtab - l.Translation) * l.Factor
-}
-
-func isBlack(c color.Color) bool {
-	r, g, b, _ := c.RGBA()
-	return r == 0 && g == 0 && b == 0
-}
-
-// distance field computation from https://prideout.net/blog/distance_fields/
-func findHullParabolas(row []float64) ([]int, []float64) {
-	v := make([]int, len(row))
-	z := make([]float64, len(row)+1)
-	k := 0
-
-	v[0] = 0
-	z[0] = -math.MaxInt16
-	z[1] = math.MaxInt16
-
-	for i := 1; i < len(row); i++ {
-		q := i
-		p := v[k]
-		s := intersectParabolas(p, q, row)
-		for s <= z[k] {
-			k = k - 1
-			p = v[k]
-			s = intersectParabolas(p, q, row)
-		}
-		k = k + 1
-		v[k] = q
-		z[k] = s
-		z[k+1] = math.MaxInt16
-	}
-
-	return v, z
-}
-
-func intersectParabolas(p int, q int, row []float64) float64 {
-	intersect := ((row[q] + float64(q*q)) - (row[p] + float64(p*p))) / (2*float64(q) - 2*float64(p))
-	return intersect
-}
-
-func marchParabolas(row []float64, vertices []int, intersections []float64) {
-	k := 0
-	for q := range row {
-		for intersections[k+1] < float64(q) {
-			k = k + 1
-		}
-		dx := q - vertices[k]
-		row[q] = float64(dx*dx) + row[vertices[k]]
-	}
-}
-
-func horizontalPass(row []float64) {
-	vertices, intersections := findHullParabolas(row)
-	marchParabolas(row, vertices, intersections)
-}
-
-func transpose(field [][]float64) [][]float64 {
-	transposed := make([][]float64, len(field[0]))
-	for x := range transposed {
-		transposed[x] = make([]float64, len(field))
-		for y := range transposed[x] {
-			transposed[x][y] = field[y][x]
-		}
-	}
-	return transposed
-}
-
-func computeEdt(img image.Image, width int, height int, maxvalue int) map[Coords]float64 {
-
-	field := make([][]float64, width+maxvalue*2)
-	for x := range field {
-		field[x] = make([]float64, height+maxvalue*2)
-		for y := range field[x] {
-			if x > maxvalue && x < img.Bounds().Dx()+maxvalue && y > maxvalue && y < img.Bounds().Dy()+maxvalue && isBlack(img.At(x-maxvalue, y-maxvalue)) {
-				field[x][y] = 0
-			} else {
-				field[x][y] = math.MaxInt16
-			}
-		}
-	}
-
-	for _, row := range field {
-		horizontalPass(row)
-	}
-
-	field = transpose(field)
-
-	for _, row := range field {
-		horizontalPass(row)
-	}
-
-	field = transpose(field)
-
-	return convertField(field, maxvalue, maxvalue)
+	return math.Max(0, math.Sqrt(v)/l.Sqrtab-l.Translation) * l.Factor
 }
 
-func doNothing(x int, y int) {}
-
-func convertField(field [][]float64, offsetX int, offsetY int) map[Coords]float64 {
-	offsetField := make(map[Coords]float64)
-	for x := range field {
-		for y := range field[x] {
-			offsetField[Coords{int64(x - offsetX), int64(y - offsetY)}] = math.Sqrt(field[x][y])
-		}
-	}
-	return offsetField
+func (l LineOrbit) Describe() params.OrbitDescription {
+	return params.OrbitDescription{Type: "line", Args: []float64{l.A, l.B, l.C, l.MaxValue}, Coords: l.Coords}
 }
 
-func CreateImageOrbit(params params.ImageParams, path string, maxvalue float64) (ImageOrbit, error) {
-	f, err := os.Open(path)
+// CreateImageOrbit returns a trap on the shape of the image of the trap store, made of its pixels whose coverage by black or opaque colors is at least the threshold,
+// or on the outline of the shape, stretched over the rectangle left, top, right, bottom, or over the whole window without one.
+// Its distances are counted in pixels of the image and normalized to range from 0 to maxvalue.
+func CreateImageOrbit(name string, maxvalue float64, threshold float64, outline bool, rect []float64, coords string, window params.Window) (ImageOrbit, error) {
+	img, sum, err := Traps.Load(name)
 	if err != nil {
 		return ImageOrbit{}, err
 	}
 
-	img, err := png.Decode(f)
-
-	if err != nil {
-		return ImageOrbit{}, err
+	planeRect := window
+	if len(rect) == 4 {
+		planeRect.Left, planeRect.Top = toPlane(rect[0], rect[1], coords, window)
+		planeRect.Right, planeRect.Bottom = toPlane(rect[2], rect[3], coords, window)
 	}
 
-	distances := computeEdt(img, params.Width, params.Height, int(maxvalue))
-
-	minDist := 0.0
-	maxDist := 0.0
-
-	for _, v := range distances {
-		if maxDist < v {
-			maxDist = v
-		}
+	// distances are defined up to maxvalue pixels around the image
+	field := cachedEdt(img, sum, int(math.Max(0, math.Min(maxvalue, maxTrapPadding))), threshold)
+	maxDist := math.Max(field.maxDist, 0)
+	if outline {
+		maxDist = math.Max(maxDist, -field.minDist)
 	}
+	translation, factor := normalization(0, maxDist, maxvalue)
 
-	factor := (maxvalue - minDist) / (maxDist - minDist)
-	translation := minDist
-
-	return ImageOrbit{Distances: distances, Factor: factor, Translation: translation, Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+	return ImageOrbit{Name: name, MaxValue: maxvalue, Threshold: threshold, Outline: outline, Coords: coords, Rect: rect, PlaneRect: planeRect, Distances: field.distances, Factor: factor, Translation: translation, Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), Texture: img}, nil
 }
 
+// GetOrbitFastValue returns the distance to the outline of the shape, or to the shape itself, 0 inside it
 func (im ImageOrbit) GetOrbitFastValue(z complex128) float64 {
-	x := real(z)
-	y := imag(z)
-
-	hFloat := float64(im.Height)
-	wFloat := float64(im.Width)
-
-	xOffset := 2.0
-	yOffset := 1.0
-	xFactor := wFloat / 3
-	yFactor := hFloat / 2
-
-	xImg := x*xFactor + xOffset/xFactor
-	yImg := y*yFactor + yOffset/yFactor
-
-	dist, ok := im.Distances[Coords{int64(xImg), int64(yImg)}]
+	xImg := (real(z) - im.PlaneRect.Left) / (im.PlaneRect.Right - im.PlaneRect.Left) * float64(im.Width)
+	yImg := (imag(z) - im.PlaneRect.Top) / (im.PlaneRect.Bottom - im.PlaneRect.Top) * float64(im.Height)
 
+	dist, ok := im.Distances.At(xImg, yImg)
 	if !ok {
 		return math.MaxInt64
 	}
-	return dist
+	if im.Outline {
+		return math.Abs(dist)
+	}
+	return math.Max(dist, 0)
 }
 
 func (im ImageOrbit) GetOrbitValue(v float64) float64 {
@@ -275,3 +202,30 @@ func (im ImageOrbit) GetOrbitValue(v float64) float64 {
 	}
 	return (v - im.Translation) * im.Factor
 }
+
+// GetTextureCoords returns the coordinates of the point in the image, 0,0 being its top left corner and 1,1 its bottom right one
+func (im ImageOrbit) GetTextureCoords(z complex128) (float64, float64) {
+	return (real(z) - im.PlaneRect.Left) / (im.PlaneRect.Right - im.PlaneRect.Left), (imag(z) - im.PlaneRect.Top) / (im.PlaneRect.Bottom - im.PlaneRect.Top)
+}
+
+// GetTextureColor returns the color of the pixel of the image at the texture coordinates, if they are in the image and the pixel is not transparent
+func (im ImageOrbit) GetTextureColor(u float64, v float64) (color.RGBA64, bool) {
+	if !(u >= 0 && u < 1 && v >= 0 && v < 1) {
+		return color.RGBA64{}, false
+	}
+	bounds := im.Texture.Bounds()
+	c := color.RGBA64Model.Convert(im.Texture.At(bounds.Min.X+int(u*float64(im.Width)), bounds.Min.Y+int(v*float64(im.Height)))).(color.RGBA64)
+	return c, c.A > 0
+}
+
+func (im ImageOrbit) Describe() params.OrbitDescription {
+	orbitType := "raster"
+	if im.Outline {
+		orbitType = "outline"
+	}
+	args := []float64{im.MaxValue}
+	if im.Threshold != DefaultThreshold {
+		args = append(args, im.Threshold)
+	}
+	return params.OrbitDescription{Type: orbitType, Name: im.Name, Args: append(args, im.Rect...), Coords: im.Coords}
+}
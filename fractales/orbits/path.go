@@ -0,0 +1,257 @@
+package orbits
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// curveSegments is the number of segments a curve of a path is flattened into
+const curveSegments = 16
+
+// pathArities gives the number of arguments of the commands of SVG paths
+var pathArities = map[byte]int{'M': 2, 'L': 2, 'H': 1, 'V': 1, 'C': 6, 'S': 4, 'Q': 4, 'T': 2, 'A': 7, 'Z': 0}
+
+// tokenizePath splits SVG path data into its commands and numbers
+func tokenizePath(data string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == ',' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			dot := c == '.'
+			for j < len(data) {
+				d := data[j]
+				if d >= '0' && d <= '9' {
+					j++
+				} else if d == '.' && !dot {
+					dot = true
+					j++
+				} else if (d == 'e' || d == 'E') && j+1 < len(data) {
+					dot = true
+					j++
+					if data[j] == '-' || data[j] == '+' {
+						j++
+					}
+				} else {
+					break
+				}
+			}
+			// signs and dots must be part of a number
+			if _, err := strconv.ParseFloat(data[i:j], 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q in path", data[i:j])
+			}
+			tokens = append(tokens, data[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q in path", c)
+		}
+	}
+	return tokens, nil
+}
+
+// parsePath flattens SVG path data into polylines, one per subpath
+func parsePath(data string) ([]polyline, error) {
+	tokens, err := tokenizePath(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+
+	var polylines []polyline
+	var current polyline
+	var x, y, startX, startY float64
+	// control point of the previous curve, reflected by the smooth curves
+	var ctrlX, ctrlY float64
+	var previous byte
+
+	flush := func(closed bool) {
+		if len(current.points) > 0 {
+			current.closed = closed
+			polylines = append(polylines, current)
+		}
+		current = polyline{}
+	}
+	lineTo := func(nx float64, ny float64) {
+		if len(current.points) == 0 {
+			current.points = append(current.points, vertex{x, y})
+		}
+		current.points = append(current.points, vertex{nx, ny})
+		x, y = nx, ny
+	}
+
+	var command byte
+	for i := 0; i < len(tokens); {
+		token := tokens[i]
+		if _, err := strconv.ParseFloat(token, 64); err != nil {
+			command = token[0]
+			i++
+		} else if command == 0 || command == 'Z' || command == 'z' {
+			return nil, fmt.Errorf("path numbers without a command")
+		}
+
+		upper := command &^ 0x20
+		arity, ok := pathArities[upper]
+		if !ok {
+			return nil, fmt.Errorf("unknown command %q in path", token)
+		}
+		if i+arity > len(tokens) {
+			return nil, fmt.Errorf("missing arguments for %c in path", command)
+		}
+		args := make([]float64, arity)
+		for k := range args {
+			args[k], err = strconv.ParseFloat(tokens[i+k], 64)
+			if err != nil {
+				return nil, fmt.Errorf("missing arguments for %c in path", command)
+			}
+		}
+		i += arity
+
+		relative := command != upper
+		// absolute returns the coordinates of the kth point of the arguments
+		absolute := func(k int) (float64, float64) {
+			if relative {
+				return x + args[2*k], y + args[2*k+1]
+			}
+			return args[2*k], args[2*k+1]
+		}
+		reflected := func(curves string) (float64, float64) {
+			if strings.IndexByte(curves, previous) >= 0 {
+				return 2*x - ctrlX, 2*y - ctrlY
+			}
+			return x, y
+		}
+
+		switch upper {
+		case 'M':
+			flush(false)
+			x, y = absolute(0)
+			startX, startY = x, y
+			current.points = []vertex{{x, y}}
+			// further pairs of a move are lines
+			if relative {
+				command = 'l'
+			} else {
+				command = 'L'
+			}
+		case 'L':
+			lineTo(absolute(0))
+		case 'H':
+			nx := args[0]
+			if relative {
+				nx += x
+			}
+			lineTo(nx, y)
+		case 'V':
+			ny := args[0]
+			if relative {
+				ny += y
+			}
+			lineTo(x, ny)
+		case 'C', 'S':
+			var c1x, c1y, c2x, c2y, ex, ey float64
+			if upper == 'C' {
+				c1x, c1y = absolute(0)
+				c2x, c2y = absolute(1)
+				ex, ey = absolute(2)
+			} else {
+				c1x, c1y = reflected("CS")
+				c2x, c2y = absolute(0)
+				ex, ey = absolute(1)
+			}
+			x0, y0 := x, y
+			for k := 1; k <= curveSegments; k++ {
+				t := float64(k) / curveSegments
+				u := 1 - t
+				lineTo(u*u*u*x0+3*u*u*t*c1x+3*u*t*t*c2x+t*t*t*ex, u*u*u*y0+3*u*u*t*c1y+3*u*t*t*c2y+t*t*t*ey)
+			}
+			ctrlX, ctrlY = c2x, c2y
+		case 'Q', 'T':
+			var cx, cy, ex, ey float64
+			if upper == 'Q' {
+				cx, cy = absolute(0)
+				ex, ey = absolute(1)
+			} else {
+				cx, cy = reflected("QT")
+				ex, ey = absolute(0)
+			}
+			x0, y0 := x, y
+			for k := 1; k <= curveSegments; k++ {
+				t := float64(k) / curveSegments
+				u := 1 - t
+				lineTo(u*u*x0+2*u*t*cx+t*t*ex, u*u*y0+2*u*t*cy+t*t*ey)
+			}
+			ctrlX, ctrlY = cx, cy
+		case 'A':
+			ex, ey := args[5], args[6]
+			if relative {
+				ex, ey = x+ex, y+ey
+			}
+			arc(x, y, args[0], args[1], args[2], args[3] != 0, args[4] != 0, ex, ey, lineTo)
+		case 'Z':
+			x, y = startX, startY
+			flush(true)
+			current.points = []vertex{{x, y}}
+		}
+		previous = upper
+	}
+	if len(current.points) > 1 {
+		flush(false)
+	}
+	if len(polylines) == 0 {
+		return nil, fmt.Errorf("path without segments")
+	}
+	return polylines, nil
+}
+
+// arc draws with lineTo the elliptical arc of an SVG path from (x0, y0) to (x1, y1), converting it from endpoint to center parameterization
+func arc(x0 float64, y0 float64, rx float64, ry float64, rotation float64, large bool, sweep bool, x1 float64, y1 float64, lineTo func(float64, float64)) {
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 || (x0 == x1 && y0 == y1) {
+		lineTo(x1, y1)
+		return
+	}
+	phi := rotation * math.Pi / 180
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	dx, dy := (x0-x1)/2, (y0-y1)/2
+	px, py := cos*dx+sin*dy, -sin*dx+cos*dy
+
+	if lambda := px*px/(rx*rx) + py*py/(ry*ry); lambda > 1 {
+		rx, ry = rx*math.Sqrt(lambda), ry*math.Sqrt(lambda)
+	}
+	num := rx*rx*ry*ry - rx*rx*py*py - ry*ry*px*px
+	den := rx*rx*py*py + ry*ry*px*px
+	coef := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cpx, cpy := coef*rx*py/ry, -coef*ry*px/rx
+	cx, cy := cos*cpx-sin*cpy+(x0+x1)/2, sin*cpx+cos*cpy+(y0+y1)/2
+
+	theta := math.Atan2((py-cpy)/ry, (px-cpx)/rx)
+	delta := math.Atan2((-py-cpy)/ry, (-px-cpx)/rx) - theta
+	if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	} else if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	}
+
+	for k := 1; k <= curveSegments; k++ {
+		if k == curveSegments {
+			lineTo(x1, y1)
+			break
+		}
+		t := theta + delta*float64(k)/curveSegments
+		ex, ey := rx*math.Cos(t), ry*math.Sin(t)
+		lineTo(cos*ex-sin*ey+cx, sin*ex+cos*ey+cy)
+	}
+}
@@ -0,0 +1,312 @@
+package orbits
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// normalizationSamples is the number of intervals between the samples of each side of the window used to find the range of the distances to a shape
+const normalizationSamples = 64
+
+// sdf is the signed distance from a point of the plane to a shape, negative inside the shape
+type sdf func(x float64, y float64) float64
+
+// Shape is a shape of an orbit trap given by its signed distance field: a primitive given by its arguments,
+// an SVG path given by its data or a combination of other shapes
+type Shape struct {
+	Type   string
+	Args   []float64
+	Path   string
+	Shapes []Shape
+	sdf    sdf
+}
+
+// shapeArities gives the numbers of arguments accepted by the primitives
+var shapeArities = map[string][]int{
+	"point":   {2},
+	"line":    {3},
+	"circle":  {3},
+	"ring":    {4},
+	"segment": {4},
+	"cross":   {3},
+	"rect":    {4},
+	"polygon": {4, 5},
+	"star":    {5, 6},
+	"grid":    {0, 1},
+	"path":    {0},
+}
+
+// IsShape tells whether the type is a primitive or a combinator of shapes
+func IsShape(shapeType string) bool {
+	_, primitive := shapeArities[shapeType]
+	return primitive || isCombinator(shapeType)
+}
+
+func isCombinator(shapeType string) bool {
+	return shapeType == "union" || shapeType == "intersect" || shapeType == "subtract" || shapeType == "smooth"
+}
+
+// NewShape returns the shape of the type with the arguments, path data for paths and shapes for combinators:
+// union(shapes...), intersect(shapes...), subtract(shape, shape) and smooth(shapes..., k) for a union rounded over a distance k
+func NewShape(shapeType string, args []float64, path string, shapes []Shape) (Shape, error) {
+	shape := Shape{Type: shapeType, Args: args, Path: path, Shapes: shapes}
+
+	if isCombinator(shapeType) {
+		return shape, shape.combine()
+	}
+
+	arities, ok := shapeArities[shapeType]
+	if !ok {
+		return Shape{}, fmt.Errorf("unknown shape %s", shapeType)
+	}
+	if len(shapes) > 0 {
+		return Shape{}, fmt.Errorf("%s does not take shapes", shapeType)
+	}
+	valid := false
+	for _, arity := range arities {
+		valid = valid || len(args) == arity
+	}
+	if !valid {
+		return Shape{}, fmt.Errorf("%s takes %v arguments, not %d", shapeType, arities, len(args))
+	}
+
+	a := args
+	switch shapeType {
+	case "point":
+		shape.sdf = func(x float64, y float64) float64 {
+			return math.Hypot(x-a[0], y-a[1])
+		}
+	case "line":
+		norm := math.Hypot(a[0], a[1])
+		if norm == 0 {
+			return Shape{}, errors.New("line needs a non-zero normal")
+		}
+		shape.sdf = func(x float64, y float64) float64 {
+			return math.Abs(a[0]*x+a[1]*y+a[2]) / norm
+		}
+	case "circle":
+		shape.sdf = func(x float64, y float64) float64 {
+			return math.Hypot(x-a[0], y-a[1]) - a[2]
+		}
+	case "ring":
+		shape.sdf = func(x float64, y float64) float64 {
+			return math.Abs(math.Hypot(x-a[0], y-a[1])-a[2]) - a[3]
+		}
+	case "segment":
+		shape.sdf = func(x float64, y float64) float64 {
+			return segmentDistance(x, y, a[0], a[1], a[2], a[3])
+		}
+	case "cross":
+		shape.sdf = func(x float64, y float64) float64 {
+			return math.Min(segmentDistance(x, y, a[0]-a[2], a[1], a[0]+a[2], a[1]), segmentDistance(x, y, a[0], a[1]-a[2], a[0], a[1]+a[2]))
+		}
+	case "rect":
+		cx, cy := (a[0]+a[2])/2, (a[1]+a[3])/2
+		hx, hy := math.Abs(a[2]-a[0])/2, math.Abs(a[3]-a[1])/2
+		shape.sdf = func(x float64, y float64) float64 {
+			dx, dy := math.Abs(x-cx)-hx, math.Abs(y-cy)-hy
+			return math.Hypot(math.Max(dx, 0), math.Max(dy, 0)) + math.Min(math.Max(dx, dy), 0)
+		}
+	case "polygon", "star":
+		sides := a[3]
+		if shapeType == "star" {
+			sides = a[4]
+		}
+		if sides < 3 || sides != math.Trunc(sides) || sides > 1000 {
+			return Shape{}, fmt.Errorf("%s needs a whole number of sides from 3, not %v", shapeType, sides)
+		}
+		angle := 0.0
+		if len(a) == arities[1] {
+			angle = a[len(a)-1] * math.Pi / 180
+		}
+		radii := []float64{a[2]}
+		if shapeType == "star" {
+			radii = []float64{a[2], a[3]}
+		}
+		var polygon polyline
+		points := int(sides) * len(radii)
+		for i := 0; i < points; i++ {
+			theta := angle + 2*math.Pi*float64(i)/float64(points)
+			r := radii[i%len(radii)]
+			polygon.points = append(polygon.points, vertex{a[0] + r*math.Cos(theta), a[1] + r*math.Sin(theta)})
+		}
+		polygon.closed = true
+		shape.sdf = polylinesSDF([]polyline{polygon})
+	case "grid":
+		spacing := 1.0
+		if len(a) == 1 {
+			spacing = a[0]
+		}
+		if spacing <= 0 {
+			return Shape{}, fmt.Errorf("grid needs a positive spacing, not %v", spacing)
+		}
+		shape.sdf = func(x float64, y float64) float64 {
+			return math.Min(math.Abs(x-spacing*math.Round(x/spacing)), math.Abs(y-spacing*math.Round(y/spacing)))
+		}
+	case "path":
+		polylines, err := parsePath(path)
+		if err != nil {
+			return Shape{}, err
+		}
+		shape.sdf = polylinesSDF(polylines)
+	}
+	return shape, nil
+}
+
+// combine sets the signed distance field of a combinator from the ones of its shapes
+func (s *Shape) combine() error {
+	minShapes := 1
+	if s.Type == "subtract" || s.Type == "smooth" {
+		minShapes = 2
+	}
+	if len(s.Shapes) < minShapes || (s.Type == "subtract" && len(s.Shapes) != 2) {
+		return fmt.Errorf("%s takes at least %d shapes, not %d", s.Type, minShapes, len(s.Shapes))
+	}
+	if (s.Type == "smooth") != (len(s.Args) == 1) || (s.Type == "smooth" && s.Args[0] <= 0) {
+		return fmt.Errorf("%s takes %d arguments", s.Type, len(s.Args))
+	}
+
+	shapes := s.Shapes
+	switch s.Type {
+	case "union":
+		s.sdf = func(x float64, y float64) float64 {
+			d := shapes[0].sdf(x, y)
+			for _, shape := range shapes[1:] {
+				d = math.Min(d, shape.sdf(x, y))
+			}
+			return d
+		}
+	case "intersect":
+		s.sdf = func(x float64, y float64) float64 {
+			d := shapes[0].sdf(x, y)
+			for _, shape := range shapes[1:] {
+				d = math.Max(d, shape.sdf(x, y))
+			}
+			return d
+		}
+	case "subtract":
+		s.sdf = func(x float64, y float64) float64 {
+			return math.Max(shapes[0].sdf(x, y), -shapes[1].sdf(x, y))
+		}
+	case "smooth":
+		k := s.Args[0]
+		s.sdf = func(x float64, y float64) float64 {
+			d := shapes[0].sdf(x, y)
+			for _, shape := range shapes[1:] {
+				other := shape.sdf(x, y)
+				h := math.Max(k-math.Abs(d-other), 0) / k
+				d = math.Min(d, other) - h*h*k/4
+			}
+			return d
+		}
+	}
+	return nil
+}
+
+// Describe returns the description of the shape, without any maximum value
+func (s Shape) Describe() params.OrbitDescription {
+	description := params.OrbitDescription{Type: s.Type, Path: s.Path, Args: s.Args}
+	for _, shape := range s.Shapes {
+		description.Orbits = append(description.Orbits, shape.Describe())
+	}
+	return description
+}
+
+// ShapeOrbit is a trap on a shape, the distance to the shape being 0 inside it
+type ShapeOrbit struct {
+	Shape       Shape
+	MaxValue    float64
+	Coords      string
+	Window      params.Window
+	Translation float64
+	Factor      float64
+}
+
+// CreateShapeOrbit returns a trap on the shape, whose distances are normalized so that the points of the window range from 0 to maxvalue
+func CreateShapeOrbit(shape Shape, maxvalue float64, coords string, window params.Window) ShapeOrbit {
+	orbit := ShapeOrbit{Shape: shape, MaxValue: maxvalue, Coords: coords, Window: window}
+
+	minDist, maxDist := math.MaxFloat64, 0.0
+	for i := 0; i <= normalizationSamples; i++ {
+		for j := 0; j <= normalizationSamples; j++ {
+			x := window.Left + float64(i)/normalizationSamples*(window.Right-window.Left)
+			y := window.Top + float64(j)/normalizationSamples*(window.Bottom-window.Top)
+			dist := orbit.GetOrbitFastValue(complex(x, y))
+			minDist = math.Min(minDist, dist)
+			maxDist = math.Max(maxDist, dist)
+		}
+	}
+
+	orbit.Translation, orbit.Factor = normalization(minDist, maxDist, maxvalue)
+	return orbit
+}
+
+func (s ShapeOrbit) GetOrbitFastValue(z complex128) float64 {
+	x, y := real(z), imag(z)
+	if s.Coords == CoordsView {
+		x = (x - s.Window.Left) / (s.Window.Right - s.Window.Left)
+		y = (y - s.Window.Top) / (s.Window.Bottom - s.Window.Top)
+	}
+	return math.Max(s.Shape.sdf(x, y), 0)
+}
+
+func (s ShapeOrbit) GetOrbitValue(v float64) float64 {
+	return math.Max(0, v-s.Translation) * s.Factor
+}
+
+func (s ShapeOrbit) Describe() params.OrbitDescription {
+	description := s.Shape.Describe()
+	description.Args = append(append([]float64{}, description.Args...), s.MaxValue)
+	description.Coords = s.Coords
+	return description
+}
+
+// vertex is a point of a polyline
+type vertex struct {
+	X float64
+	Y float64
+}
+
+// polyline is a list of points joined by segments, closed polylines also joining the last point to the first one
+type polyline struct {
+	points []vertex
+	closed bool
+}
+
+// segmentDistance returns the distance from (x, y) to the segment from (ax, ay) to (bx, by)
+func segmentDistance(x float64, y float64, ax float64, ay float64, bx float64, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(((x-ax)*dx+(y-ay)*dy)/length, 1))
+	}
+	return math.Hypot(x-ax-t*dx, y-ay-t*dy)
+}
+
+// polylinesSDF returns the signed distance field of the polylines, the inside of the closed ones following the even-odd rule
+func polylinesSDF(polylines []polyline) sdf {
+	return func(x float64, y float64) float64 {
+		dist := math.MaxFloat64
+		inside := false
+		for _, p := range polylines {
+			n := len(p.points)
+			if n == 1 {
+				dist = math.Min(dist, math.Hypot(x-p.points[0].X, y-p.points[0].Y))
+			}
+			for i := 0; i+1 < n || (p.closed && i < n && n > 1); i++ {
+				a, b := p.points[i], p.points[(i+1)%n]
+				dist = math.Min(dist, segmentDistance(x, y, a.X, a.Y, b.X, b.Y))
+				if p.closed && (a.Y > y) != (b.Y > y) && x < a.X+(y-a.Y)/(b.Y-a.Y)*(b.X-a.X) {
+					inside = !inside
+				}
+			}
+		}
+		if inside {
+			return -dist
+		}
+		return dist
+	}
+}
@@ -0,0 +1,279 @@
+package orbits
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// trap images may be uploaded as JPEG and GIF as well as PNG
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+// maxTrapPixels is the maximum number of pixels of a trap image
+const maxTrapPixels = 4096 * 4096
+
+// maxStoreSize is the number of bytes the images of a trap store may hold, the least recently used ones being removed beyond it
+const maxStoreSize = 1 << 30
+
+// maxTrapPadding is the maximum number of pixels around a trap image its distance field covers
+const maxTrapPadding = 1024
+
+// edtCacheSize is the number of distance fields of trap images kept in memory
+const edtCacheSize = 16
+
+// edtCacheBytes is the number of bytes the distance fields of trap images kept in memory may hold
+const edtCacheBytes = 512 << 20
+
+// trapNameRegexp matches the names of trap images: the SHA-256 of stored images or the file name of bundled ones
+var trapNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9\-]+$`)
+
+// dataURIRegexp matches the base64 data URIs of trap images
+var dataURIRegexp = regexp.MustCompile(`^data:image/(png|jpeg|gif);base64,`)
+
+// Store is a content-addressed store of trap images, named by the SHA-256 of their uploaded content and kept as PNG in Dir up to maxStoreSize bytes,
+// falling back to the PNG images of Bundled named by their file name
+type Store struct {
+	Dir     string
+	Bundled string
+}
+
+// Traps is the store the raster traps are loaded from
+var Traps = Store{Dir: filepath.Join(os.TempDir(), "marzipango-traps"), Bundled: "fractales/orbits"}
+
+// IsDataURI tells whether the raster trap name is a data URI
+func IsDataURI(name string) bool {
+	return strings.HasPrefix(name, "data:")
+}
+
+// ValidTrapName tells whether the name may be the name of a trap image
+func ValidTrapName(name string) bool {
+	return trapNameRegexp.MatchString(name)
+}
+
+// Put stores the PNG, JPEG or GIF image and returns its name
+func (s Store) Put(data []byte) (string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if config.Width*config.Height > maxTrapPixels || config.Width <= 0 || config.Height <= 0 {
+		return "", fmt.Errorf("trap images must have at most %d pixels, not %dx%d", maxTrapPixels, config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:])
+	path := filepath.Join(s.Dir, name+".png")
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		return name, os.Chtimes(path, now, now)
+	}
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", err
+	}
+	// images are written to a temporary file first so that concurrent renders never read a partial image
+	file, err := ioutil.TempFile(s.Dir, name+"-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return "", err
+	}
+	return name, s.evict(maxStoreSize, path)
+}
+
+// evict removes the least recently used images of the store until they hold at most maxSize bytes, keeping the image at the path
+func (s Store) evict(maxSize int64, keep string) error {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	var images []os.FileInfo
+	size := int64(0)
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".png" {
+			images = append(images, file)
+			size += file.Size()
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ModTime().Before(images[j].ModTime()) })
+
+	for _, file := range images {
+		if size <= maxSize {
+			break
+		}
+		path := filepath.Join(s.Dir, file.Name())
+		if path == keep {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= file.Size()
+	}
+	return nil
+}
+
+// Has tells whether the store holds an image of the name
+func (s Store) Has(name string) bool {
+	if !ValidTrapName(name) {
+		return false
+	}
+	for _, dir := range []string{s.Dir, s.Bundled} {
+		if _, err := os.Stat(filepath.Join(dir, name+".png")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeDataURI returns the image of a base64 data URI
+func decodeDataURI(uri string) ([]byte, error) {
+	header := dataURIRegexp.FindString(uri)
+	if header == "" {
+		return nil, errors.New("trap data URIs must hold base64 PNG, JPEG or GIF images")
+	}
+	// query strings decode unescaped + to spaces
+	payload := strings.ReplaceAll(uri[len(header):], " ", "+")
+	return base64.StdEncoding.DecodeString(payload)
+}
+
+// DataURIName returns the name the image of a base64 data URI is stored as
+func DataURIName(uri string) (string, error) {
+	data, err := decodeDataURI(uri)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// PutDataURI stores the image of a base64 data URI and returns its name
+func (s Store) PutDataURI(uri string) (string, error) {
+	data, err := decodeDataURI(uri)
+	if err != nil {
+		return "", err
+	}
+	return s.Put(data)
+}
+
+// Load returns the image of the name and the SHA-256 of its file
+func (s Store) Load(name string) (image.Image, [sha256.Size]byte, error) {
+	if !ValidTrapName(name) {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("invalid trap name %s", name)
+	}
+	path := filepath.Join(s.Dir, name+".png")
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		// loaded images are kept over the others when the store is full
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(filepath.Join(s.Bundled, name+".png"))
+	}
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+	return img, sha256.Sum256(data), nil
+}
+
+// edt is the distance field of a trap image and its range of distances, computed once
+type edt struct {
+	once      sync.Once
+	distances DistanceField
+	minDist   float64
+	maxDist   float64
+	size      int64
+}
+
+// edtKey identifies the distance field of an image padded on each side, whose shape has the coverage threshold
+type edtKey struct {
+	sum       [sha256.Size]byte
+	padding   int
+	threshold float64
+}
+
+var (
+	edtsMu   sync.Mutex
+	edts     = make(map[edtKey]*edt)
+	edtOrder []edtKey
+)
+
+// cachedEdt returns the distance field of the shape of the image whose content has the SHA-256, computing it if it is not among the most recently used ones.
+// Distance fields are computed without holding the cache, so that traps of other images do not wait for them.
+// The distance fields are shared between the traps and must not be modified.
+func cachedEdt(img image.Image, sum [sha256.Size]byte, padding int, threshold float64) *edt {
+	key := edtKey{sum: sum, padding: padding, threshold: threshold}
+	edtsMu.Lock()
+	for i, k := range edtOrder {
+		if k == key {
+			edtOrder = append(edtOrder[:i], edtOrder[i+1:]...)
+			break
+		}
+	}
+	edtOrder = append(edtOrder, key)
+
+	field, ok := edts[key]
+	if !ok {
+		field = &edt{}
+		edts[key] = field
+		evictEdts(edtCacheSize, edtCacheBytes)
+	}
+	edtsMu.Unlock()
+
+	field.once.Do(func() {
+		field.distances = computeEdt(img, padding, threshold)
+		field.minDist, field.maxDist = field.distances.Range()
+
+		edtsMu.Lock()
+		defer edtsMu.Unlock()
+		field.size = 4 * int64(len(field.distances.Values))
+		evictEdts(edtCacheSize, edtCacheBytes)
+	})
+	return field
+}
+
+// evictEdts removes the least recently used distance fields until at most maxEntries of them hold at most maxBytes.
+// A distance field larger than maxBytes is removed as well. edtsMu must be held.
+func evictEdts(maxEntries int, maxBytes int64) {
+	size := int64(0)
+	for _, field := range edts {
+		size += field.size
+	}
+	for len(edtOrder) > 0 && (len(edtOrder) > maxEntries || size > maxBytes) {
+		size -= edts[edtOrder[0]].size
+		delete(edts, edtOrder[0])
+		edtOrder = edtOrder[1:]
+	}
+}
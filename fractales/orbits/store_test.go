@@ -0,0 +1,92 @@
+package orbits
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := Store{Dir: dir}
+
+	var names []string
+	for seed := int64(0); seed < 3; seed++ {
+		var encoded bytes.Buffer
+		png.Encode(&encoded, randomTrapImage(32, 32, 20, seed))
+		name, err := store.Put(encoded.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first image is the least recently used one
+		used := time.Now().Add(time.Duration(seed) * time.Minute)
+		os.Chtimes(filepath.Join(dir, name+".png"), used, used)
+		names = append(names, name)
+	}
+	if !store.Has(names[0]) || store.Has("missing") || store.Has("../traps") {
+		t.Errorf("Only stored images should be found")
+	}
+
+	size := int64(0)
+	for _, name := range names[1:] {
+		info, _ := os.Stat(filepath.Join(dir, name+".png"))
+		size += info.Size()
+	}
+	last := filepath.Join(dir, names[2]+".png")
+	if err := store.evict(size, last); err != nil {
+		t.Fatal(err)
+	}
+	if store.Has(names[0]) || !store.Has(names[1]) || !store.Has(names[2]) {
+		t.Errorf("The least recently used image should be evicted")
+	}
+
+	if err := store.evict(0, last); err != nil {
+		t.Fatal(err)
+	}
+	if store.Has(names[1]) || !store.Has(names[2]) {
+		t.Errorf("Every image but the kept one should be evicted")
+	}
+}
+
+func TestCachedEdt(t *testing.T) {
+	edtsMu.Lock()
+	edts = make(map[edtKey]*edt)
+	edtOrder = nil
+	edtsMu.Unlock()
+
+	img := randomTrapImage(40, 30, 10, 1)
+	fields := make(chan *edt, 4)
+	for i := 0; i < cap(fields); i++ {
+		go func() {
+			fields <- cachedEdt(img, [sha256.Size]byte{1}, 5, DefaultThreshold)
+		}()
+	}
+	first := <-fields
+	for i := 1; i < cap(fields); i++ {
+		if field := <-fields; field != first {
+			t.Errorf("Concurrent traps of an image should share its distance field")
+		}
+	}
+	if first.distances.Width != 50 || first.size != 4*50*40 {
+		t.Errorf("Distance field should cover the padded image, got %dx%d (%d bytes)", first.distances.Width, first.distances.Height, first.size)
+	}
+
+	cachedEdt(img, [sha256.Size]byte{2}, 5, DefaultThreshold)
+	edtsMu.Lock()
+	evictEdts(edtCacheSize, first.size)
+	_, kept := edts[edtKey{sum: [sha256.Size]byte{1}, padding: 5, threshold: DefaultThreshold}]
+	remaining := len(edts)
+	edtsMu.Unlock()
+	if kept || remaining != 1 {
+		t.Errorf("The least recently used distance field should be evicted once the cache is full, %d remain", remaining)
+	}
+}
@@ -0,0 +1,7 @@
+package fractales
+
+// ProgressFunction is called with the amount of work done so far and the total amount of work of a computation
+type ProgressFunction func(done int, total int)
+
+// progressInterval is the number of chaos game iterations between two progress reports and cancellation checks
+const progressInterval = 1 << 20
@@ -1,40 +1,66 @@
 package fractales
 
 import (
-	"github.com/Balise42/marzipango/fractales/orbits"
-	"github.com/Balise42/marzipango/params"
+	"context"
 	"math/rand"
+
+	"github.com/Balise42/marzipango/params"
 )
 
-func SierpValueComputeLow(params params.ImageParams) ValueComputation {
+// sierpWindow is the window of the plane showing the Sierpinski triangle
+var sierpWindow = ifsWindow{Left: -1, Right: 0, Top: -1, Bottom: 0}
+
+// sierpIterations is the number of iterations of the chaos game drawing the Sierpinski triangle
+const sierpIterations = 50000000
+
+func SierpValueComputeLow(ctx context.Context, params params.ImageParams, progress ProgressFunction) ValueComputation {
 	sierpFuncs := createSierpFuncs()
-	ifsMap := createSierpMap(params, sierpFuncs)
-
-	return func(x int, y int) (float64, bool) {
-		val, ok := ifsMap[orbits.Coords{int64(x),int64(y)}]
-		if !ok {
-			return 0, false
-		} else {
-			return val, true
-		}
+	histogram := accumulateHistogram(ctx, params, func(seed int64) ifsHistogram {
+		pass := params
+		pass.Seed = seed
+		return createSierpHistogram(ctx, pass, sierpFuncs, chaosGameIterations(params, sierpIterations), 0, params.Height, progress)
+	})
+
+	return func(x float64, y float64) (float64, bool, float64) {
+		val, ok := histogram.value(x, y)
+		return val, ok, 0
 	}
 }
 
-func createSierpMap(params params.ImageParams, funcs []ifsFunc) map[orbits.Coords]float64 {
-	res := make(map[orbits.Coords]float64)
-	x := float64(0)
-	y := float64(0)
-
-	for i := 0; i < 50000000; i++ {
-		rule := rand.Intn(3)
-		x1, y1 := funcs[rule](x, y)
-		coords := scaleFlame(x1, y1, params)
-		res[coords] = res[coords] + 1
-		x, y = x1, y1
-	}
-	return res
+// SierpBandValueComputer returns a BandValueComputation playing the chaos game of the Sierpinski triangle again for each band of rows of the image,
+// keeping only the points falling in it, so that the histogram of a band holding at most maxBytes is kept rather than the one of the whole image
+func SierpBandValueComputer(ctx context.Context, params params.ImageParams, maxBytes int64) BandValueComputation {
+	sierpFuncs := createSierpFuncs()
+	iterations := chaosGameIterations(params, sierpIterations)
+	return bandHistograms(params, iterations, maxBytes, func(top int, bottom int) ifsHistogram {
+		return createSierpHistogram(ctx, params, sierpFuncs, iterations, top, bottom, nil)
+	})
 }
 
+func createSierpHistogram(ctx context.Context, params params.ImageParams, funcs []ifsFunc, iterations int, top int, bottom int, progress ProgressFunction) ifsHistogram {
+	ctx, cancel := withBudget(ctx, params)
+	defer cancel()
+
+	histograms := newIFSHistograms(params, parallelWorkers(iterations), top, bottom)
+	parallelChaosGame(ctx, iterations, params.Seed, progress, func(worker int, rnd *rand.Rand, iterations int, next func(i int) bool) {
+		res := histograms[worker]
+		x := float64(0)
+		y := float64(0)
+
+		for i := 0; next(i); i++ {
+			rule := rnd.Intn(3)
+			x1, y1 := funcs[rule](x, y)
+			if index, ok := sierpWindow.index(x1, y1, params); ok {
+				res.add(index)
+			}
+			x, y = x1, y1
+		}
+	})
+	return mergeHistograms(histograms)
+}
+
+type ifsFunc func(float64, float64) (float64, float64)
+
 func createSierpFuncs() []ifsFunc {
 	F0 := func(x float64, y float64) (float64, float64) {
 		return x/2, y/2
@@ -0,0 +1,119 @@
+package fractales
+
+import (
+	"image/color"
+	"math"
+	"math/cmplx"
+
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// trapAggregator aggregates the distances of the points of an orbit to the traps according to the trap mode
+type trapAggregator struct {
+	orbits      []params.Orbit
+	trap        params.Trapping
+	dist        float64
+	closest     int
+	closestZ    complex128
+	closestTrap params.Orbit
+	hit         float64
+	sum         float64
+	count       int
+}
+
+func newTrapAggregator(orbits []params.Orbit, trap params.Trapping) trapAggregator {
+	return trapAggregator{orbits: orbits, trap: trap, dist: math.MaxFloat64, hit: math.MaxFloat64}
+}
+
+// add accounts for the point z reached at the iteration
+func (t *trapAggregator) add(iteration int, z complex128) {
+	dist := math.MaxFloat64
+	var trap params.Orbit
+	for _, orbit := range t.orbits {
+		if d := orbit.GetOrbitValue(orbit.GetOrbitFastValue(z)); d < dist {
+			dist, trap = d, orbit
+		}
+	}
+
+	if dist < t.dist {
+		t.dist, t.closest, t.closestZ, t.closestTrap = dist, iteration, z, trap
+	}
+	switch t.trap.Mode {
+	case params.TrapFirst:
+		if t.hit == math.MaxFloat64 && dist <= t.trap.Threshold {
+			t.hit = dist
+		}
+	case params.TrapLast:
+		if dist <= t.trap.Threshold {
+			t.hit = dist
+		}
+	case params.TrapAverage:
+		// raster traps have no distance outside of their image
+		if dist < math.MaxInt64 {
+			t.sum += dist
+			t.count++
+		}
+	}
+}
+
+// value returns the value of the orbit: the distance of its closest approach to the traps, of its first or last hit, falling back
+// to the closest approach when no point is within the threshold, its average distance, or the iteration of its closest approach
+func (t *trapAggregator) value() float64 {
+	switch t.trap.Mode {
+	case params.TrapFirst, params.TrapLast:
+		if t.hit != math.MaxFloat64 {
+			return t.hit
+		}
+	case params.TrapAverage:
+		if t.count > 0 {
+			return t.sum / float64(t.count)
+		}
+	case params.TrapIteration:
+		if t.dist != math.MaxFloat64 {
+			return float64(t.closest + 1)
+		}
+	}
+	return t.dist
+}
+
+// texture returns the color of the texture of the trap closest to the orbit at the trap-local coordinates of the closest approach, if that trap has a texture there
+func (t *trapAggregator) texture() (color.RGBA64, bool) {
+	textured, ok := t.closestTrap.(params.TexturedOrbit)
+	if !ok {
+		return color.RGBA64{}, false
+	}
+	return textured.GetTextureColor(textured.GetTextureCoords(t.closestZ))
+}
+
+// iterateTraps iterates z -> z^2 + c from z until it escapes or maxiter iterations, accounting for each point in traps, and returns the last point and whether it escaped
+func iterateTraps(z complex128, c complex128, maxiter int, traps *trapAggregator) (complex128, bool) {
+	i := 0
+	for i < maxiter && cmplx.Abs(z) < 4 {
+		z = z*z + c
+		traps.add(i, z)
+		i++
+	}
+	return z, i < maxiter
+}
+
+// OrbitTextureComputer returns a ColorComputation for the Mandelbrot or Julia set with orbit trapping, coloring the escaped points with the texture of the trap
+// closest to their orbit at the coordinates of the closest approach, and the other points and those whose closest trap has no texture there with colorPixel
+func OrbitTextureComputer(imageParams params.ImageParams, orbits []params.Orbit, colorPixel palettes.ColoringFunction) ColorComputation {
+	return func(x float64, y float64) color.RGBA64 {
+		traps := newTrapAggregator(orbits, imageParams.Trap)
+		var value, interior float64
+		var escaped bool
+		if imageParams.Type == "julia" {
+			value, escaped, interior = juliaTraps(scale(x, y, imageParams), imageParams.MaxIter, &traps, imageParams.Palette.Interior, periodTolerance(imageParams))
+		} else {
+			value, escaped, interior = mandelbrotTraps(scale(x, y, imageParams), imageParams.MaxIter, &traps, imageParams.Palette.Interior, periodTolerance(imageParams))
+		}
+		if escaped {
+			if textureColor, ok := traps.texture(); ok {
+				return textureColor
+			}
+		}
+		return colorPixel(value, escaped, interior)
+	}
+}
@@ -0,0 +1,85 @@
+package fractales
+
+import (
+	"image/color"
+	"math"
+	"math/cmplx"
+	"testing"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// distanceTrap is a trap whose value is the distance to its center
+type distanceTrap struct {
+	center complex128
+}
+
+func (t distanceTrap) GetOrbitFastValue(z complex128) float64 {
+	return cmplx.Abs(z - t.center)
+}
+
+func (t distanceTrap) GetOrbitValue(v float64) float64 {
+	return v
+}
+
+func (t distanceTrap) Describe() params.OrbitDescription {
+	return params.OrbitDescription{Type: "point", Args: []float64{real(t.center), imag(t.center), 1}}
+}
+
+// texturedTrap is a distance trap painted red on its right half
+type texturedTrap struct {
+	distanceTrap
+}
+
+func (t texturedTrap) GetTextureCoords(z complex128) (float64, float64) {
+	return real(z - t.center), imag(z - t.center)
+}
+
+func (t texturedTrap) GetTextureColor(u float64, v float64) (color.RGBA64, bool) {
+	return color.RGBA64{R: 0xffff, A: 0xffff}, u > 0
+}
+
+func TestTrapModes(t *testing.T) {
+	orbit := []complex128{3, 0.5, 2, 0.2 + 1i, 0.1}
+	traps := []params.Orbit{distanceTrap{}, distanceTrap{center: 10}}
+	expected := map[string]float64{
+		params.TrapMin:       0.1,
+		params.TrapFirst:     0.5,
+		params.TrapLast:      0.1,
+		params.TrapAverage:   (3 + 0.5 + 2 + cmplx.Abs(0.2+1i) + 0.1) / 5,
+		params.TrapIteration: 5,
+	}
+	for mode, value := range expected {
+		aggregator := newTrapAggregator(traps, params.Trapping{Mode: mode, Threshold: 0.6})
+		for i, z := range orbit {
+			aggregator.add(i, z)
+		}
+		if got := aggregator.value(); math.Abs(got-value) > 1e-9 {
+			t.Errorf("Trap mode %q should give %v, got %v", mode, value, got)
+		}
+	}
+
+	missed := newTrapAggregator(traps, params.Trapping{Mode: params.TrapFirst, Threshold: 0.01})
+	for i, z := range orbit {
+		missed.add(i, z)
+	}
+	if missed.value() != 0.1 {
+		t.Errorf("Orbits missing the threshold should fall back to the closest approach, got %v", missed.value())
+	}
+}
+
+func TestTrapTexture(t *testing.T) {
+	textured := newTrapAggregator([]params.Orbit{texturedTrap{}, distanceTrap{center: 1i}}, params.Trapping{Mode: params.TrapTexture})
+	textured.add(0, 0.1)
+	if c, ok := textured.texture(); !ok || c.R != 0xffff {
+		t.Errorf("Closest approach on the right of the textured trap should be red, got %v %v", c, ok)
+	}
+	textured.add(1, -0.05)
+	if _, ok := textured.texture(); ok {
+		t.Errorf("Closest approach on the left of the textured trap should not be textured")
+	}
+	textured.add(2, 0.99i)
+	if _, ok := textured.texture(); ok {
+		t.Errorf("Closest approach to the plain trap should not be textured")
+	}
+}
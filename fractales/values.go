@@ -0,0 +1,95 @@
+package fractales
+
+import (
+	"image/color"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// ValueGrid holds the values computed for one pixel every Step pixels of an image
+type ValueGrid struct {
+	Width    int
+	Height   int
+	Step     int
+	values   []float64
+	converge []bool
+	interior []float64
+}
+
+// ComputeValueGrid computes the values of one pixel every step pixels in both directions of the image
+func ComputeValueGrid(computeValue ValueComputation, params params.ImageParams, step int) ValueGrid {
+	width := (params.Width + step - 1) / step
+	height := (params.Height + step - 1) / step
+	grid := ValueGrid{
+		Width:    width,
+		Height:   height,
+		Step:     step,
+		values:   make([]float64, width*height),
+		converge: make([]bool, width*height),
+		interior: make([]float64, width*height),
+	}
+
+	parallelColumns(width, func(x int) {
+		for y := 0; y < height; y++ {
+			i := y*width + x
+			grid.values[i], grid.converge[i], grid.interior[i] = computeValue(float64(x*step)+0.5, float64(y*step)+0.5)
+		}
+	})
+
+	return grid
+}
+
+// ComputeColorGrid computes the colors of the centers of the pixels of the image, row by row
+func ComputeColorGrid(colorAt ColorComputation, params params.ImageParams) []color.RGBA64 {
+	colors := make([]color.RGBA64, params.Width*params.Height)
+	parallelColumns(params.Width, func(x int) {
+		for y := 0; y < params.Height; y++ {
+			colors[y*params.Width+x] = colorAt(float64(x)+0.5, float64(y)+0.5)
+		}
+	})
+	return colors
+}
+
+// parallelColumns calls column for the columns from 0 to width on all the CPUs
+func parallelColumns(width int, column func(x int)) {
+	var wg sync.WaitGroup
+	columns := make(chan int, width)
+	for x := 0; x < width; x++ {
+		columns <- x
+	}
+	close(columns)
+
+	for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
+		wg.Add(1)
+		go func() {
+			for x := range columns {
+				column(x)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// Lookup returns a ValueComputation reading the precomputed values of the grid
+func (g ValueGrid) Lookup() ValueComputation {
+	return func(x float64, y float64) (float64, bool, float64) {
+		i := (int(y)/g.Step)*g.Width + int(x)/g.Step
+		return g.values[i], g.converge[i], g.interior[i]
+	}
+}
+
+// EscapedValues returns the sorted values of the points of the grid that escaped
+func (g ValueGrid) EscapedValues() []float64 {
+	escaped := make([]float64, 0, len(g.values))
+	for i, v := range g.values {
+		if g.converge[i] {
+			escaped = append(escaped, v)
+		}
+	}
+	sort.Float64s(escaped)
+	return escaped
+}
@@ -0,0 +1,151 @@
+package fractales
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/Balise42/marzipango/params"
+)
+
+// epsilon keeps the variations dividing by the distance to the origin finite
+const epsilon = 1e-10
+
+// variation is a non-linear function of a fractal flame, applied to the point given by the affine transform t of the flame transform.
+// Variations with parameters take them from the coefficients of t, whose E and F are the translations.
+type variation func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64)
+
+// Variations are the variations of the fractal flames by name, following the flam3 definitions, where r is the distance to the origin,
+// theta is atan2(x, y) and phi is atan2(y, x)
+var Variations = map[string]variation{
+	"linear": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		return x, y
+	},
+	"sinusoidal": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		return math.Sin(x), math.Sin(y)
+	},
+	"spherical": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r2 := x*x + y*y + epsilon
+		return x / r2, y / r2
+	},
+	"swirl": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r2 := x*x + y*y
+		sin, cos := math.Sincos(r2)
+		return x*sin - y*cos, x*cos + y*sin
+	},
+	"horseshoe": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := math.Sqrt(x*x+y*y) + epsilon
+		return (x - y) * (x + y) / r, 2 * x * y / r
+	},
+	"polar": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		return math.Atan2(x, y) / math.Pi, math.Sqrt(x*x+y*y) - 1
+	},
+	"handkerchief": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := math.Sqrt(x*x + y*y)
+		theta := math.Atan2(x, y)
+		return r * math.Sin(theta+r), r * math.Cos(theta-r)
+	},
+	"heart": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := math.Sqrt(x*x + y*y)
+		sin, cos := math.Sincos(math.Atan2(x, y) * r)
+		return r * sin, -r * cos
+	},
+	"disc": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		sin, cos := math.Sincos(math.Pi * math.Sqrt(x*x+y*y))
+		theta := math.Atan2(x, y) / math.Pi
+		return theta * sin, theta * cos
+	},
+	"spiral": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := math.Sqrt(x*x+y*y) + epsilon
+		sinTheta, cosTheta := math.Sincos(math.Atan2(x, y))
+		sinR, cosR := math.Sincos(r)
+		return (cosTheta + sinR) / r, (sinTheta - cosR) / r
+	},
+	"hyperbolic": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := math.Sqrt(x*x+y*y) + epsilon
+		sin, cos := math.Sincos(math.Atan2(x, y))
+		return sin / r, r * cos
+	},
+	"diamond": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		sinTheta, cosTheta := math.Sincos(math.Atan2(x, y))
+		sinR, cosR := math.Sincos(math.Sqrt(x*x + y*y))
+		return sinTheta * cosR, cosTheta * sinR
+	},
+	"ex": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := math.Sqrt(x*x + y*y)
+		theta := math.Atan2(x, y)
+		p0 := math.Sin(theta + r)
+		p1 := math.Cos(theta - r)
+		p0, p1 = p0*p0*p0, p1*p1*p1
+		return r * (p0 + p1), r * (p0 - p1)
+	},
+	"julia": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := math.Sqrt(math.Sqrt(x*x + y*y))
+		angle := math.Atan2(x, y) / 2
+		if rnd.Intn(2) == 1 {
+			angle += math.Pi
+		}
+		sin, cos := math.Sincos(angle)
+		return r * cos, r * sin
+	},
+	"bent": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		if x < 0 {
+			x *= 2
+		}
+		if y < 0 {
+			y /= 2
+		}
+		return x, y
+	},
+	"waves": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		return x + t.B*math.Sin(y/(t.E*t.E+epsilon)), y + t.D*math.Sin(x/(t.F*t.F+epsilon))
+	},
+	"fisheye": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		factor := 2 / (math.Sqrt(x*x+y*y) + 1)
+		return factor * y, factor * x
+	},
+	"popcorn": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		return x + t.E*math.Sin(math.Tan(3*y)), y + t.F*math.Sin(math.Tan(3*x))
+	},
+	"exponential": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		factor := math.Exp(x - 1)
+		sin, cos := math.Sincos(math.Pi * y)
+		return factor * cos, factor * sin
+	},
+	"power": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		sin, cos := math.Sincos(math.Atan2(x, y))
+		factor := math.Pow(math.Sqrt(x*x+y*y), sin)
+		return factor * cos, factor * sin
+	},
+	"cosine": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		sin, cos := math.Sincos(math.Pi * x)
+		return cos * math.Cosh(y), -sin * math.Sinh(y)
+	},
+	"eyefish": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		factor := 2 / (math.Sqrt(x*x+y*y) + 1)
+		return factor * x, factor * y
+	},
+	"bubble": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		factor := 4 / (x*x + y*y + 4)
+		return factor * x, factor * y
+	},
+	"cylinder": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		return math.Sin(x), y
+	},
+	"tangent": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		return math.Sin(x) / (math.Cos(y) + epsilon), math.Tan(y)
+	},
+	"cross": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		factor := math.Sqrt(1 / ((x*x-y*y)*(x*x-y*y) + epsilon))
+		return factor * x, factor * y
+	},
+	"blur": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := rnd.Float64()
+		sin, cos := math.Sincos(2 * math.Pi * rnd.Float64())
+		return r * cos, r * sin
+	},
+	"noise": func(x float64, y float64, t params.AffineTransform, rnd *rand.Rand) (float64, float64) {
+		r := rnd.Float64()
+		sin, cos := math.Sincos(2 * math.Pi * rnd.Float64())
+		return r * x * cos, r * y * sin
+	},
+}
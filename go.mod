@@ -2,4 +2,7 @@ module github.com/Balise42/marzipango
 
 go 1.14
 
-require github.com/icza/mjpeg v0.0.0-20201020132628-7c1e1838a393
+require (
+	github.com/icza/mjpeg v0.0.0-20201020132628-7c1e1838a393
+	golang.org/x/image v0.0.0-20201208152932-35266b937fa6
+)
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Balise42/marzipango/formats"
+	"github.com/Balise42/marzipango/params"
+	"github.com/Balise42/marzipango/parsing"
+	"github.com/Balise42/marzipango/render"
+)
+
+// Job statuses
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobRetention is how long finished jobs and their images are kept
+const jobRetention = time.Hour
+
+// maxRunningJobs is the number of jobs which may run at the same time
+const maxRunningJobs = 4
+
+// maxJobs is the number of jobs kept, the oldest finished ones being removed beyond it
+const maxJobs = 32
+
+// errTooManyJobs is returned when starting a job while too many are running
+var errTooManyJobs = errors.New("too many jobs are running, try again later")
+
+// job is a render running in the background
+type job struct {
+	id          string
+	imageParams params.ImageParams
+	cancel      context.CancelFunc
+	start       time.Time
+
+	mu       sync.Mutex
+	status   string
+	done     int
+	total    int
+	finished time.Time
+	err      error
+	img      image.Image
+}
+
+// jobStatus is the JSON description of a job
+type jobStatus struct {
+	ID      string  `json:"id"`
+	Status  string  `json:"status"`
+	Percent float64 `json:"percent"`
+	ETA     float64 `json:"eta,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*job)
+)
+
+func newJobID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// startJob starts rendering the image in the background and registers the job
+func startJob(imageParams params.ImageParams) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	jobsMu.Lock()
+	sweepJobs()
+	var running int
+	var oldest *job
+	var oldestFinished time.Time
+	for _, old := range jobs {
+		finished, ok := old.finishedAt()
+		if !ok {
+			running++
+		} else if oldest == nil || finished.Before(oldestFinished) {
+			oldest, oldestFinished = old, finished
+		}
+	}
+	if running >= maxRunningJobs {
+		jobsMu.Unlock()
+		return nil, errTooManyJobs
+	}
+	if len(jobs) >= maxJobs && oldest != nil {
+		delete(jobs, oldest.id)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{id: id, imageParams: imageParams, cancel: cancel, start: time.Now(), status: jobRunning}
+	jobs[j.id] = j
+	jobsMu.Unlock()
+
+	go j.run(ctx)
+	return j, nil
+}
+
+func (j *job) run(ctx context.Context) {
+	img, err := render.Render(ctx, j.imageParams, render.WithProgress(j.progress))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	switch {
+	case err == context.Canceled:
+		j.status = jobCancelled
+	case err != nil:
+		j.status = jobFailed
+		j.err = err
+	default:
+		j.status = jobDone
+		j.img = img
+	}
+	j.cancel()
+}
+
+func (j *job) progress(done int, total int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if done > j.done || total != j.total {
+		j.done = done
+	}
+	j.total = total
+}
+
+// finishedAt returns when the job finished, and whether it did
+func (j *job) finishedAt() (time.Time, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished, j.status != jobRunning
+}
+
+func (j *job) expired() bool {
+	finished, ok := j.finishedAt()
+	return ok && time.Since(finished) > jobRetention
+}
+
+// sweepJobs removes the expired jobs. jobsMu must be held.
+func sweepJobs() {
+	for id, old := range jobs {
+		if old.expired() {
+			delete(jobs, id)
+		}
+	}
+}
+
+// describe returns the status of the job, estimating the remaining time from the progress so far
+func (j *job) describe() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := jobStatus{ID: j.id, Status: j.status}
+	if j.err != nil {
+		status.Error = j.err.Error()
+	}
+	if j.status == jobDone {
+		status.Percent = 100
+	} else if j.total > 0 {
+		status.Percent = 100 * float64(j.done) / float64(j.total)
+	}
+	if j.status == jobRunning && j.done > 0 {
+		elapsed := time.Since(j.start).Seconds()
+		status.ETA = elapsed * float64(j.total-j.done) / float64(j.done)
+	}
+	return status
+}
+
+func lookupJob(id string) (*job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	sweepJobs()
+	j, ok := jobs[id]
+	return j, ok
+}
+
+func writeJobStatus(w http.ResponseWriter, code int, j *job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(j.describe())
+}
+
+// createJob starts a job from a JSON render document if one is posted, from the query parameters otherwise
+func createJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "a job must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var imageParams params.ImageParams
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var document []byte
+		document, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxDocumentSize))
+		if err == nil {
+			imageParams, err = parsing.ParseRenderDocument(document)
+		}
+	} else {
+		// jobs are posted, so that they may upload the images of their data URI traps
+		var values url.Values
+		values, err = parsing.StoreTraps(r.URL.Query())
+		if err == nil {
+			imageParams, err = parseValues(values)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := startJob(imageParams)
+	if err == errTooManyJobs {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeJobStatus(w, http.StatusAccepted, j)
+}
+
+// jobHandler serves the status of a job on GET, its image on GET .../result, and cancels it on DELETE
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	id := strings.TrimSuffix(path, "/result")
+	j, ok := lookupJob(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if id != path {
+		if r.Method != http.MethodGet {
+			http.Error(w, "the result of a job can only be fetched", http.StatusMethodNotAllowed)
+			return
+		}
+		jobResult(w, r, j)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJobStatus(w, http.StatusOK, j)
+	case http.MethodDelete:
+		j.cancel()
+		writeJobStatus(w, http.StatusOK, j)
+	default:
+		http.Error(w, "jobs can only be fetched or cancelled", http.StatusMethodNotAllowed)
+	}
+}
+
+func jobResult(w http.ResponseWriter, r *http.Request, j *job) {
+	j.mu.Lock()
+	status, img := j.status, j.img
+	j.mu.Unlock()
+	if status != jobDone {
+		http.Error(w, "job is "+status, http.StatusConflict)
+		return
+	}
+
+	outputParams, err := parseOutputParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", formats.ContentType(outputParams.Format))
+	w.Header().Add("Vary", "Accept")
+
+	metadata := ""
+	if outputParams.Metadata {
+		metadata = j.imageParams.Describe().Values().Encode()
+	}
+	err = formats.Encode(w, img, outputParams, metadata)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
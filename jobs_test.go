@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postJob creates a job from the query and returns its status
+func postJob(t *testing.T, query string) jobStatus {
+	recorder := httptest.NewRecorder()
+	createJob(recorder, httptest.NewRequest(http.MethodPost, "/jobs?"+query, nil))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Job creation should be accepted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var status jobStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if location := recorder.Header().Get("Location"); location != "/jobs/"+status.ID {
+		t.Errorf("Location should be /jobs/%s, got %s", status.ID, location)
+	}
+	return status
+}
+
+// callJob sends a request to the job handler and returns the response
+func callJob(method string, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	jobHandler(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+// waitJob polls the job until it is not running anymore and returns its status
+func waitJob(t *testing.T, id string) jobStatus {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		var status jobStatus
+		if err := json.NewDecoder(callJob(http.MethodGet, "/jobs/"+id).Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != jobRunning {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s should finish", id)
+	return jobStatus{}
+}
+
+func TestJobResult(t *testing.T) {
+	created := postJob(t, "type=julia&width=30&height=20&maxiter=50")
+	if created.Status != jobRunning && created.Status != jobDone {
+		t.Errorf("New job should be running, got %s", created.Status)
+	}
+
+	if status := waitJob(t, created.ID); status.Status != jobDone || status.Percent != 100 {
+		t.Fatalf("Job should be done, got %+v", status)
+	}
+
+	recorder := callJob(http.MethodGet, "/jobs/"+created.ID+"/result")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Result should be a PNG image, got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(recorder.Body)
+	if err != nil {
+		t.Fatalf("Result should decode: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 30 || bounds.Dy() != 20 {
+		t.Errorf("Result should be 30x20, got %v", bounds)
+	}
+
+	if recorder := callJob(http.MethodPost, "/jobs/"+created.ID+"/result"); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Posting to the result should not be allowed, got %d", recorder.Code)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	created := postJob(t, "type=fern&width=200&height=200")
+
+	recorder := callJob(http.MethodDelete, "/jobs/"+created.ID)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Cancelling should succeed, got %d", recorder.Code)
+	}
+	if status := waitJob(t, created.ID); status.Status != jobCancelled {
+		t.Fatalf("Job should be cancelled, got %+v", status)
+	}
+
+	recorder = callJob(http.MethodGet, "/jobs/"+created.ID+"/result")
+	if recorder.Code != http.StatusConflict || !strings.Contains(recorder.Body.String(), jobCancelled) {
+		t.Errorf("Result of a cancelled job should be a conflict, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestUnknownJob(t *testing.T) {
+	for _, path := range []string{"/jobs/unknown", "/jobs/unknown/result", "/jobs/"} {
+		if recorder := callJob(http.MethodGet, path); recorder.Code != http.StatusNotFound {
+			t.Errorf("%s should not be found, got %d", path, recorder.Code)
+		}
+	}
+	if recorder := callJob(http.MethodDelete, "/jobs/unknown"); recorder.Code != http.StatusNotFound {
+		t.Errorf("Cancelling an unknown job should not be found, got %d", recorder.Code)
+	}
+
+	recorder := httptest.NewRecorder()
+	createJob(recorder, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Jobs should only be created by posting, got %d", recorder.Code)
+	}
+}
+
+func TestJobProgress(t *testing.T) {
+	j := &job{id: "progress", start: time.Now().Add(-10 * time.Second), status: jobRunning}
+	j.progress(30, 120)
+	j.progress(20, 120)
+
+	status := j.describe()
+	if status.Percent != 25 {
+		t.Errorf("Job should be 25%% done, got %v", status.Percent)
+	}
+	if status.ETA < 29 || status.ETA > 31 {
+		t.Errorf("Job should end in about 30 seconds, got %v", status.ETA)
+	}
+}
+
+func TestJobLimits(t *testing.T) {
+	jobsMu.Lock()
+	saved := jobs
+	jobs = make(map[string]*job)
+	for i := 0; i < maxRunningJobs; i++ {
+		id := "running" + strconv.Itoa(i)
+		jobs[id] = &job{id: id, cancel: func() {}, status: jobRunning}
+	}
+	jobsMu.Unlock()
+	defer func() {
+		jobsMu.Lock()
+		jobs = saved
+		jobsMu.Unlock()
+	}()
+
+	recorder := httptest.NewRecorder()
+	createJob(recorder, httptest.NewRequest(http.MethodPost, "/jobs?width=30&height=20", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Jobs should be refused while too many are running, got %d", recorder.Code)
+	}
+
+	jobsMu.Lock()
+	jobs = make(map[string]*job)
+	for i := 0; i < maxJobs; i++ {
+		id := "finished" + strconv.Itoa(i)
+		jobs[id] = &job{id: id, cancel: func() {}, status: jobDone, finished: time.Now().Add(time.Duration(i) * time.Second)}
+	}
+	jobs["expired"] = &job{id: "expired", cancel: func() {}, status: jobDone, finished: time.Now().Add(-2 * jobRetention)}
+	jobsMu.Unlock()
+
+	if _, ok := lookupJob("expired"); ok {
+		t.Errorf("Expired jobs should be removed")
+	}
+	created := postJob(t, "width=30&height=20&maxiter=20")
+	waitJob(t, created.ID)
+	if _, ok := lookupJob("finished0"); ok {
+		t.Errorf("The oldest finished job should be removed once too many jobs are kept")
+	}
+	if _, ok := lookupJob("finished1"); !ok {
+		t.Errorf("Only the oldest finished job should be removed")
+	}
+}
+
+func TestJobDocument(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/jobs?type=ifs&ifs=unknown", strings.NewReader(`{"width": 30, "height": 20, "maxiter": 20}`))
+	request.Header.Set("Content-Type", "application/json")
+	createJob(recorder, request)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Query parameters should be ignored when a document is posted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var status jobStatus
+	json.NewDecoder(recorder.Body).Decode(&status)
+	waitJob(t, status.ID)
+}
@@ -1,138 +1,393 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
 	"io"
+	"io/ioutil"
 	"log"
-	"math"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/signal"
-	"runtime"
 	"runtime/pprof"
-	"sync"
+	"strings"
 	"time"
 
+	"github.com/Balise42/marzipango/formats"
 	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/fractales/orbits"
 	"github.com/Balise42/marzipango/params"
 	"github.com/Balise42/marzipango/parsing"
-	"github.com/icza/mjpeg"
+	"github.com/Balise42/marzipango/render"
 )
 
 var (
 	port       = flag.Int("port", 8080, "Webserver port to listen on.")
 	hostname   = flag.String("hostname", "localhost", "Host to listen on.")
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	trapStore  = flag.String("trapstore", orbits.Traps.Dir, "directory of the uploaded trap images")
+	traps      = flag.String("traps", orbits.Traps.Bundled, "directory of the bundled trap images")
+	presets    = flag.String("presets", fractales.IFSPresets, "directory of the IFS presets")
 )
 
-func generateImage(params params.ImageParams, comp fractales.Computation) image.Image {
-	var wg sync.WaitGroup
-	img := image.NewRGBA64(image.Rect(0, 0, params.Width, params.Height))
-	for x := 0; x < params.Width; x++ {
-		var numRows = params.Height / runtime.NumCPU()
-		for cpu := 0; cpu < runtime.NumCPU()-1; cpu++ {
-			wg.Add(1)
-			go comp(x, numRows*cpu, numRows*(cpu+1), img, &wg)
-		}
-		wg.Add(1)
-		go comp(x, numRows*(runtime.NumCPU()-1), params.Height, img, &wg)
+func parseImageParams(r *http.Request) (params.ImageParams, error) {
+	return parseValues(r.URL.Query())
+}
+
+// parseValues parses the query parameters, unless they refer to IFS presets or trap images which cannot be loaded
+func parseValues(values url.Values) (params.ImageParams, error) {
+	if err := parsing.CheckValues(values); err != nil {
+		return params.ImageParams{}, err
 	}
-	wg.Wait()
+	return parsing.ParseValues(values), nil
+}
 
-	return img
+func parseOutputParams(r *http.Request) (params.OutputParams, error) {
+	values, accept := r.URL.Query(), r.Header.Get("Accept")
+	if err := parsing.CheckOutputValues(values, accept); err != nil {
+		return params.OutputParams{}, err
+	}
+	return parsing.ParseOutputValues(values, accept), nil
 }
 
-func generateVideo(w io.Writer, imageParams params.ImageParams) error {
-	aw, err := mjpeg.New("test.avi", int32(imageParams.Width), int32(imageParams.Height), 25)
+// maxDocumentSize is the maximum size of the JSON render documents
+const maxDocumentSize = 1 << 20
 
+// maxTrapSize is the maximum size of the uploaded trap images
+const maxTrapSize = 16 << 20
+
+// maxRerenderSize is the maximum size of the uploaded images to re-render
+const maxRerenderSize = 64 << 20
+
+// maxRerenderPixels is the maximum number of pixels of re-rendered images
+const maxRerenderPixels = 8192 * 8192
+
+func serveImage(w http.ResponseWriter, r *http.Request, imageParams params.ImageParams, outputParams params.OutputParams) error {
+	img, err := render.Render(r.Context(), imageParams)
 	if err != nil {
 		return err
 	}
 
-	left := imageParams.Left
-	right := imageParams.Right
-	top := imageParams.Top
-	bottom := imageParams.Bottom
+	w.Header().Set("Content-Type", formats.ContentType(outputParams.Format))
+	w.Header().Add("Vary", "Accept")
 
-	deltaX := math.Abs(left - right)
-	deltaY := math.Abs(top - bottom)
+	metadata := ""
+	if outputParams.Metadata {
+		metadata = imageParams.Describe().Values().Encode()
+	}
+	return formats.Encode(w, img, outputParams, metadata)
+}
 
-	for i := 0; i < 200; i++ {
+func fractale(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	imageParams, err := parseImageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputParams, err := parseOutputParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = serveImage(w, r, imageParams, outputParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Print("Image served", imageParams)
+	fmt.Printf("in %s\n", time.Since(start))
+}
+
+func renderDocument(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		http.Error(w, "a JSON render document must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	document, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxDocumentSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imageParams, err := parsing.ParseRenderDocument(document)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputParams, err := parseOutputParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		left = imageParams.Left
-		right = imageParams.Right
-		top = imageParams.Top
-		bottom = imageParams.Bottom
-		deltaX = math.Abs(left - right)
-		deltaY = math.Abs(top - bottom)
+	err = serveImage(w, r, imageParams, outputParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Print("Image rendered", imageParams)
+	fmt.Printf("in %s\n", time.Since(start))
+}
 
-		imageParams.Left = left + 1.0/2*deltaX/20
-		imageParams.Right = right - 1.0/2*deltaX/20
-		imageParams.Top = top + 1.0/2*deltaY/20
-		imageParams.Bottom = bottom - 1.0/2*deltaY/20
-		comp := parsing.ComputerFromParameters(imageParams)
-		img := generateImage(imageParams, comp)
+// flame renders a posted flam3 XML file, or exports the flame of the query parameters to flam3 XML
+func flame(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	switch r.Method {
+	case http.MethodGet:
+		imageParams, err := parseImageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		document, err := parsing.EncodeFlam3(imageParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(document)
+	case http.MethodPost:
+		document, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxDocumentSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		imageParams, err := parsing.ParseFlam3(document)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		outputParams, err := parseOutputParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		buf := &bytes.Buffer{}
-		err = jpeg.Encode(buf, img, nil)
+		err = serveImage(w, r, imageParams, outputParams)
 		if err != nil {
-			return err
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		fmt.Print("Flame rendered", imageParams)
+		fmt.Printf("in %s\n", time.Since(start))
+	default:
+		http.Error(w, "a flam3 file must be posted", http.StatusMethodNotAllowed)
+	}
+}
 
-		err = aw.AddFrame(buf.Bytes())
+func progressive(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	imageParams, err := parseImageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputParams, err := parseOutputParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+
+	err = render.Progressive(r.Context(), imageParams, func(img image.Image, pass int, passes int) error {
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {formats.ContentType(outputParams.Format)}})
+		if err != nil {
+			return err
+		}
+		err = formats.Encode(part, img, outputParams, "")
 		if err != nil {
 			return err
 		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Progressive image interrupted:", err)
+		return
 	}
+	mw.Close()
+
+	fmt.Print("Progressive image served", imageParams)
+	fmt.Printf("in %s\n", time.Since(start))
+}
+
+func renderSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	io.WriteString(w, parsing.RenderSchema)
+}
 
-	err = aw.Close()
+func describe(w http.ResponseWriter, r *http.Request) {
+	imageParams, err := parseImageParams(r)
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(imageParams.Describe())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-func fractale(w http.ResponseWriter, r *http.Request) {
+func rerender(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	imageParams := parsing.ParseImageParams(r)
-	comp := parsing.ComputerFromParameters(imageParams)
+	if r.Method != http.MethodPost {
+		http.Error(w, "an image must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRerenderSize)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	metadata, err := formats.ReadPNGMetadata(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values, err := url.ParseQuery(metadata)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imageParams, err := parseValues(parsing.ResizeValues(values, r.URL.Query()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if imageParams.Width <= 0 || imageParams.Height <= 0 || imageParams.Width > maxRerenderPixels/imageParams.Height {
+		http.Error(w, fmt.Sprintf("re-rendered images must have at most %d pixels, not %dx%d", maxRerenderPixels, imageParams.Width, imageParams.Height), http.StatusBadRequest)
+		return
+	}
+	outputParams, err := parseOutputParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputParams.Metadata = true
 
-	w.Header().Set("Content-Type", "image/png")
-	img := generateImage(imageParams, comp)
-	err := png.Encode(w, img)
+	err = serveImage(w, r, imageParams, outputParams)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Print("Image served", imageParams)
+	fmt.Print("Image rerendered", imageParams)
 	fmt.Printf("in %s\n", time.Since(start))
 }
 
+// uploadTrap stores a posted PNG, JPEG or GIF image in the trap store and returns its name and the raster trap using it
+func uploadTrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "a trap image must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxTrapSize)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, err := orbits.Traps.Put(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Name  string `json:"name"`
+		Orbit string `json:"orbit"`
+	}{name, "raster(" + name + ")"})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("Trap image stored", name)
+}
+
 func video(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	imageParams := parsing.ParseImageParams(r)
+	imageParams, err := parseImageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	w.Header().Set("Content-Type", "image/png")
-	err := generateVideo(w, imageParams)
+	file, err := ioutil.TempFile("", "marzipango-*.avi")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	err = render.Video(r.Context(), file.Name(), imageParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/x-msvideo")
+	http.ServeFile(w, r, file.Name())
 
 	fmt.Print("Video served", imageParams)
 	fmt.Printf("in %s\n", time.Since(start))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(runRender(os.Args[2:], os.Stderr))
+	}
+
 	flag.Parse()
+	orbits.Traps = orbits.Store{Dir: *trapStore, Bundled: *traps}
+	fractales.IFSPresets = *presets
 	http.HandleFunc("/", fractale)
 	http.HandleFunc("/video/", video)
+	http.HandleFunc("/describe", describe)
+	http.HandleFunc("/rerender", rerender)
+	http.HandleFunc("/render", renderDocument)
+	http.HandleFunc("/render/schema.json", renderSchema)
+	http.HandleFunc("/progressive", progressive)
+	http.HandleFunc("/flame", flame)
+	http.HandleFunc("/traps", uploadTrap)
+	http.HandleFunc("/jobs", createJob)
+	http.HandleFunc("/jobs/", jobHandler)
 	address := fmt.Sprintf("%s:%d", *hostname, *port)
 	fmt.Printf("Listening on http://%s ...\n", address)
 
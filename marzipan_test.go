@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRerender(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	fractale(recorder, httptest.NewRequest(http.MethodGet, "/?width=30&height=20&maxiter=20&format=png&metadata=true", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Render failed: %d %s", recorder.Code, recorder.Body)
+	}
+	original := recorder.Body.Bytes()
+
+	recorder = httptest.NewRecorder()
+	rerender(recorder, httptest.NewRequest(http.MethodPost, "/rerender?width=60", bytes.NewReader(original)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Re-render failed: %d %s", recorder.Code, recorder.Body)
+	}
+	img, err := png.Decode(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 60 || size.Y != 40 {
+		t.Errorf("Re-rendered image should be 60x40, got %v", size)
+	}
+
+	recorder = httptest.NewRecorder()
+	rerender(recorder, httptest.NewRequest(http.MethodPost, "/rerender?width=100000&height=100000", bytes.NewReader(original)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Re-rendering huge images should be rejected, got %d", recorder.Code)
+	}
+}
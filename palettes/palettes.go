@@ -1,9 +1,12 @@
 package palettes
 
 import (
-	"image"
+	"fmt"
 	"image/color"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var Blue = color.RGBA{0, 0, 255, 255}
@@ -50,23 +53,82 @@ var ColorNames = map[string]color.Color{
 	"softpink":      SoftPink,
 }
 
+// ColorName returns the name of the color if it has one, or its hexadecimal #rrggbbaa form
+func ColorName(c color.Color) string {
+	r, g, b, a := c.RGBA()
+	for name, named := range ColorNames {
+		nr, ng, nb, na := named.RGBA()
+		if r == nr && g == ng && b == nb && a == na {
+			return name
+		}
+	}
+	nrgba := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x%02x", nrgba.R, nrgba.G, nrgba.B, nrgba.A)
+}
+
+// ParseColor returns the color from its name or its hexadecimal #rrggbb or #rrggbbaa form
+func ParseColor(name string) (color.Color, bool) {
+	if c, ok := ColorNames[name]; ok {
+		return c, true
+	}
+	if !strings.HasPrefix(name, "#") || (len(name) != 7 && len(name) != 9) {
+		return nil, false
+	}
+	if len(name) == 7 {
+		name += "ff"
+	}
+	v, err := strconv.ParseUint(name[1:], 16, 32)
+	if err != nil {
+		return nil, false
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, true
+}
+
+// Interior coloring methods for points that never escape
+const (
+	InteriorNone       = ""
+	InteriorModulus    = "modulus"
+	InteriorPeriod     = "period"
+	InteriorMultiplier = "multiplier"
+	InteriorOrbit      = "orbit"
+)
+
+// Coloring modes mapping the values of the escaped points on the palette
+const (
+	ColoringContinuous = ""
+	ColoringHistogram  = "histogram"
+)
+
+// AutoSize is the palette size asking for the size to be picked from the range of computed values
+const AutoSize = 0
+
 // Colors used for the palette
 type Colors struct {
-	Divergence color.Color
-	ListColors []color.Color
-	MaxValue   int
+	Divergence     color.Color
+	ListColors     []color.Color
+	MaxValue       int
+	Interior       string
+	InteriorColors []color.Color
+	Coloring       string
+	Histogram      []float64
 }
 
-type ColoringFunction func(img *image.RGBA64, x int, y int, value float64, converge bool)
+// ColoringFunction returns the color of a point from its value, whether it escaped and its interior value
+type ColoringFunction func(value float64, converge bool, interior float64) color.RGBA64
 
 // ColorFromContinuousPalette returns the color corresponding to the value from 0 to 1 (0 is the first color of the palette, 1 is the last color of the palette)
-func ColorFromContinuousPalette(rawValue float64, converge bool, palette Colors) color.Color {
+func ColorFromContinuousPalette(rawValue float64, converge bool, palette Colors) color.RGBA64 {
 	if !converge {
-		return palette.Divergence
+		return toRGBA64(palette.Divergence)
 	}
 
 	if len(palette.ListColors) == 1 {
-		return palette.ListColors[0]
+		return toRGBA64(palette.ListColors[0])
+	}
+
+	if len(palette.Histogram) > 0 {
+		rank := sort.SearchFloat64s(palette.Histogram, rawValue)
+		return ColorFromGradient(float64(rank)/float64(len(palette.Histogram)), palette.ListColors)
 	}
 
 	value := math.Mod(rawValue, float64(palette.MaxValue))
@@ -74,22 +136,84 @@ func ColorFromContinuousPalette(rawValue float64, converge bool, palette Colors)
 	normalized := value / float64(palette.MaxValue)
 	normalized = (math.Pow(normalized-0.5, 3) + 0.125) / 0.250
 
-	colorIndex := (int(float64((len(palette.ListColors) - 1)) * normalized)) % (len(palette.ListColors) - 1)
-	normalizedColor := float64((len(palette.ListColors)-1))*normalized - float64(colorIndex)
+	return ColorFromGradient(normalized, palette.ListColors)
+}
+
+// AutoMaxValue returns a palette size making the palette span most of the sorted values once
+func AutoMaxValue(values []float64) int {
+	if len(values) == 0 {
+		return 1
+	}
+	return int(math.Max(1, math.Ceil(values[len(values)*95/100])))
+}
+
+// ColorFromInterior returns the color of a point that never escaped according to the interior coloring method of the palette
+func ColorFromInterior(value float64, palette Colors) color.RGBA64 {
+	colors := palette.InteriorColors
+	if len(colors) == 0 {
+		colors = palette.ListColors
+	}
+
+	switch palette.Interior {
+	case InteriorPeriod:
+		if value < 1 {
+			return toRGBA64(palette.Divergence)
+		}
+		return toRGBA64(colors[(int(value)-1)%len(colors)])
+	case InteriorModulus:
+		return ColorFromGradient(value/2, colors)
+	case InteriorMultiplier:
+		return ColorFromGradient(value, colors)
+	case InteriorOrbit:
+		return ColorFromGradient(math.Mod(value, float64(palette.MaxValue))/float64(palette.MaxValue), colors)
+	}
+	return toRGBA64(palette.Divergence)
+}
+
+// ColorFromGradient returns the color at position t from 0 to 1 on the gradient going through all the colors
+func ColorFromGradient(t float64, colors []color.Color) color.RGBA64 {
+	if len(colors) == 1 {
+		return toRGBA64(colors[0])
+	}
 
-	c1r, c1g, c1b, _ := palette.ListColors[colorIndex].RGBA()
-	c2r, c2g, c2b, _ := palette.ListColors[colorIndex+1].RGBA()
+	t = math.Max(0, math.Min(t, 1))
 
-	var r, g, b int16
-	r = int16(float64(c2r)*normalizedColor + float64(c1r)*(1-normalizedColor))
-	g = int16(float64(c2g)*normalizedColor + float64(c1g)*(1-normalizedColor))
-	b = int16(float64(c2b)*normalizedColor + float64(c1b)*(1-normalizedColor))
+	position := float64(len(colors)-1) * t
+	colorIndex := int(position)
+	if colorIndex > len(colors)-2 {
+		colorIndex = len(colors) - 2
+	}
+
+	return Interpolate(colors[colorIndex], colors[colorIndex+1], position-float64(colorIndex))
+}
+
+// Interpolate returns the color at position t from 0 to 1 between c1 and c2, alpha included
+func Interpolate(c1 color.Color, c2 color.Color, t float64) color.RGBA64 {
+	c1r, c1g, c1b, c1a := c1.RGBA()
+	c2r, c2g, c2b, c2a := c2.RGBA()
+
+	return color.RGBA64{
+		R: interpolateChannel(c1r, c2r, t),
+		G: interpolateChannel(c1g, c2g, t),
+		B: interpolateChannel(c1b, c2b, t),
+		A: interpolateChannel(c1a, c2a, t),
+	}
+}
+
+func interpolateChannel(c1 uint32, c2 uint32, t float64) uint16 {
+	return uint16(math.Round(float64(c2)*t + float64(c1)*(1-t)))
+}
 
-	return color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff}
+func toRGBA64(c color.Color) color.RGBA64 {
+	return color.RGBA64Model.Convert(c).(color.RGBA64)
 }
 
+// ContinuousColoring returns a ColoringFunction mapping the values on the palette
 func ContinuousColoring(palette Colors) ColoringFunction {
-	return func(img *image.RGBA64, x int, y int, value float64, converge bool) {
-		img.Set(x, y, ColorFromContinuousPalette(value, converge, palette))
+	return func(value float64, converge bool, interior float64) color.RGBA64 {
+		if !converge && palette.Interior != InteriorNone {
+			return ColorFromInterior(interior, palette)
+		}
+		return ColorFromContinuousPalette(value, converge, palette)
 	}
 }
@@ -0,0 +1,30 @@
+package palettes
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestInterpolateBrightChannels(t *testing.T) {
+	c := Interpolate(White, Yellow, 0.5)
+	if c.R != 0xffff || c.G != 0xffff || c.B != 0x8000 || c.A != 0xffff {
+		t.Errorf("Interpolation between white and yellow is dubious, got %v", c)
+	}
+}
+
+func TestInterpolateAlpha(t *testing.T) {
+	c := Interpolate(color.Transparent, color.White, 0.25)
+	if c.A != 0x4000 || c.R != 0x4000 {
+		t.Errorf("Interpolation of alpha is dubious, wanted 0x4000, got %v", c)
+	}
+}
+
+func TestGradientEnds(t *testing.T) {
+	colors := []color.Color{Black, Red, White}
+	if c := ColorFromGradient(0, colors); c != toRGBA64(Black) {
+		t.Errorf("Gradient start should be black, got %v", c)
+	}
+	if c := ColorFromGradient(1, colors); c != toRGBA64(White) {
+		t.Errorf("Gradient end should be white, got %v", c)
+	}
+}
@@ -0,0 +1,262 @@
+package params
+
+import (
+	"fmt"
+	"image/color"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Balise42/marzipango/palettes"
+)
+
+// Description is the canonical serializable form of ImageParams, from which the same image can be rendered again
+type Description struct {
+	Left       float64            `json:"left"`
+	Right      float64            `json:"right"`
+	Top        float64            `json:"top"`
+	Bottom     float64            `json:"bottom"`
+	Width      int                `json:"width"`
+	Height     int                `json:"height"`
+	MaxIter    int                `json:"maxiter"`
+	Palette    PaletteDescription `json:"palette"`
+	Power      float64            `json:"power"`
+	Type       string             `json:"type"`
+	AA         Antialiasing       `json:"aa"`
+	Orbits     []OrbitDescription `json:"orbits,omitempty"`
+	IFS        *IFS               `json:"ifs,omitempty"`
+	Flame      *Flame             `json:"flame,omitempty"`
+	Seed       int64              `json:"seed,omitempty"`
+	Samples    int                `json:"spp,omitempty"`
+	Budget     string             `json:"budget,omitempty"`
+	Accumulate bool               `json:"accumulate,omitempty"`
+	TrapWindow *Window            `json:"trapwindow,omitempty"`
+	Trap       *Trapping          `json:"trap,omitempty"`
+}
+
+// PaletteDescription describes a palette with color names or hexadecimal colors; a size of 0 means an automatic size
+type PaletteDescription struct {
+	Divergence     string   `json:"divergence"`
+	Colors         []string `json:"colors"`
+	Size           int      `json:"size"`
+	Coloring       string   `json:"coloring,omitempty"`
+	Interior       string   `json:"interior,omitempty"`
+	InteriorColors []string `json:"interiorcolors,omitempty"`
+}
+
+// OrbitDescription describes an orbit trap by its type, the name of its image for raster traps, the data of its SVG path for path traps,
+// the shapes combined by combinator traps, its numeric arguments and whether they are coordinates of the complex plane or fractions of the trap window
+type OrbitDescription struct {
+	Type   string             `json:"type"`
+	Name   string             `json:"name,omitempty"`
+	Path   string             `json:"path,omitempty"`
+	Orbits []OrbitDescription `json:"orbits,omitempty"`
+	Args   []float64          `json:"args,omitempty"`
+	Coords string             `json:"coords,omitempty"`
+}
+
+// String returns the orbit in the syntax of the orbit query parameter, type(name or path, shapes, args) or type(...)@coords
+func (o OrbitDescription) String() string {
+	args := make([]string, 0, len(o.Orbits)+len(o.Args)+1)
+	if o.Name != "" {
+		args = append(args, o.Name)
+	}
+	if o.Path != "" {
+		args = append(args, o.Path)
+	}
+	for _, orbit := range o.Orbits {
+		args = append(args, orbit.String())
+	}
+	for _, arg := range o.Args {
+		args = append(args, formatFloat(arg))
+	}
+	if o.Coords != "" {
+		return fmt.Sprintf("%s(%s)@%s", o.Type, strings.Join(args, ","), o.Coords)
+	}
+	return fmt.Sprintf("%s(%s)", o.Type, strings.Join(args, ","))
+}
+
+// String returns the affine transform as a,b,c,d,e,f
+func (t AffineTransform) String() string {
+	return strings.Join([]string{formatFloat(t.A), formatFloat(t.B), formatFloat(t.C), formatFloat(t.D), formatFloat(t.E), formatFloat(t.F)}, ",")
+}
+
+// String returns the flame transform in the syntax of the xform query parameter: weight|color|a,b,c,d,e,f|name:weight,...[|post a,b,c,d,e,f]
+func (t FlameTransform) String() string {
+	names := make([]string, 0, len(t.Variations))
+	for name := range t.Variations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	variations := make([]string, len(names))
+	for i, name := range names {
+		variations[i] = name + ":" + formatFloat(t.Variations[name])
+	}
+
+	fields := []string{formatFloat(t.Weight), formatFloat(t.Color), t.Affine.String(), strings.Join(variations, ",")}
+	if t.Post != nil {
+		fields = append(fields, t.Post.String())
+	}
+	return strings.Join(fields, "|")
+}
+
+// Describe returns the canonical description of the image parameters
+func (p ImageParams) Describe() Description {
+	palette := PaletteDescription{
+		Divergence:     palettes.ColorName(p.Palette.Divergence),
+		Colors:         colorNames(p.Palette.ListColors),
+		Size:           p.Palette.MaxValue,
+		Coloring:       p.Palette.Coloring,
+		Interior:       p.Palette.Interior,
+		InteriorColors: colorNames(p.Palette.InteriorColors),
+	}
+
+	var orbits []OrbitDescription
+	for _, orbit := range p.Orbits {
+		orbits = append(orbits, orbit.Describe())
+	}
+
+	var ifs *IFS
+	if p.Type == "ifs" {
+		ifs = &p.IFS
+	}
+
+	var flame *Flame
+	if p.Type == "flame" {
+		flame = &p.Flame
+	}
+
+	// Traps keep the window of the image they were created for, which differs from the viewport of its tiles and strips
+	var trapWindow *Window
+	if len(orbits) > 0 && p.TrapWindow != p.Viewport() {
+		trapWindow = &p.TrapWindow
+	}
+
+	var trap *Trapping
+	if len(orbits) > 0 && p.Trap.Mode != TrapMin {
+		trap = &Trapping{Mode: p.Trap.Mode}
+		if p.Trap.Mode == TrapFirst || p.Trap.Mode == TrapLast {
+			trap.Threshold = p.Trap.Threshold
+		}
+	}
+
+	budget := ""
+	if p.Budget > 0 {
+		budget = p.Budget.String()
+	}
+
+	return Description{
+		Left:       p.Left,
+		Right:      p.Right,
+		Top:        p.Top,
+		Bottom:     p.Bottom,
+		Width:      p.Width,
+		Height:     p.Height,
+		MaxIter:    p.MaxIter,
+		Palette:    palette,
+		Power:      p.Power,
+		Type:       p.Type,
+		AA:         p.AA,
+		Orbits:     orbits,
+		IFS:        ifs,
+		Flame:      flame,
+		Seed:       p.Seed,
+		Samples:    p.Samples,
+		Budget:     budget,
+		Accumulate: p.Accumulate,
+		TrapWindow: trapWindow,
+		Trap:       trap,
+	}
+}
+
+// Values returns the description as query parameters
+func (d Description) Values() url.Values {
+	values := url.Values{}
+	values.Set("left", formatFloat(d.Left))
+	values.Set("right", formatFloat(d.Right))
+	values.Set("top", formatFloat(d.Top))
+	values.Set("bottom", formatFloat(d.Bottom))
+	values.Set("width", strconv.Itoa(d.Width))
+	values.Set("height", strconv.Itoa(d.Height))
+	values.Set("maxiter", strconv.Itoa(d.MaxIter))
+	values.Set("palette", strings.Join(append([]string{d.Palette.Divergence}, d.Palette.Colors...), ","))
+	if d.Palette.Size == palettes.AutoSize {
+		values.Set("palettesize", "auto")
+	} else {
+		values.Set("palettesize", strconv.Itoa(d.Palette.Size))
+	}
+	if d.Palette.Coloring != "" {
+		values.Set("coloring", d.Palette.Coloring)
+	}
+	if d.Palette.Interior != "" {
+		values.Set("interior", d.Palette.Interior)
+	}
+	if len(d.Palette.InteriorColors) > 0 {
+		values.Set("interiorpalette", strings.Join(d.Palette.InteriorColors, ","))
+	}
+	values.Set("power", formatFloat(d.Power))
+	values.Set("type", d.Type)
+	if d.AA.Mode != AANone {
+		values.Set("aa", d.AA.Mode+strconv.Itoa(d.AA.Samples))
+	}
+	for _, orbit := range d.Orbits {
+		values.Add("orbit", orbit.String())
+	}
+	if d.TrapWindow != nil {
+		values.Set("trapwindow", strings.Join([]string{formatFloat(d.TrapWindow.Left), formatFloat(d.TrapWindow.Right), formatFloat(d.TrapWindow.Top), formatFloat(d.TrapWindow.Bottom)}, ","))
+	}
+	if d.Trap != nil {
+		values.Set("trap", d.Trap.Mode)
+		if d.Trap.Threshold != 0 {
+			values.Set("trapthreshold", formatFloat(d.Trap.Threshold))
+		}
+	}
+	if d.Seed != 0 {
+		values.Set("seed", strconv.FormatInt(d.Seed, 10))
+	}
+	if d.Samples > 0 {
+		values.Set("spp", strconv.Itoa(d.Samples))
+	}
+	if d.Budget != "" {
+		values.Set("budget", d.Budget)
+	}
+	if d.Accumulate {
+		values.Set("accumulate", "true")
+	}
+	if d.IFS != nil {
+		if d.IFS.Preset != "" {
+			values.Set("ifs", d.IFS.Preset)
+		}
+		for _, t := range d.IFS.Transforms {
+			values.Add("transform", t.String()+","+formatFloat(t.Weight))
+		}
+	}
+	if d.Flame != nil {
+		for _, t := range d.Flame.Transforms {
+			values.Add("xform", t.String())
+		}
+		if d.Flame.Final != nil {
+			values.Set("finalxform", d.Flame.Final.String())
+		}
+		values.Set("gamma", formatFloat(d.Flame.Gamma))
+		values.Set("vibrancy", formatFloat(d.Flame.Vibrancy))
+		values.Set("brightness", formatFloat(d.Flame.Brightness))
+		values.Set("estimator", formatFloat(d.Flame.Estimator))
+		values.Set("estimatormin", formatFloat(d.Flame.EstimatorMin))
+		values.Set("estimatorcurve", formatFloat(d.Flame.EstimatorCurve))
+	}
+	return values
+}
+
+func colorNames(colors []color.Color) []string {
+	var names []string
+	for _, c := range colors {
+		names = append(names, palettes.ColorName(c))
+	}
+	return names
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -1,6 +1,9 @@
 package params
 
 import (
+	"image/color"
+	"time"
+
 	"github.com/Balise42/marzipango/palettes"
 )
 
@@ -13,21 +16,130 @@ const Bottom = -1.0
 const Maxiter = 100
 
 type ImageParams struct {
-	Left    float64
-	Right   float64
-	Top     float64
-	Bottom  float64
-	Width   int
-	Height  int
-	MaxIter int
-	Palette palettes.Colors
-	Power   float64
-	Type	string
-	Orbits []Orbit
+	Left       float64
+	Right      float64
+	Top        float64
+	Bottom     float64
+	Width      int
+	Height     int
+	MaxIter    int
+	Palette    palettes.Colors
+	Power      float64
+	Type       string
+	Orbits     []Orbit
+	AA         Antialiasing
+	IFS        IFS
+	Flame      Flame
+	Seed       int64
+	Samples    int
+	Budget     time.Duration
+	Accumulate bool
+	TrapWindow Window
+	Trap       Trapping
+}
+
+// Window is a rectangle of the complex plane
+type Window struct {
+	Left   float64 `json:"left"`
+	Right  float64 `json:"right"`
+	Top    float64 `json:"top"`
+	Bottom float64 `json:"bottom"`
+}
+
+// Viewport returns the window of the complex plane shown by the image
+func (p ImageParams) Viewport() Window {
+	return Window{Left: p.Left, Right: p.Right, Top: p.Top, Bottom: p.Bottom}
+}
+
+// AffineTransform maps (x, y) to (A x + B y + E, C x + D y + F) in an iterated function system, and is picked with a probability proportional to its weight, or to its area without one
+type AffineTransform struct {
+	A      float64 `json:"a"`
+	B      float64 `json:"b"`
+	C      float64 `json:"c"`
+	D      float64 `json:"d"`
+	E      float64 `json:"e"`
+	F      float64 `json:"f"`
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// IFS is an iterated function system given by its transforms, which may come from a named preset
+type IFS struct {
+	Preset     string            `json:"preset,omitempty"`
+	Transforms []AffineTransform `json:"transforms,omitempty"`
+}
+
+// FlameTransform is a transform of a fractal flame: an affine transform followed by a weighted sum of variations and an optional post transform.
+// It is picked with a probability proportional to its weight and moves the color coordinate of the point towards its own color.
+type FlameTransform struct {
+	Weight     float64            `json:"weight"`
+	Color      float64            `json:"color"`
+	Affine     AffineTransform    `json:"affine"`
+	Variations map[string]float64 `json:"variations"`
+	Post       *AffineTransform   `json:"post,omitempty"`
+}
+
+// Flame describes a fractal flame: its transforms, the final transform applied to the points before plotting them,
+// the tone mapping of the densities and the maximum radius, minimum radius and curve of the density estimation filter
+type Flame struct {
+	Transforms     []FlameTransform `json:"transforms"`
+	Final          *FlameTransform  `json:"final,omitempty"`
+	Gamma          float64          `json:"gamma"`
+	Vibrancy       float64          `json:"vibrancy"`
+	Brightness     float64          `json:"brightness"`
+	Estimator      float64          `json:"estimator"`
+	EstimatorMin   float64          `json:"estimatormin"`
+	EstimatorCurve float64          `json:"estimatorcurve"`
+}
+
+// Antialiasing modes
+const (
+	AANone     = ""
+	AAGrid     = "grid"
+	AAJitter   = "jitter"
+	AAAdaptive = "adaptive"
+)
+
+// Antialiasing describes how pixels are sampled: Samples x Samples samples are taken for each (refined) pixel
+type Antialiasing struct {
+	Mode    string `json:"mode,omitempty"`
+	Samples int    `json:"samples,omitempty"`
+}
+
+// Orbit trap modes: the distance of the closest approach of the orbit to the traps, of its first or last point closer than the threshold,
+// the average distance of its points, the iteration of the closest approach, or the color of the texture of the trap at the closest approach
+const (
+	TrapMin       = ""
+	TrapFirst     = "first"
+	TrapLast      = "last"
+	TrapAverage   = "average"
+	TrapIteration = "iteration"
+	TrapTexture   = "texture"
+)
+
+// Trapping describes how the distances of the points of an orbit to the traps are aggregated into the value of the point
+type Trapping struct {
+	Mode      string  `json:"mode,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// OutputParams describe how the image is encoded
+type OutputParams struct {
+	Format      string
+	Depth       int
+	Quality     int
+	Compression string
+	Metadata    bool
 }
 
 type Orbit interface {
 	GetOrbitFastValue(z complex128) float64
 	GetOrbitValue(v float64) float64
+	Describe() OrbitDescription
 }
 
+// TexturedOrbit is an orbit trap with a texture, sampled at the trap-local texture coordinates of the points of the plane
+type TexturedOrbit interface {
+	Orbit
+	GetTextureCoords(z complex128) (float64, float64)
+	GetTextureColor(u float64, v float64) (color.RGBA64, bool)
+}
@@ -0,0 +1,352 @@
+package parsing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// flam3PaletteSize is the number of colors of the palettes of flam3 files
+const flam3PaletteSize = 256
+
+// flam3Flame is a flame element of a flam3 XML file
+type flam3Flame struct {
+	XMLName          xml.Name      `xml:"flame"`
+	Name             string        `xml:"name,attr,omitempty"`
+	Size             string        `xml:"size,attr"`
+	Center           string        `xml:"center,attr"`
+	Scale            float64       `xml:"scale,attr"`
+	Zoom             float64       `xml:"zoom,attr,omitempty"`
+	Rotate           float64       `xml:"rotate,attr,omitempty"`
+	Background       string        `xml:"background,attr"`
+	Brightness       float64       `xml:"brightness,attr"`
+	Gamma            float64       `xml:"gamma,attr"`
+	Vibrancy         float64       `xml:"vibrancy,attr"`
+	EstimatorRadius  float64       `xml:"estimator_radius,attr"`
+	EstimatorMinimum float64       `xml:"estimator_minimum,attr"`
+	EstimatorCurve   float64       `xml:"estimator_curve,attr"`
+	Xforms           []flam3Xform  `xml:"xform"`
+	Final            *flam3Xform   `xml:"finalxform"`
+	Colors           []flam3Color  `xml:"color"`
+	Palette          *flam3Palette `xml:"palette"`
+}
+
+// flam3Xform is a transform of a flam3 flame, its variations being the attributes named after them
+type flam3Xform struct {
+	Weight float64    `xml:"weight,attr,omitempty"`
+	Color  string     `xml:"color,attr"`
+	Coefs  string     `xml:"coefs,attr"`
+	Post   string     `xml:"post,attr,omitempty"`
+	Attrs  []xml.Attr `xml:",any,attr"`
+}
+
+// flam3Color is a color of the palette of a flam3 flame
+type flam3Color struct {
+	Index int    `xml:"index,attr"`
+	RGB   string `xml:"rgb,attr"`
+}
+
+// flam3Palette is a palette of a flam3 flame given as hexadecimal RGB colors
+type flam3Palette struct {
+	Count  int    `xml:"count,attr"`
+	Format string `xml:"format,attr"`
+	Data   string `xml:",chardata"`
+}
+
+// ParseFlam3 parses the first flame of a flam3 XML file, as saved by the usual flame editors, to the computation parameters.
+// Variations that marzipango does not know are ignored, and a rotation of the camera becomes a post transform of the final transform.
+func ParseFlam3(document []byte) (params.ImageParams, error) {
+	flame := flam3Flame{Brightness: 4, Gamma: 4, Vibrancy: 1, EstimatorRadius: 9, EstimatorCurve: 0.4}
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return params.ImageParams{}, errors.New("no flame element in the document")
+		}
+		if err != nil {
+			return params.ImageParams{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "flame" {
+			if err := decoder.DecodeElement(&flame, &start); err != nil {
+				return params.ImageParams{}, err
+			}
+			break
+		}
+	}
+
+	size, err := parseFloats(flame.Size, 2)
+	if err != nil || size[0] < 1 || size[1] < 1 {
+		return params.ImageParams{}, fmt.Errorf("invalid size %q", flame.Size)
+	}
+	center, err := parseFloats(flame.Center, 2)
+	if err != nil {
+		center = []float64{0, 0}
+	}
+	scale := flame.Scale * math.Pow(2, flame.Zoom)
+	if scale <= 0 {
+		return params.ImageParams{}, fmt.Errorf("invalid scale %v", flame.Scale)
+	}
+	if len(flame.Xforms) == 0 {
+		return params.ImageParams{}, errors.New("the flame has no xform")
+	}
+
+	imageParams := ParseValues(url.Values{"type": {"flame"}})
+	imageParams.Width, imageParams.Height = int(size[0]), int(size[1])
+	halfWidth, halfHeight := size[0]/2/scale, size[1]/2/scale
+	imageParams.Left, imageParams.Right = center[0]-halfWidth, center[0]+halfWidth
+	imageParams.Top, imageParams.Bottom = center[1]-halfHeight, center[1]+halfHeight
+
+	imageParams.Flame = params.Flame{
+		Gamma:          flame.Gamma,
+		Vibrancy:       flame.Vibrancy,
+		Brightness:     flame.Brightness,
+		Estimator:      flame.EstimatorRadius,
+		EstimatorMin:   flame.EstimatorMinimum,
+		EstimatorCurve: flame.EstimatorCurve,
+	}
+	for i, xform := range flame.Xforms {
+		t, err := xform.transform()
+		if err != nil {
+			return params.ImageParams{}, fmt.Errorf("xform %d: %v", i+1, err)
+		}
+		imageParams.Flame.Transforms = append(imageParams.Flame.Transforms, t)
+	}
+	if flame.Final != nil {
+		t, err := flame.Final.transform()
+		if err != nil {
+			return params.ImageParams{}, fmt.Errorf("finalxform: %v", err)
+		}
+		imageParams.Flame.Final = &t
+	}
+	if flame.Rotate != 0 {
+		rotateCamera(&imageParams.Flame, flame.Rotate, center)
+	}
+
+	if background, err := parseFloats(flame.Background, 3); err == nil {
+		imageParams.Palette.Divergence = color.NRGBA{R: unitToByte(background[0]), G: unitToByte(background[1]), B: unitToByte(background[2]), A: 255}
+	}
+	if colors := flame.palette(); len(colors) > 0 {
+		imageParams.Palette.ListColors = colors
+	}
+	return imageParams, nil
+}
+
+// transform returns the flame transform of the xform
+func (x flam3Xform) transform() (params.FlameTransform, error) {
+	affine, err := parseCoefs(x.Coefs)
+	if err != nil {
+		return params.FlameTransform{}, err
+	}
+	t := params.FlameTransform{Weight: x.Weight, Affine: affine, Variations: map[string]float64{}}
+
+	if fields := strings.Fields(x.Color); len(fields) > 0 {
+		col, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return params.FlameTransform{}, fmt.Errorf("invalid color %q", x.Color)
+		}
+		t.Color = math.Max(0, math.Min(col, 1))
+	}
+	if x.Post != "" {
+		post, err := parseCoefs(x.Post)
+		if err != nil {
+			return params.FlameTransform{}, err
+		}
+		t.Post = &post
+	}
+
+	for _, attr := range x.Attrs {
+		if _, ok := fractales.Variations[attr.Name.Local]; !ok {
+			continue
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(attr.Value), 64)
+		if err != nil {
+			return params.FlameTransform{}, fmt.Errorf("invalid weight %q of variation %s", attr.Value, attr.Name.Local)
+		}
+		if weight != 0 {
+			t.Variations[attr.Name.Local] = weight
+		}
+	}
+	return t, nil
+}
+
+// palette returns the colors of the flame, given either by color elements or by a palette element
+func (f flam3Flame) palette() []color.Color {
+	if len(f.Colors) > 0 {
+		colors := make([]color.Color, flam3PaletteSize)
+		for _, c := range f.Colors {
+			rgb, err := parseFloats(c.RGB, 3)
+			if err != nil || c.Index < 0 || c.Index >= flam3PaletteSize {
+				continue
+			}
+			colors[c.Index] = color.NRGBA{R: uint8(math.Max(0, math.Min(rgb[0], 255))), G: uint8(math.Max(0, math.Min(rgb[1], 255))), B: uint8(math.Max(0, math.Min(rgb[2], 255))), A: 255}
+		}
+		for i := range colors {
+			if colors[i] == nil {
+				colors[i] = palettes.Black
+			}
+		}
+		return colors
+	}
+
+	if f.Palette != nil && (f.Palette.Format == "" || strings.EqualFold(f.Palette.Format, "RGB")) {
+		data, err := hex.DecodeString(strings.Join(strings.Fields(f.Palette.Data), ""))
+		if err != nil {
+			return nil
+		}
+		var colors []color.Color
+		for i := 0; i+3 <= len(data); i += 3 {
+			colors = append(colors, color.NRGBA{R: data[i], G: data[i+1], B: data[i+2], A: 255})
+		}
+		return colors
+	}
+	return nil
+}
+
+// rotateCamera rotates the points of the flame around the center before plotting them, as flam3 does to rotate the camera
+func rotateCamera(flame *params.Flame, degrees float64, center []float64) {
+	angle := -degrees * math.Pi / 180
+	cos, sin := math.Cos(angle), math.Sin(angle)
+	rotation := params.AffineTransform{A: cos, B: -sin, C: sin, D: cos}
+	rotation.E = center[0] - (rotation.A*center[0] + rotation.B*center[1])
+	rotation.F = center[1] - (rotation.C*center[0] + rotation.D*center[1])
+
+	if flame.Final == nil {
+		flame.Final = &params.FlameTransform{Affine: params.AffineTransform{A: 1, D: 1}, Variations: map[string]float64{"linear": 1}}
+	}
+	post := rotation
+	if flame.Final.Post != nil {
+		post = composeAffine(rotation, *flame.Final.Post)
+	}
+	flame.Final.Post = &post
+}
+
+// composeAffine returns the affine transform applying inner then outer
+func composeAffine(outer params.AffineTransform, inner params.AffineTransform) params.AffineTransform {
+	return params.AffineTransform{
+		A: outer.A*inner.A + outer.B*inner.C,
+		B: outer.A*inner.B + outer.B*inner.D,
+		C: outer.C*inner.A + outer.D*inner.C,
+		D: outer.C*inner.B + outer.D*inner.D,
+		E: outer.A*inner.E + outer.B*inner.F + outer.E,
+		F: outer.C*inner.E + outer.D*inner.F + outer.F,
+	}
+}
+
+// parseCoefs parses flam3 coefficients, which list the columns of the affine matrix: x' = c0 x + c2 y + c4, y' = c1 x + c3 y + c5
+func parseCoefs(coefs string) (params.AffineTransform, error) {
+	c, err := parseFloats(coefs, 6)
+	if err != nil {
+		return params.AffineTransform{}, fmt.Errorf("invalid coefficients %q", coefs)
+	}
+	return params.AffineTransform{A: c[0], B: c[2], C: c[1], D: c[3], E: c[4], F: c[5]}, nil
+}
+
+// formatCoefs formats the affine transform as flam3 coefficients
+func formatCoefs(t params.AffineTransform) string {
+	return formatFloats(t.A, t.C, t.B, t.D, t.E, t.F)
+}
+
+// parseFloats parses exactly n space-separated numbers
+func parseFloats(s string, n int) ([]float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %d numbers, got %q", n, s)
+	}
+	values := make([]float64, n)
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func formatFloats(values ...float64) string {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		fields[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(fields, " ")
+}
+
+func unitToByte(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(v, 1)) * 255))
+}
+
+// EncodeFlam3 returns the flame of the parameters as a flam3 XML file, its palette sampled to 256 colors.
+// flam3 has a single scale for both axes, so the viewport is exported by its center and its width.
+func EncodeFlam3(imageParams params.ImageParams) ([]byte, error) {
+	if imageParams.Type != "flame" {
+		return nil, fmt.Errorf("only flames can be exported to flam3, not %s", imageParams.Type)
+	}
+
+	r, g, b, _ := color.NRGBAModel.Convert(imageParams.Palette.Divergence).RGBA()
+	flame := flam3Flame{
+		Name:             "marzipango",
+		Size:             fmt.Sprintf("%d %d", imageParams.Width, imageParams.Height),
+		Center:           formatFloats((imageParams.Left+imageParams.Right)/2, (imageParams.Top+imageParams.Bottom)/2),
+		Scale:            float64(imageParams.Width) / math.Abs(imageParams.Right-imageParams.Left),
+		Background:       formatFloats(float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff),
+		Brightness:       imageParams.Flame.Brightness,
+		Gamma:            imageParams.Flame.Gamma,
+		Vibrancy:         imageParams.Flame.Vibrancy,
+		EstimatorRadius:  imageParams.Flame.Estimator,
+		EstimatorMinimum: imageParams.Flame.EstimatorMin,
+		EstimatorCurve:   imageParams.Flame.EstimatorCurve,
+	}
+	for _, t := range imageParams.Flame.Transforms {
+		flame.Xforms = append(flame.Xforms, newFlam3Xform(t))
+	}
+	if imageParams.Flame.Final != nil {
+		final := newFlam3Xform(*imageParams.Flame.Final)
+		final.Weight = 0
+		flame.Final = &final
+	}
+
+	colors := imageParams.Palette.ListColors
+	if len(colors) == 0 {
+		colors = []color.Color{palettes.White}
+	}
+	for i := 0; i < flam3PaletteSize; i++ {
+		c := color.NRGBAModel.Convert(palettes.ColorFromGradient(float64(i)/(flam3PaletteSize-1), colors)).(color.NRGBA)
+		flame.Colors = append(flame.Colors, flam3Color{Index: i, RGB: fmt.Sprintf("%d %d %d", c.R, c.G, c.B)})
+	}
+
+	document, err := xml.MarshalIndent(flame, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(document, '\n'), nil
+}
+
+func newFlam3Xform(t params.FlameTransform) flam3Xform {
+	xform := flam3Xform{Weight: t.Weight, Color: strconv.FormatFloat(t.Color, 'g', -1, 64), Coefs: formatCoefs(t.Affine)}
+	if t.Post != nil {
+		xform.Post = formatCoefs(*t.Post)
+	}
+
+	names := make([]string, 0, len(t.Variations))
+	for name := range t.Variations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		xform.Attrs = append(xform.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: strconv.FormatFloat(t.Variations[name], 'g', -1, 64)})
+	}
+	return xform
+}
@@ -0,0 +1,93 @@
+package parsing
+
+import (
+	"image/color"
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+const testFlame = `<flames>
+<flame name="test" version="Apophysis 2.09" size="400 200" center="0.5 -0.25" scale="100" rotate="90" background="0 0 1" brightness="3" gamma="2.5" vibrancy="0.8" estimator_radius="5">
+   <xform weight="0.5" color="0.25 0" linear="0.5" julia="0.5" julian_power="3" coefs="1 0.1 0.2 1 0.3 0.4" post="1 0 0 1 0 -1" />
+   <xform weight="1" color="1" spherical="1" coefs="0.5 0 0 0.5 0 0" />
+   <palette count="2" format="RGB">
+      FF0000 00FF00
+   </palette>
+</flame>
+</flames>`
+
+func TestParseFlam3(t *testing.T) {
+	imageParams, err := ParseFlam3([]byte(testFlame))
+	if err != nil {
+		t.Fatalf("Valid flame rejected: %v", err)
+	}
+	if imageParams.Type != "flame" || imageParams.Width != 400 || imageParams.Height != 200 {
+		t.Errorf("Flame should be a 400x200 flame, got %v %dx%d", imageParams.Type, imageParams.Width, imageParams.Height)
+	}
+	if imageParams.Left != -1.5 || imageParams.Right != 2.5 || imageParams.Top != -1.25 || imageParams.Bottom != 0.75 {
+		t.Errorf("Camera should give the viewport, got %v %v %v %v", imageParams.Left, imageParams.Right, imageParams.Top, imageParams.Bottom)
+	}
+
+	flame := imageParams.Flame
+	if len(flame.Transforms) != 2 || flame.Gamma != 2.5 || flame.Vibrancy != 0.8 || flame.Estimator != 5 || flame.EstimatorCurve != 0.4 {
+		t.Fatalf("Flame should keep its transforms and tone mapping, got %v", flame)
+	}
+	first := flame.Transforms[0]
+	if first.Affine.B != 0.2 || first.Affine.C != 0.1 || first.Affine.F != 0.4 || first.Color != 0.25 || first.Post == nil || first.Post.F != -1 {
+		t.Errorf("Coefficients should be read by columns, got %v", first)
+	}
+	if !reflect.DeepEqual(first.Variations, map[string]float64{"linear": 0.5, "julia": 0.5}) {
+		t.Errorf("Known variations should be kept, got %v", first.Variations)
+	}
+
+	if flame.Final == nil || flame.Final.Post == nil {
+		t.Fatalf("Rotation should become a final transform")
+	}
+	post := *flame.Final.Post
+	if x, y := post.A*1.5+post.B*-0.25+post.E, post.C*1.5+post.D*-0.25+post.F; math.Abs(x-0.5) > 1e-9 || math.Abs(y+1.25) > 1e-9 {
+		t.Errorf("Rotation should turn around the center, got %v, %v", x, y)
+	}
+
+	if imageParams.Palette.Divergence != (color.NRGBA{B: 255, A: 255}) || len(imageParams.Palette.ListColors) != 2 {
+		t.Errorf("Flame should keep its background and palette, got %v and %v", imageParams.Palette.Divergence, imageParams.Palette.ListColors)
+	}
+}
+
+func TestFlam3RoundTrip(t *testing.T) {
+	values, _ := url.ParseQuery("type=flame&width=200&height=100&left=-1&right=0&top=-0.75&bottom=-0.25&palette=black,red,yellow&gamma=3&xform=1|0.5|0.5,0.1,0,0.5,0,0|swirl:0.5,julia|1,0,0,1,0.2,0&finalxform=0|0|1,0,0,1,0,0|linear")
+	imageParams := ParseValues(values)
+	document, err := EncodeFlam3(imageParams)
+	if err != nil {
+		t.Fatalf("Flame should be exported: %v", err)
+	}
+	imported, err := ParseFlam3(document)
+	if err != nil {
+		t.Fatalf("Exported flame should be parsed: %v", err)
+	}
+
+	if !reflect.DeepEqual(imported.Flame, imageParams.Flame) {
+		t.Errorf("Flame should survive a round trip, got %v and %v", imported.Flame, imageParams.Flame)
+	}
+	if imported.Left != imageParams.Left || imported.Right != imageParams.Right || imported.Top != imageParams.Top || imported.Bottom != imageParams.Bottom {
+		t.Errorf("Viewport should survive a round trip, got %v", imported)
+	}
+	if len(imported.Palette.ListColors) != 256 || imported.Palette.ListColors[255] != (color.NRGBA{R: 255, G: 255, A: 255}) {
+		t.Errorf("Palette should be exported as 256 colors")
+	}
+}
+
+func TestFlam3Errors(t *testing.T) {
+	invalid := []string{
+		`<notaflame/>`,
+		`<flame size="100 100" center="0 0" scale="0"><xform weight="1" coefs="1 0 0 1 0 0" linear="1"/></flame>`,
+		`<flame size="100 100" center="0 0" scale="10"></flame>`,
+		`<flame size="100 100" center="0 0" scale="10"><xform weight="1" coefs="1 0 0" linear="1"/></flame>`,
+	}
+	for _, document := range invalid {
+		if _, err := ParseFlam3([]byte(document)); err == nil {
+			t.Errorf("Invalid flame %s accepted", document)
+		}
+	}
+}
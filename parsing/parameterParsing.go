@@ -1,28 +1,33 @@
 package parsing
 
 import (
-	"github.com/Balise42/marzipango/fractales/orbits"
+	"errors"
+	"fmt"
 	"image/color"
-	"net/http"
+	"math"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Balise42/marzipango/formats"
 	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/fractales/orbits"
 	"github.com/Balise42/marzipango/palettes"
 	"github.com/Balise42/marzipango/params"
 )
 
-func parseIntParam(r *http.Request, name string, fallback int) int {
-	param, err := strconv.Atoi(r.URL.Query().Get(name))
+func parseIntParam(values url.Values, name string, fallback int) int {
+	param, err := strconv.Atoi(values.Get(name))
 	if err != nil {
 		return fallback
 	}
 	return param
 }
 
-func parseFloatParam(r *http.Request, name string, fallback float64) float64 {
-	param, err := strconv.ParseFloat(r.URL.Query().Get(name), 64)
+func parseFloatParam(values url.Values, name string, fallback float64) float64 {
+	param, err := strconv.ParseFloat(values.Get(name), 64)
 	if err != nil {
 		return fallback
 	}
@@ -30,15 +35,15 @@ func parseFloatParam(r *http.Request, name string, fallback float64) float64 {
 }
 
 func parseColor(name string) color.Color {
-	color, ok := palettes.ColorNames[name]
+	color, ok := palettes.ParseColor(name)
 	if ok {
 		return color
 	}
 	return palettes.Black
 }
 
-func parsePalette(r *http.Request, name string, fallback palettes.Colors) palettes.Colors {
-	param := r.URL.Query().Get(name)
+func parsePalette(values url.Values, name string, fallback palettes.Colors) palettes.Colors {
+	param := values.Get(name)
 	if len(param) < 1 {
 		return fallback
 	}
@@ -53,27 +58,102 @@ func parsePalette(r *http.Request, name string, fallback palettes.Colors) palett
 	return palettes.Colors{Divergence: divergence, ListColors: listColors, MaxValue: 254}
 }
 
-func parseImageSize(r *http.Request) (int, int) {
-	if r.URL.Query().Get("size") != "" {
-		param, err := strconv.Atoi(r.URL.Query().Get("size"))
+func parseColorList(values url.Values, name string, fallback []color.Color) []color.Color {
+	param := values.Get(name)
+	if len(param) < 1 {
+		return fallback
+	}
+
+	paramList := strings.Split(param, ",")
+	listColors := make([]color.Color, len(paramList))
+	for i, name := range paramList {
+		listColors[i] = parseColor(name)
+	}
+	return listColors
+}
+
+func parseInterior(values url.Values, fallback string) string {
+	interior := values.Get("interior")
+	if interior == palettes.InteriorModulus || interior == palettes.InteriorPeriod || interior == palettes.InteriorMultiplier || interior == palettes.InteriorOrbit {
+		return interior
+	}
+	return fallback
+}
+
+func parseColoring(values url.Values, fallback string) string {
+	coloring := values.Get("coloring")
+	if coloring == palettes.ColoringHistogram {
+		return coloring
+	}
+	return fallback
+}
+
+func parsePaletteSize(values url.Values, fallback int) int {
+	if values.Get("palettesize") == "auto" {
+		return palettes.AutoSize
+	}
+	size := parseIntParam(values, "palettesize", fallback)
+	if size < 1 {
+		return fallback
+	}
+	return size
+}
+
+var antialiasingRegexp = regexp.MustCompile(`^(grid|jitter|adaptive)?([0-9]*)$`)
+
+func parseAntialiasing(values url.Values) params.Antialiasing {
+	param := values.Get("aa")
+	matches := antialiasingRegexp.FindStringSubmatch(param)
+	if param == "" || matches == nil {
+		return params.Antialiasing{Mode: params.AANone}
+	}
+
+	mode := matches[1]
+	samples := 3
+	if mode == "" {
+		mode = params.AAGrid
+	} else if mode == params.AAAdaptive {
+		samples = 4
+	}
+
+	if matches[2] != "" {
+		samples, _ = strconv.Atoi(matches[2])
+	}
+	if samples < 1 || samples > 16 {
+		return params.Antialiasing{Mode: params.AANone}
+	}
+	return params.Antialiasing{Mode: mode, Samples: samples}
+}
+
+func parseImageSize(values url.Values) (int, int) {
+	if values.Get("size") != "" {
+		param, err := strconv.Atoi(values.Get("size"))
 		if err == nil {
 			return param, param
 		}
 	}
-	return parseIntParam(r, "width", params.Width), parseIntParam(r, "height", params.Height)
+	return parseIntParam(values, "width", params.Width), parseIntParam(values, "height", params.Height)
 }
 
-func parseImageCoords(r *http.Request) (float64, float64, float64, float64) {
-	if r.URL.Query().Get("x") != "" && r.URL.Query().Get("y") != "" && r.URL.Query().Get("window") != "" {
-		x := parseFloatParam(r, "x", 0)
-		y := parseFloatParam(r, "y", 0)
-		space := parseFloatParam(r, "window", 1)
+func parseImageCoords(values url.Values) (float64, float64, float64, float64) {
+	if values.Get("x") != "" && values.Get("y") != "" && values.Get("window") != "" {
+		x := parseFloatParam(values, "x", 0)
+		y := parseFloatParam(values, "y", 0)
+		space := parseFloatParam(values, "window", 1)
 		return x - space, x + space, y - space, y + space
 	}
-	return parseFloatParam(r, "left", params.Left), parseFloatParam(r, "right", params.Right), parseFloatParam(r, "top", params.Top), parseFloatParam(r, "bottom", params.Bottom)
+	return parseFloatParam(values, "left", params.Left), parseFloatParam(values, "right", params.Right), parseFloatParam(values, "top", params.Top), parseFloatParam(values, "bottom", params.Bottom)
 }
 
+// parseOrbit parses an orbit trap given as type(args), or type(args)@view for arguments relative to the trap window of the image
 func parseOrbit(rawOrbit string, defaultOrbit params.Orbit, imageParams params.ImageParams) params.Orbit {
+	coords := orbits.CoordsPlane
+	if strings.HasSuffix(rawOrbit, "@"+orbits.CoordsView) {
+		coords = orbits.CoordsView
+		rawOrbit = strings.TrimSuffix(rawOrbit, "@"+orbits.CoordsView)
+	}
+	window := imageParams.TrapWindow
+
 	if strings.HasPrefix(rawOrbit, "point(") {
 		paramString := strings.TrimSuffix(strings.TrimPrefix(rawOrbit, "point("), ")")
 		params := strings.Split(paramString, ",")
@@ -93,7 +173,7 @@ func parseOrbit(rawOrbit string, defaultOrbit params.Orbit, imageParams params.I
 		if err != nil {
 			return defaultOrbit
 		}
-		return orbits.CreatePointOrbit(x, y, dist)
+		return orbits.CreatePointOrbit(x, y, dist, coords, window)
 	} else if strings.HasPrefix(rawOrbit, "line(") {
 		paramString := strings.TrimSuffix(strings.TrimPrefix(rawOrbit, "line("), ")")
 		params := strings.Split(paramString, ",")
@@ -116,45 +196,171 @@ func parseOrbit(rawOrbit string, defaultOrbit params.Orbit, imageParams params.I
 		if err != nil {
 			return defaultOrbit
 		}
-		return orbits.CreateLineOrbit(a, b, c, dist)
-	} else if strings.HasPrefix(rawOrbit, "raster(") {
-		paramString := strings.TrimSuffix(strings.TrimPrefix(rawOrbit, "raster("), ")")
-		params := strings.Split(paramString, ",")
-
-		if len(params) > 2 {
+		if a == 0 && b == 0 {
 			return defaultOrbit
 		}
-
-		matched, err := regexp.MatchString(`^[a-zA-Z0-9\-]+$`, params[0])
-
-		if err != nil || !matched {
+		return orbits.CreateLineOrbit(a, b, c, dist, coords, window)
+	} else if strings.HasPrefix(rawOrbit, "raster(") || strings.HasPrefix(rawOrbit, "outline(") {
+		// raster traps are on the shape of the image and outline ones on its edge, both given as (name[,max[,threshold]][,left,top,right,bottom])
+		outline := strings.HasPrefix(rawOrbit, "outline(")
+		params, ok := splitRasterArgs(strings.TrimSuffix(rawOrbit[strings.Index(rawOrbit, "(")+1:], ")"))
+		if !ok || len(params) > 3 && len(params) != 6 && len(params) != 7 {
 			return defaultOrbit
 		}
 
-		path := "fractales/orbits/" + params[0] + ".png"
+		// images given as data URIs are loaded from the store, where StoreTraps puts them
+		name := params[0]
+		var err error
+		if orbits.IsDataURI(name) {
+			name, err = orbits.DataURIName(name)
+			if err != nil {
+				return defaultOrbit
+			}
+		} else if !orbits.ValidTrapName(name) {
+			return defaultOrbit
+		}
 
 		dist := float64(100)
 
-		if len(params) == 2 {
+		if len(params) >= 2 {
 			dist, err = strconv.ParseFloat(params[1], 64)
 			if err != nil {
 				return defaultOrbit
 			}
 		}
 
-		orbit, err := orbits.CreateImageOrbit(imageParams, path, dist)
+		threshold := orbits.DefaultThreshold
+		if len(params) == 3 || len(params) == 7 {
+			threshold, err = strconv.ParseFloat(params[2], 64)
+			if err != nil || threshold <= 0 || threshold > 1 {
+				return defaultOrbit
+			}
+		}
+
+		var rect []float64
+		if len(params) >= 6 {
+			for _, param := range params[len(params)-4:] {
+				f, err := strconv.ParseFloat(param, 64)
+				if err != nil {
+					return defaultOrbit
+				}
+				rect = append(rect, f)
+			}
+		}
+
+		orbit, err := orbits.CreateImageOrbit(name, dist, threshold, outline, rect, coords, window)
 		if err != nil {
 			return defaultOrbit
 		}
 
+		return orbit
+	} else if shapeType, _, ok := parseCall(rawOrbit); ok && orbits.IsShape(shapeType) {
+		orbit, err := parseShapeOrbit(rawOrbit, coords, window)
+		if err != nil {
+			return defaultOrbit
+		}
 		return orbit
 	}
 	return defaultOrbit
 }
 
-func parseOrbits(r *http.Request, imageParams params.ImageParams) ([]params.Orbit, bool) {
-	rawOrbits, ok := r.URL.Query()["orbit"]
-	defaultOrbit := orbits.CreatePointOrbit(0.5, -0.7, float64(100))
+// splitRasterArgs splits the arguments of a raster or outline trap, the first of which is the name of its image or a data URI
+func splitRasterArgs(paramString string) ([]string, bool) {
+	if !orbits.IsDataURI(paramString) {
+		return strings.Split(paramString, ","), true
+	}
+
+	// the comma ending the header of a data URI is part of the image
+	header := strings.Index(paramString, ",")
+	if header < 0 {
+		return nil, false
+	}
+	end := len(paramString)
+	if next := strings.Index(paramString[header+1:], ","); next >= 0 {
+		end = header + 1 + next
+	}
+	params := []string{paramString[:end]}
+	if end < len(paramString) {
+		params = append(params, strings.Split(paramString[end+1:], ",")...)
+	}
+	return params, true
+}
+
+// rasterTrapImage returns the name or the data URI of the image of a raster or outline trap
+func rasterTrapImage(rawOrbit string) (string, bool) {
+	if !strings.HasPrefix(rawOrbit, "raster(") && !strings.HasPrefix(rawOrbit, "outline(") {
+		return "", false
+	}
+	paramString := strings.TrimSuffix(strings.TrimSuffix(rawOrbit, "@"+orbits.CoordsView), ")")
+	params, ok := splitRasterArgs(paramString[strings.Index(paramString, "(")+1:])
+	if !ok {
+		return "", false
+	}
+	return params[0], true
+}
+
+// StoreTraps stores the images of the raster and outline traps given as data URIs, and returns the query parameters naming them instead
+func StoreTraps(values url.Values) (url.Values, error) {
+	stored := url.Values{}
+	for k, v := range values {
+		stored[k] = v
+	}
+	stored["orbit"] = make([]string, len(values["orbit"]))
+	for i, rawOrbit := range values["orbit"] {
+		stored["orbit"][i] = rawOrbit
+		if image, ok := rasterTrapImage(rawOrbit); ok && orbits.IsDataURI(image) {
+			name, err := orbits.Traps.PutDataURI(image)
+			if err != nil {
+				return nil, err
+			}
+			stored["orbit"][i] = strings.Replace(rawOrbit, image, name, 1)
+		}
+	}
+	if len(values["orbit"]) == 0 {
+		delete(stored, "orbit")
+	}
+	return stored, nil
+}
+
+// defaultTrapThreshold is the trap value under which a point of an orbit hits a trap in the first and last trap modes
+const defaultTrapThreshold = 10
+
+// parseTrapping parses the trap mode and the threshold of the first and last hit modes
+func parseTrapping(values url.Values) params.Trapping {
+	trap := params.Trapping{Mode: params.TrapMin, Threshold: defaultTrapThreshold}
+	switch mode := values.Get("trap"); mode {
+	case params.TrapFirst, params.TrapLast, params.TrapAverage, params.TrapIteration, params.TrapTexture:
+		trap.Mode = mode
+	}
+	if threshold, err := strconv.ParseFloat(values.Get("trapthreshold"), 64); err == nil && threshold >= 0 {
+		trap.Threshold = threshold
+	}
+	return trap
+}
+
+// parseTrapWindow parses the window the orbit traps are placed in and normalized against, given as left,right,top,bottom, defaulting to the viewport
+func parseTrapWindow(values url.Values, viewport params.Window) params.Window {
+	fields := strings.Split(values.Get("trapwindow"), ",")
+	if len(fields) != 4 {
+		return viewport
+	}
+	coords := make([]float64, 4)
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return viewport
+		}
+		coords[i] = f
+	}
+	if coords[0] == coords[1] || coords[2] == coords[3] {
+		return viewport
+	}
+	return params.Window{Left: coords[0], Right: coords[1], Top: coords[2], Bottom: coords[3]}
+}
+
+func parseOrbits(values url.Values, imageParams params.ImageParams) ([]params.Orbit, bool) {
+	rawOrbits, ok := values["orbit"]
+	defaultOrbit := orbits.CreatePointOrbit(0.5, -0.7, float64(100), orbits.CoordsPlane, imageParams.TrapWindow)
 
 	if !ok {
 		return []params.Orbit{defaultOrbit}, false
@@ -167,40 +373,246 @@ func parseOrbits(r *http.Request, imageParams params.ImageParams) ([]params.Orbi
 	return orbits, true
 }
 
-func parseFractaleType(r *http.Request, defaultType string) string {
-	fractaleType := r.URL.Query().Get("type")
-	if fractaleType == "mandelbrot" || fractaleType == "julia" || fractaleType == "fern" || fractaleType == "flame" || fractaleType == "sierp"{
+func parseFractaleType(values url.Values, defaultType string) string {
+	fractaleType := values.Get("type")
+	if fractaleType == "mandelbrot" || fractaleType == "julia" || fractaleType == "fern" || fractaleType == "flame" || fractaleType == "sierp" || fractaleType == "ifs" {
 		return fractaleType
 	}
 	return defaultType
 }
 
-func highPrecision(params params.ImageParams) bool {
-	coords := make(map[float64]bool)
-	for x := 0; x < params.Width; x++ {
-		coords[params.Left+float64(x)/float64(params.Width)*(params.Right-params.Left)] = true
+// hasViewport tells whether the values set the viewport of the image
+func hasViewport(values url.Values) bool {
+	for _, key := range []string{"left", "right", "top", "bottom", "x", "y", "window"} {
+		if values.Get(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTransform parses an affine transform given as a,b,c,d,e,f or a,b,c,d,e,f,weight
+func parseTransform(rawTransform string) (params.AffineTransform, bool) {
+	fields := strings.Split(rawTransform, ",")
+	if len(fields) != 6 && len(fields) != 7 {
+		return params.AffineTransform{}, false
+	}
+	coefficients := make([]float64, 7)
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return params.AffineTransform{}, false
+		}
+		coefficients[i] = f
 	}
-	return len(coords) < params.Width-5
+	return params.AffineTransform{A: coefficients[0], B: coefficients[1], C: coefficients[2], D: coefficients[3], E: coefficients[4], F: coefficients[5], Weight: coefficients[6]}, true
 }
 
-// ParseImageParams parses the request parameters to the computation parameters
-func ParseImageParams(r *http.Request) params.ImageParams {
-	imgWidth, imgHeight := parseImageSize(r)
-	imgLeft, imgRight, imgTop, imgBottom := parseImageCoords(r)
-	imgMaxIter := parseIntParam(r, "maxiter", params.Maxiter)
+// parseIFS parses the IFS of the values: the transforms of the ifs preset, from fractales.IFSPresets, replaced by the transform values if there are any.
+// It also returns the window of the preset, if one was loaded, and the error loading the preset if the IFS has no transforms because of it.
+func parseIFS(values url.Values) (params.IFS, *fractales.IFSPreset, error) {
+	ifs := params.IFS{Preset: values.Get("ifs")}
+	if ifs.Preset == "" && len(values["transform"]) == 0 {
+		ifs.Preset = "fern"
+	}
+
+	var preset *fractales.IFSPreset
+	var presetErr error
+	if ifs.Preset != "" {
+		loaded, err := fractales.LoadNamedIFSPreset(ifs.Preset)
+		if err == nil {
+			preset = &loaded
+			ifs.Transforms = loaded.Transforms
+		}
+		presetErr = err
+	}
+
+	var transforms []params.AffineTransform
+	for _, rawTransform := range values["transform"] {
+		if t, ok := parseTransform(rawTransform); ok {
+			transforms = append(transforms, t)
+		}
+	}
+	if len(transforms) > 0 {
+		ifs.Transforms = transforms
+		preset = nil
+		presetErr = nil
+	}
+	return ifs, preset, presetErr
+}
+
+// parseFlameTransform parses a flame transform given as weight|color|a,b,c,d,e,f|name:weight,... with an optional post transform |a,b,c,d,e,f.
+// A variation without a weight has a weight of 1.
+func parseFlameTransform(rawTransform string) (params.FlameTransform, bool) {
+	fields := strings.Split(rawTransform, "|")
+	if len(fields) != 4 && len(fields) != 5 {
+		return params.FlameTransform{}, false
+	}
+
+	weight, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+	if err != nil {
+		return params.FlameTransform{}, false
+	}
+	col, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+	if err != nil {
+		return params.FlameTransform{}, false
+	}
+	affine, ok := parseTransform(fields[2])
+	if !ok || affine.Weight != 0 {
+		return params.FlameTransform{}, false
+	}
+	t := params.FlameTransform{Weight: weight, Color: math.Max(0, math.Min(col, 1)), Affine: affine, Variations: map[string]float64{}}
+
+	for _, rawVariation := range strings.Split(fields[3], ",") {
+		nameWeight := strings.SplitN(strings.TrimSpace(rawVariation), ":", 2)
+		if _, ok := fractales.Variations[nameWeight[0]]; !ok {
+			continue
+		}
+		variationWeight := 1.0
+		if len(nameWeight) == 2 {
+			variationWeight, err = strconv.ParseFloat(nameWeight[1], 64)
+			if err != nil {
+				continue
+			}
+		}
+		t.Variations[nameWeight[0]] = variationWeight
+	}
+
+	if len(fields) == 5 {
+		post, ok := parseTransform(fields[4])
+		if !ok || post.Weight != 0 {
+			return params.FlameTransform{}, false
+		}
+		t.Post = &post
+	}
+	return t, true
+}
+
+// flamePalette is the palette of the flames without a palette value
+var flamePalette = []color.Color{palettes.Red, palettes.Orange, palettes.Yellow, palettes.White}
+
+// parseFlame parses the flame of the values: the transforms of the xform values, or the default flame without any, and its tone mapping and density estimation
+func parseFlame(values url.Values) params.Flame {
+	flame := fractales.DefaultFlame()
+
+	var transforms []params.FlameTransform
+	for _, rawTransform := range values["xform"] {
+		if t, ok := parseFlameTransform(rawTransform); ok {
+			transforms = append(transforms, t)
+		}
+	}
+	if len(transforms) > 0 {
+		flame.Transforms = transforms
+	}
+	if final, ok := parseFlameTransform(values.Get("finalxform")); ok {
+		flame.Final = &final
+	}
+
+	flame.Gamma = parseFloatParam(values, "gamma", flame.Gamma)
+	flame.Vibrancy = parseFloatParam(values, "vibrancy", flame.Vibrancy)
+	flame.Brightness = parseFloatParam(values, "brightness", flame.Brightness)
+	flame.Estimator = parseFloatParam(values, "estimator", flame.Estimator)
+	flame.EstimatorMin = parseFloatParam(values, "estimatormin", flame.EstimatorMin)
+	flame.EstimatorCurve = parseFloatParam(values, "estimatorcurve", flame.EstimatorCurve)
+	return flame
+}
+
+// ResizeValues returns a copy of the values with the image size given by the override values.
+// If only the width or the height is overridden, the other one keeps the aspect ratio.
+func ResizeValues(values url.Values, override url.Values) url.Values {
+	resized := url.Values{}
+	for k, v := range values {
+		resized[k] = v
+	}
+
+	width, height := parseImageSize(values)
+	newWidth := parseIntParam(override, "width", 0)
+	newHeight := parseIntParam(override, "height", 0)
+	if size := parseIntParam(override, "size", 0); size > 0 {
+		newWidth, newHeight = size, size
+	}
+
+	if newWidth > 0 && newHeight <= 0 {
+		newHeight = int(math.Round(float64(newWidth) * float64(height) / float64(width)))
+	} else if newHeight > 0 && newWidth <= 0 {
+		newWidth = int(math.Round(float64(newHeight) * float64(width) / float64(height)))
+	}
+
+	if newWidth > 0 && newHeight > 0 {
+		resized.Del("size")
+		resized.Set("width", strconv.Itoa(newWidth))
+		resized.Set("height", strconv.Itoa(newHeight))
+	}
+	return resized
+}
+
+// ParseDescription parses a render description to the computation parameters
+func ParseDescription(description params.Description) params.ImageParams {
+	return ParseValues(description.Values())
+}
+
+// ParseValues parses query parameters to the computation parameters
+func ParseValues(values url.Values) params.ImageParams {
+	imgWidth, imgHeight := parseImageSize(values)
+	imgLeft, imgRight, imgTop, imgBottom := parseImageCoords(values)
+	imgMaxIter := parseIntParam(values, "maxiter", params.Maxiter)
 
 	listCols := color.Palette{palettes.White, palettes.Black, palettes.White}
 	palette := palettes.Colors{Divergence: color.Black, ListColors: listCols, MaxValue: 500}
-	imgPalette := parsePalette(r, "palette", palette)
-	imgPalette.MaxValue = parseIntParam(r, "palettesize", 100)
+	imgPalette := parsePalette(values, "palette", palette)
+	imgPalette.MaxValue = parsePaletteSize(values, 100)
+	imgPalette.Coloring = parseColoring(values, palettes.ColoringContinuous)
+	imgPalette.Interior = parseInterior(values, palettes.InteriorNone)
+	imgPalette.InteriorColors = parseColorList(values, "interiorpalette", nil)
+
+	power := parseFloatParam(values, "power", 2)
 
-	power := parseFloatParam(r, "power", 2)
+	fractaleType := parseFractaleType(values, "mandelbrot")
 
-	fractaleType := parseFractaleType(r, "mandelbrot")
+	antialiasing := parseAntialiasing(values)
 
-	imageParams := params.ImageParams{Left: imgLeft, Right: imgRight, Top: imgTop, Bottom: imgBottom, Width: imgWidth, Height: imgHeight, MaxIter: imgMaxIter, Palette: imgPalette, Power: power, Type: fractaleType}
+	seed, err := strconv.ParseInt(values.Get("seed"), 10, 64)
+	if err != nil {
+		seed = 0
+	}
 
-	orbits, hasOrbits := parseOrbits(r, imageParams)
+	samples := parseIntParam(values, "spp", 0)
+	if samples < 0 {
+		samples = 0
+	}
+	budget, err := time.ParseDuration(values.Get("budget"))
+	if err != nil || budget < 0 {
+		budget = 0
+	}
+	accumulate := values.Get("accumulate") == "true"
+
+	imageParams := params.ImageParams{Left: imgLeft, Right: imgRight, Top: imgTop, Bottom: imgBottom, Width: imgWidth, Height: imgHeight, MaxIter: imgMaxIter, Palette: imgPalette, Power: power, Type: fractaleType, AA: antialiasing, Seed: seed, Samples: samples, Budget: budget, Accumulate: accumulate}
+
+	if fractaleType == "ifs" {
+		ifs, preset, _ := parseIFS(values)
+		imageParams.IFS = ifs
+		if !hasViewport(values) {
+			if preset != nil {
+				imageParams.Left, imageParams.Right, imageParams.Top, imageParams.Bottom = preset.Left, preset.Right, preset.Top, preset.Bottom
+			} else {
+				imageParams.Left, imageParams.Right, imageParams.Top, imageParams.Bottom = fractales.FitIFS(ifs.Transforms, float64(imgWidth)/float64(imgHeight))
+			}
+		}
+	}
+
+	if fractaleType == "flame" {
+		imageParams.Flame = parseFlame(values)
+		if !hasViewport(values) {
+			imageParams.Left, imageParams.Right, imageParams.Top, imageParams.Bottom = fractales.FlameLeft, fractales.FlameRight, fractales.FlameTop, fractales.FlameBottom
+		}
+		if values.Get("palette") == "" {
+			imageParams.Palette.ListColors = flamePalette
+		}
+	}
+
+	imageParams.TrapWindow = parseTrapWindow(values, imageParams.Viewport())
+	imageParams.Trap = parseTrapping(values)
+	orbits, hasOrbits := parseOrbits(values, imageParams)
 	if hasOrbits {
 		imageParams.Orbits = orbits
 	}
@@ -208,44 +620,127 @@ func ParseImageParams(r *http.Request) params.ImageParams {
 	return imageParams
 }
 
-func ComputerFromParameters(imageParams params.ImageParams) fractales.Computation {
-	colorPixel := palettes.ContinuousColoring(imageParams.Palette)
-	var valueComputer fractales.ValueComputation
+// CheckValues returns an error if the query parameters refer to something which cannot be loaded, and which ParseValues would leave out of the image:
+// an IFS preset or a trap image which does not exist, or an image given as data URI which StoreTraps did not store
+func CheckValues(values url.Values) error {
+	if parseFractaleType(values, "mandelbrot") == "ifs" {
+		if _, _, err := parseIFS(values); err != nil {
+			return err
+		}
+	}
+	for _, rawOrbit := range values["orbit"] {
+		image, ok := rasterTrapImage(rawOrbit)
+		if !ok {
+			continue
+		}
+		if !orbits.IsDataURI(image) {
+			if !orbits.Traps.Has(image) {
+				return fmt.Errorf("unknown trap image %s", image)
+			}
+			continue
+		}
+		name, err := orbits.DataURIName(image)
+		if err != nil {
+			return err
+		}
+		if !orbits.Traps.Has(name) {
+			return fmt.Errorf("trap image %s given as data URI is not stored, it must be uploaded first", name)
+		}
+	}
+	return nil
+}
 
-	fractaleType := imageParams.Type
-	orbits := imageParams.Orbits
-	hasOrbits := len(orbits) > 0
-	power := imageParams.Power
+// acceptQuality returns the quality factor given by the Accept header to the MIME type, using the most specific media range matching it
+func acceptQuality(accept string, mimeType string) float64 {
+	quality := 0.0
+	specificity := -1
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		rangeSpecificity := -1
+		if mediaRange == mimeType {
+			rangeSpecificity = 2
+		} else if mediaRange == "image/*" {
+			rangeSpecificity = 1
+		} else if mediaRange == "*/*" {
+			rangeSpecificity = 0
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
 
-	if !highPrecision(imageParams) {
-		if fractaleType == "julia" {
-			if hasOrbits {
-				valueComputer = fractales.JuliaOrbitValueComputerLow(imageParams, orbits)
-			} else {
-				valueComputer = fractales.JuliaContinuousValueComputerLow(imageParams)
-			}
-		} else if fractaleType == "mandelbrot" && power == 2 {
-			if hasOrbits {
-				valueComputer = fractales.MandelbrotOrbitValueComputerLow(imageParams, orbits)
-			} else {
-				valueComputer = fractales.MandelbrotContinuousValueComputerLow(imageParams)
+		rangeQuality := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(field, "q="), 64)
+				if err == nil {
+					rangeQuality = q
+				}
 			}
-		} else if fractaleType == "fern" {
-			valueComputer = fractales.FernValueComputeLow(imageParams)
-		} else if fractaleType == "flame" {
-			return fractales.CreateFlameComputer(imageParams)
-		} else if fractaleType == "sierp" {
-			valueComputer = fractales.SierpValueComputeLow(imageParams)
-		} else if power != 2 {
-			valueComputer = fractales.MultibrotContinuousValueComputerLow(imageParams)
 		}
-	} else {
-		if fractaleType == "julia" {
-			valueComputer = fractales.JuliaContinuousValueComputerHigh(imageParams)
-		} else if fractaleType == "mandelbrot" && power == 2 {
-			valueComputer = fractales.MandelbrotContinuousValueComputerHigh(imageParams)
+		specificity = rangeSpecificity
+		quality = rangeQuality
+	}
+	return quality
+}
+
+func parseFormat(values url.Values, accept string, fallback string) string {
+	format := values.Get("format")
+	if format == "jpg" {
+		return formats.JPEG
+	}
+	for _, f := range formats.Formats {
+		if format == f {
+			return f
+		}
+	}
+
+	// WebP images are lossless and slower to encode than PNG ones, so they are only sent to clients accepting no other format
+	best := fallback
+	bestQuality := 0.0
+	for _, f := range formats.Formats {
+		if q := acceptQuality(accept, formats.ContentType(f)); q > bestQuality && f != formats.WebP {
+			best = f
+			bestQuality = q
 		}
 	}
+	if bestQuality == 0 && acceptQuality(accept, formats.ContentType(formats.WebP)) > 0 {
+		return formats.WebP
+	}
+	return best
+}
+
+// CheckOutputValues returns an error if the query parameters ask for an encoding which is not supported: WebP images are lossless only, and have no quality
+func CheckOutputValues(values url.Values, accept string) error {
+	if values.Get("quality") != "" && parseFormat(values, accept, formats.PNG) == formats.WebP {
+		return errors.New("WebP images are lossless only and have no quality")
+	}
+	return nil
+}
+
+// ParseOutputValues parses query parameters and the value of an Accept header to the image encoding parameters
+func ParseOutputValues(values url.Values, accept string) params.OutputParams {
+	format := parseFormat(values, accept, formats.PNG)
+
+	// images are rendered with 16 bits per channel and written as such unless 8 bits are asked for
+	depth := parseIntParam(values, "depth", 16)
+	if depth != 8 {
+		depth = 16
+	}
+
+	quality := parseIntParam(values, "quality", 90)
+	if quality < 1 || quality > 100 {
+		quality = 90
+	}
+
+	compression := values.Get("compression")
+	if compression != "none" && compression != "speed" && compression != "best" {
+		compression = "default"
+	}
+
+	metadata := values.Get("metadata") == "true"
 
-	return fractales.CreateComputer(valueComputer, colorPixel, imageParams)
+	return params.OutputParams{Format: format, Depth: depth, Quality: quality, Compression: compression, Metadata: metadata}
 }
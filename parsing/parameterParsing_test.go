@@ -0,0 +1,335 @@
+package parsing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/fractales/orbits"
+	"github.com/Balise42/marzipango/params"
+)
+
+func TestDescriptionRoundTrip(t *testing.T) {
+	values, _ := url.ParseQuery("x=-0.75&y=0.1&window=0.05&size=300&maxiter=250&palette=black,%23102030,white&palettesize=auto&interior=period&interiorpalette=red,blue&aa=jitter2&power=2&type=julia&orbit=point(0.5,-0.7,100)&orbit=line(1,2,0.5,50)&orbit=point(0.5,0.5,30)@view&orbit=raster(spiral,40,0,0,0.5,1)@view&trapwindow=-1,1,1,-1")
+	description := ParseValues(values).Describe()
+
+	fromQuery := ParseValues(description.Values()).Describe()
+	if !reflect.DeepEqual(description, fromQuery) {
+		t.Errorf("Query string round trip is dubious, wanted %v, got %v", description, fromQuery)
+	}
+
+	encoded, err := json.Marshal(description)
+	if err != nil {
+		t.Fatalf("JSON encoding failed: %v", err)
+	}
+	var decoded params.Description
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("JSON decoding failed: %v", err)
+	}
+
+	if fromJSON := ParseDescription(decoded).Describe(); !reflect.DeepEqual(description, fromJSON) {
+		t.Errorf("JSON round trip is dubious, wanted %v, got %v", description, fromJSON)
+	}
+}
+
+func TestResizeKeepsAspectRatio(t *testing.T) {
+	values, _ := url.ParseQuery("width=900&height=600&maxiter=50")
+	override, _ := url.ParseQuery("width=300")
+	resized := ResizeValues(values, override)
+	if resized.Get("width") != "300" || resized.Get("height") != "200" || resized.Get("maxiter") != "50" {
+		t.Errorf("Resized values are dubious, got %v", resized)
+	}
+}
+
+func TestIFSTransforms(t *testing.T) {
+	values, _ := url.ParseQuery("type=ifs&width=300&height=200&transform=0.5,-0.5,0.5,0.5,0,0&transform=-0.5,-0.5,0.5,-0.5,1,0,2&transform=oops")
+	imageParams := ParseValues(values)
+	expected := []params.AffineTransform{{A: 0.5, B: -0.5, C: 0.5, D: 0.5}, {A: -0.5, B: -0.5, C: 0.5, D: -0.5, E: 1, Weight: 2}}
+	if !reflect.DeepEqual(imageParams.IFS.Transforms, expected) {
+		t.Errorf("Transforms should be %v, got %v", expected, imageParams.IFS.Transforms)
+	}
+	if imageParams.Left >= -0.3 || imageParams.Right <= 1.1 || imageParams.Top <= imageParams.Bottom {
+		t.Errorf("Viewport should frame the dragon with the y axis up, got %v %v %v %v", imageParams.Left, imageParams.Right, imageParams.Top, imageParams.Bottom)
+	}
+
+	description := imageParams.Describe()
+	if fromQuery := ParseValues(description.Values()).Describe(); !reflect.DeepEqual(description, fromQuery) {
+		t.Errorf("Query string round trip is dubious, wanted %v, got %v", description, fromQuery)
+	}
+}
+
+func TestIFSPresetErrors(t *testing.T) {
+	defer func(dir string) { fractales.IFSPresets = dir }(fractales.IFSPresets)
+	fractales.IFSPresets = "../fractales/presets"
+
+	for _, query := range []string{"type=ifs", "type=ifs&ifs=dragon", "type=ifs&ifs=nope&transform=0.5,0,0,0.5,0,0", "type=julia&ifs=nope"} {
+		values, _ := url.ParseQuery(query)
+		if err := CheckValues(values); err != nil {
+			t.Errorf("%s should be accepted, got %v", query, err)
+		}
+		if ParseValues(values).Type == "ifs" && len(ParseValues(values).IFS.Transforms) == 0 {
+			t.Errorf("%s should have transforms", query)
+		}
+	}
+	for _, query := range []string{"type=ifs&ifs=nope", "type=ifs&ifs=../presets/fern"} {
+		values, _ := url.ParseQuery(query)
+		if err := CheckValues(values); err == nil {
+			t.Errorf("%s should be rejected", query)
+		}
+	}
+
+	if _, err := ParseRenderDocument([]byte(`{"type": "ifs", "ifs": {"preset": "nope"}}`)); err == nil {
+		t.Errorf("Render documents with an unknown preset should be rejected")
+	}
+
+	fractales.IFSPresets = os.TempDir()
+	if err := CheckValues(url.Values{"type": {"ifs"}}); err == nil {
+		t.Errorf("Presets should be loaded from fractales.IFSPresets")
+	}
+}
+
+func TestViewTraps(t *testing.T) {
+	values, _ := url.ParseQuery("left=-1&right=3&top=2&bottom=0&orbit=point(0.25,0.5,100)@view&orbit=point(0,1,100)&orbit=line(1,0,-0.25,100)@view&orbit=line(1,0,0,100)")
+	traps := ParseValues(values).Orbits
+	for _, z := range []complex128{0, 1 + 1i, -3 + 0.5i} {
+		if view, plane := traps[0].GetOrbitValue(traps[0].GetOrbitFastValue(z)), traps[1].GetOrbitValue(traps[1].GetOrbitFastValue(z)); math.Abs(view-plane) > 1e-9 {
+			t.Errorf("Point at a quarter of the viewport should be at 0+1i, got %v and %v at %v", view, plane, z)
+		}
+		if view, plane := traps[2].GetOrbitValue(traps[2].GetOrbitFastValue(z)), traps[3].GetOrbitValue(traps[3].GetOrbitFastValue(z)); math.Abs(view-plane) > 1e-9 {
+			t.Errorf("Line at a quarter of the viewport should be x = 0, got %v and %v at %v", view, plane, z)
+		}
+	}
+
+	if far := traps[1].GetOrbitValue(traps[1].GetOrbitFastValue(3 + 0i)); math.Abs(far-100) > 1e-9 {
+		t.Errorf("Farthest corner of the viewport should be at the maximum value, got %v", far)
+	}
+
+	zoomed, _ := url.ParseQuery("left=-0.1&right=0.1&top=1.1&bottom=0.9&orbit=point(0,1,100)")
+	trap := ParseValues(zoomed).Orbits[0]
+	if corner := trap.GetOrbitValue(trap.GetOrbitFastValue(0.1 + 1.1i)); math.Abs(corner-100) > 1e-9 {
+		t.Errorf("Trap range should follow the zoom, got %v at the corner", corner)
+	}
+}
+
+func TestShapeTraps(t *testing.T) {
+	values, _ := url.ParseQuery("left=-2&right=2&top=2&bottom=-2" +
+		"&orbit=circle(0,0,1,100)" +
+		"&orbit=grid(0.5,100)" +
+		"&orbit=smooth(ring(0,0,1,0.1),cross(1,1,0.5),rect(-1,-1,-0.5,-0.5),0.2,50)@view" +
+		"&orbit=subtract(polygon(0,0,1,6,30),star(0,0,0.5,0.2,5),100)" +
+		"&orbit=path(M-1,-1 L1,-1 Q1.5,0 1,1 H-1 Z,100)" +
+		"&orbit=union(point(0,0),segment(0,0,1,1),100)")
+	traps := ParseValues(values).Orbits
+	if len(traps) != 6 {
+		t.Fatalf("Expected 6 traps, got %d", len(traps))
+	}
+	value := func(i int, z complex128) float64 {
+		return traps[i].GetOrbitValue(traps[i].GetOrbitFastValue(z))
+	}
+
+	if inside, outside := value(0, 0.5), value(0, 2+2i); inside != 0 || math.Abs(outside-100) > 1e-9 {
+		t.Errorf("Circle should be 0 inside and 100 at the corner, got %v and %v", inside, outside)
+	}
+	if onLine, between := value(1, 1+0.3i), value(1, 0.25+0.25i); onLine != 0 || between <= 0 {
+		t.Errorf("Grid should be 0 on its lines only, got %v and %v", onLine, between)
+	}
+	if center, hole := value(3, 0.8), value(3, 0); center != 0 || hole <= 0 {
+		t.Errorf("Hexagon minus star should be 0 on the hexagon only, got %v and %v", center, hole)
+	}
+	if inside, bulge, outside := value(4, 0), value(4, 1.2), value(4, 1.9); inside != 0 || bulge != 0 || outside <= 0 {
+		t.Errorf("Path should be 0 inside its curve, got %v, %v and %v", inside, bulge, outside)
+	}
+	if value(5, 0.5+0.5i) != 0 || value(5, 0.5-0.5i) <= 0 {
+		t.Errorf("Union should be 0 on the segment only")
+	}
+
+	description := ParseValues(values).Describe()
+	if fromQuery := ParseValues(description.Values()).Describe(); !reflect.DeepEqual(description, fromQuery) {
+		t.Errorf("Query string round trip is dubious, wanted %v, got %v", description, fromQuery)
+	}
+	if description.Orbits[2].String() != "smooth(ring(0,0,1,0.1),cross(1,1,0.5),rect(-1,-1,-0.5,-0.5),0.2,50)@view" {
+		t.Errorf("Combinator description is dubious, got %v", description.Orbits[2])
+	}
+
+	for _, invalid := range []string{"circle(0,0,100)", "polygon(0,0,1,2.5,100)", "union(100)", "path(M0 0 X,100)", "path(M0 0 - 1,20)", "path(M0 0 . 5,20)", "path(M0 0 L1e- 1,20)", "smooth(circle(0,0,1),circle(1,0,1),100)", "circle(0,0,1,line(0,0,1),100)"} {
+		values, _ := url.ParseQuery("orbit=" + url.QueryEscape(invalid))
+		if trap := ParseValues(values).Orbits[0].Describe(); trap.Type != "point" {
+			t.Errorf("Invalid trap %s should fall back to the default one, got %v", invalid, trap)
+		}
+	}
+}
+
+func TestTrapModes(t *testing.T) {
+	values, _ := url.ParseQuery("orbit=point(0,0,100)&trap=first&trapthreshold=5")
+	imageParams := ParseValues(values)
+	if imageParams.Trap != (params.Trapping{Mode: params.TrapFirst, Threshold: 5}) {
+		t.Errorf("Trapping should be first hit under 5, got %v", imageParams.Trap)
+	}
+	description := imageParams.Describe()
+	if fromQuery := ParseValues(description.Values()).Describe(); !reflect.DeepEqual(description, fromQuery) {
+		t.Errorf("Query string round trip is dubious, wanted %v, got %v", description, fromQuery)
+	}
+
+	for query, expected := range map[string]params.Trapping{
+		"orbit=point(0,0,100)&trap=average&trapthreshold=5": {Mode: params.TrapAverage},
+		"orbit=point(0,0,100)&trap=nearest":                 {},
+		"trap=iteration":                                    {},
+	} {
+		values, _ := url.ParseQuery(query)
+		description := ParseValues(values).Describe()
+		if trap := description.Trap; (trap == nil) != (expected == params.Trapping{}) || (trap != nil && *trap != expected) {
+			t.Errorf("Trapping of %s should be described as %v, got %v", query, expected, trap)
+		}
+	}
+}
+
+func TestDataURITraps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(store orbits.Store) { orbits.Traps = store }(orbits.Traps)
+	orbits.Traps = orbits.Store{Dir: dir, Bundled: "../fractales/orbits"}
+
+	img := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.White, color.Black})
+	img.SetColorIndex(4, 4, 1)
+	var encoded bytes.Buffer
+	if err := gif.Encode(&encoded, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	uri := "data:image/gif;base64," + base64.StdEncoding.EncodeToString(encoded.Bytes())
+
+	values := url.Values{"orbit": {"raster(" + uri + ",20,0,0,1,1)@view", "raster(spiral)"}}
+	if trap := ParseValues(values).Orbits[0].Describe(); trap.Type != "point" {
+		t.Errorf("Parsing should not store data URI traps, got %v", trap)
+	}
+	if err := CheckValues(values); err == nil {
+		t.Errorf("Data URI traps which are not stored should be rejected")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Parsing should not store data URI traps, got %d files", len(files))
+	}
+
+	values, err = StoreTraps(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckValues(url.Values{"orbit": {"raster(" + uri + ",20)"}}); err != nil {
+		t.Errorf("Stored data URI traps should be accepted, got %v", err)
+	}
+	imageParams := ParseValues(values)
+	uploaded := imageParams.Orbits[0].Describe()
+	if uploaded.Type != "raster" || len(uploaded.Name) != 64 || !reflect.DeepEqual(uploaded.Args, []float64{20, 0, 0, 1, 1}) {
+		t.Fatalf("Data URI trap should be stored by its hash, got %v", uploaded)
+	}
+	if bundled := imageParams.Orbits[1].Describe(); bundled.Name != "spiral" {
+		t.Errorf("Bundled trap should still load, got %v", bundled)
+	}
+
+	description := imageParams.Describe()
+	if fromQuery := ParseValues(description.Values()).Describe(); !reflect.DeepEqual(description, fromQuery) {
+		t.Errorf("Query string round trip is dubious, wanted %v, got %v", description, fromQuery)
+	}
+
+	document, _ := json.Marshal(map[string]interface{}{"orbits": []interface{}{map[string]interface{}{"type": "raster", "name": uri, "args": []float64{20}}}})
+	fromDocument, err := ParseRenderDocument(document)
+	if err != nil {
+		t.Fatalf("Render document with a data URI trap should be valid: %v", err)
+	}
+	if name := fromDocument.Orbits[0].Describe().Name; name != uploaded.Name {
+		t.Errorf("Data URI trap of a document should be stored as %s, got %s", uploaded.Name, name)
+	}
+
+	if err := CheckValues(description.Values()); err != nil {
+		t.Errorf("Stored and bundled traps should be accepted, got %v", err)
+	}
+	for _, missing := range []string{"raster(missing,20)", "outline(missing)@view"} {
+		if err := CheckValues(url.Values{"orbit": {missing}}); err == nil {
+			t.Errorf("Trap %s should be rejected", missing)
+		}
+	}
+	os.Remove(filepath.Join(dir, uploaded.Name+".png"))
+	if err := CheckValues(description.Values()); err == nil {
+		t.Errorf("Traps removed from the store should be rejected")
+	}
+}
+
+func TestOutlineTraps(t *testing.T) {
+	defer func(store orbits.Store) { orbits.Traps = store }(orbits.Traps)
+	orbits.Traps = orbits.Store{Dir: os.TempDir(), Bundled: "../fractales/orbits"}
+
+	values := url.Values{"orbit": {"outline(spiral,30)", "raster(spiral,30,0.25,0,0,1,1)", "outline(spiral,30,0)", "raster(spiral,30,1.5)"}}
+	imageParams := ParseValues(values)
+	if len(imageParams.Orbits) != 4 {
+		t.Fatalf("Expected 4 orbits, got %d", len(imageParams.Orbits))
+	}
+	if outline := imageParams.Orbits[0].Describe(); outline.Type != "outline" || !reflect.DeepEqual(outline.Args, []float64{30}) {
+		t.Errorf("Outline trap should describe itself as such, got %v", outline)
+	}
+	if raster := imageParams.Orbits[1].Describe(); raster.Type != "raster" || !reflect.DeepEqual(raster.Args, []float64{30, 0.25, 0, 0, 1, 1}) {
+		t.Errorf("Raster trap should keep its threshold, got %v", raster)
+	}
+	for _, orbit := range imageParams.Orbits[2:] {
+		if _, ok := orbit.(orbits.ImageOrbit); ok {
+			t.Errorf("Thresholds outside of (0, 1] should be rejected, got %v", orbit.Describe())
+		}
+	}
+
+	description := imageParams.Describe()
+	if fromQuery := ParseValues(description.Values()).Describe(); !reflect.DeepEqual(description, fromQuery) {
+		t.Errorf("Query string round trip is dubious, wanted %v, got %v", description, fromQuery)
+	}
+}
+
+func TestOutputDepth(t *testing.T) {
+	for query, depth := range map[string]int{"": 16, "depth=16": 16, "depth=8": 8, "depth=12": 16} {
+		values, _ := url.ParseQuery(query)
+		if got := ParseOutputValues(values, "").Depth; got != depth {
+			t.Errorf("Depth of %q should be %d, got %d", query, depth, got)
+		}
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	for _, c := range []struct{ query, accept, format string }{
+		{"", "", "png"},
+		{"", "text/html,application/xhtml+xml,image/avif,image/webp,image/apng,*/*;q=0.8", "png"},
+		{"", "image/avif,image/webp,*/*", "png"},
+		{"", "image/jpeg", "jpeg"},
+		{"", "image/webp", "webp"},
+		{"format=webp", "image/png", "webp"},
+		{"format=tiff", "", "tiff"},
+	} {
+		values, _ := url.ParseQuery(c.query)
+		if got := ParseOutputValues(values, c.accept).Format; got != c.format {
+			t.Errorf("Format of %q accepting %q should be %s, got %s", c.query, c.accept, c.format, got)
+		}
+	}
+
+	for _, c := range []struct {
+		query, accept string
+		valid         bool
+	}{
+		{"format=webp", "", true},
+		{"format=jpeg&quality=50", "", true},
+		{"format=webp&quality=50", "", false},
+		{"quality=50", "image/webp", false},
+	} {
+		values, _ := url.ParseQuery(c.query)
+		if err := CheckOutputValues(values, c.accept); (err == nil) != c.valid {
+			t.Errorf("Output %q accepting %q should be valid: %t, got %v", c.query, c.accept, c.valid, err)
+		}
+	}
+}
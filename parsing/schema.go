@@ -0,0 +1,383 @@
+package parsing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// RenderSchema is the JSON Schema of the render documents, mirroring params.Description
+var RenderSchema = strings.Replace(renderSchemaTemplate, "COLOR_NAMES", colorNames(), 1)
+
+// renderSchemaTemplate is RenderSchema before the names of the colors are filled in
+const renderSchemaTemplate = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "/render/schema.json",
+  "title": "marzipango render",
+  "description": "Description of a fractal render. Omitted properties take the same default values as the query parameters.",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "left": {"type": "number"},
+    "right": {"type": "number"},
+    "top": {"type": "number"},
+    "bottom": {"type": "number"},
+    "width": {"type": "integer", "minimum": 1},
+    "height": {"type": "integer", "minimum": 1},
+    "maxiter": {"type": "integer", "minimum": 1},
+    "palette": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "divergence": {"$ref": "#/definitions/color"},
+        "colors": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/color"}},
+        "size": {"type": "integer", "minimum": 0, "description": "0 picks the size from the range of values"},
+        "coloring": {"enum": ["", "histogram"]},
+        "interior": {"enum": ["", "modulus", "period", "multiplier", "orbit"]},
+        "interiorcolors": {"type": "array", "items": {"$ref": "#/definitions/color"}}
+      }
+    },
+    "power": {"type": "number"},
+    "type": {"enum": ["mandelbrot", "julia", "fern", "flame", "sierp", "ifs"]},
+    "aa": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "mode": {"enum": ["", "grid", "jitter", "adaptive"]},
+        "samples": {"type": "integer", "minimum": 1, "maximum": 16}
+      }
+    },
+    "orbits": {"type": "array", "items": {"$ref": "#/definitions/orbit"}},
+    "trap": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "mode": {"enum": ["", "first", "last", "average", "iteration", "texture"], "description": "aggregation of the distances of the orbit to the traps, the closest approach by default"},
+        "threshold": {"type": "number", "minimum": 0, "description": "trap value under which a point hits a trap in the first and last modes"}
+      }
+    },
+    "trapwindow": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["left", "right", "top", "bottom"],
+      "description": "window of the plane the orbit traps are placed in and normalized against, the viewport if omitted",
+      "properties": {
+        "left": {"type": "number"},
+        "right": {"type": "number"},
+        "top": {"type": "number"},
+        "bottom": {"type": "number"}
+      }
+    },
+    "seed": {"type": "integer", "description": "seed of the random numbers of the IFS fractals and flames; the same seed always gives the same image"},
+    "spp": {"type": "integer", "minimum": 0, "description": "chaos game iterations per pixel of the IFS fractals and flames, 0 for the default of the fractal"},
+    "budget": {"type": "string", "pattern": "^([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$", "description": "duration after which the chaos game of the IFS fractals and flames stops"},
+    "accumulate": {"type": "boolean", "description": "add the chaos game of the IFS fractals and flames to the ones of the previous renders of the same image"},
+    "ifs": {
+      "type": "object",
+      "additionalProperties": false,
+      "description": "IFS of the ifs type: the transforms of a preset, replaced by the given transforms if there are any. Without a viewport, the window of the preset or one framing the attractor is used.",
+      "properties": {
+        "preset": {"type": "string", "pattern": "^[a-zA-Z0-9\\-]+$"},
+        "transforms": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/transform"}}
+      }
+    },
+    "flame": {
+      "type": "object",
+      "additionalProperties": false,
+      "description": "Fractal flame of the flame type. Without transforms, the default flame is drawn; without a viewport, the window of the default flame is used.",
+      "properties": {
+        "transforms": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/flametransform"}},
+        "final": {"$ref": "#/definitions/flametransform"},
+        "gamma": {"type": "number", "minimum": 0},
+        "vibrancy": {"type": "number", "minimum": 0, "maximum": 1},
+        "brightness": {"type": "number", "minimum": 0},
+        "estimator": {"type": "number", "minimum": 0, "description": "maximum radius of the density estimation filter, 0 disables it"},
+        "estimatormin": {"type": "number", "minimum": 0},
+        "estimatorcurve": {"type": "number", "minimum": 0}
+      }
+    }
+  },
+  "definitions": {
+    "color": {"anyOf": [{"enum": COLOR_NAMES}, {"type": "string", "pattern": "^#[0-9a-fA-F]{6}([0-9a-fA-F]{2})?$"}]},
+    "orbit": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["type"],
+      "properties": {
+        "type": {"enum": ["point", "line", "raster", "outline", "circle", "ring", "segment", "cross", "rect", "polygon", "star", "grid", "path", "union", "intersect", "subtract", "smooth"]},
+        "name": {"type": "string", "pattern": "^([a-zA-Z0-9\\-]+|data:image/(png|jpeg|gif);base64,[A-Za-z0-9+/=]+)$", "description": "name of the image of raster traps in the trap store, or data URI of the image"},
+        "path": {"type": "string", "pattern": "^[MmLlHhVvCcSsQqTtAaZz0-9eE.,+\\- ]+$", "description": "SVG path data of path traps"},
+        "orbits": {"type": "array", "items": {"$ref": "#/definitions/orbit"}, "description": "shapes combined by union, intersect, subtract and smooth traps"},
+        "args": {"type": "array", "items": {"type": "number"}},
+        "coords": {"enum": ["", "view"], "description": "view for arguments given as fractions of the trap window"}
+      }
+    },
+    "transform": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["a", "b", "c", "d", "e", "f"],
+      "properties": {
+        "a": {"type": "number"},
+        "b": {"type": "number"},
+        "c": {"type": "number"},
+        "d": {"type": "number"},
+        "e": {"type": "number"},
+        "f": {"type": "number"},
+        "weight": {"type": "number", "minimum": 0}
+      }
+    },
+    "affine": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["a", "b", "c", "d", "e", "f"],
+      "properties": {
+        "a": {"type": "number"},
+        "b": {"type": "number"},
+        "c": {"type": "number"},
+        "d": {"type": "number"},
+        "e": {"type": "number"},
+        "f": {"type": "number"}
+      }
+    },
+    "flametransform": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["affine", "variations"],
+      "properties": {
+        "weight": {"type": "number", "minimum": 0},
+        "color": {"type": "number", "minimum": 0, "maximum": 1},
+        "affine": {"$ref": "#/definitions/affine"},
+        "variations": {"type": "object", "additionalProperties": {"type": "number"}, "description": "weights of the variations by name"},
+        "post": {"$ref": "#/definitions/affine"}
+      }
+    }
+  }
+}`
+
+var renderSchema map[string]interface{}
+
+// colorNames returns the sorted names of the colors as a JSON array
+func colorNames() string {
+	names := make([]string, 0, len(palettes.ColorNames))
+	for name := range palettes.ColorNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	encoded, _ := json.Marshal(names)
+	return string(encoded)
+}
+
+func init() {
+	if err := json.Unmarshal([]byte(RenderSchema), &renderSchema); err != nil {
+		panic(err)
+	}
+}
+
+// ParseRenderDocument validates a JSON render document against RenderSchema and parses it to the computation parameters,
+// storing the images of its data URI traps
+func ParseRenderDocument(document []byte) (params.ImageParams, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return params.ImageParams{}, err
+	}
+	if err := validate(renderSchema, renderSchema, value, "document"); err != nil {
+		return params.ImageParams{}, err
+	}
+
+	description := ParseValues(documentDefaults(document)).Describe()
+	if err := json.Unmarshal(document, &description); err != nil {
+		return params.ImageParams{}, err
+	}
+	values, err := StoreTraps(description.Values())
+	if err != nil {
+		return params.ImageParams{}, err
+	}
+	if err := CheckValues(values); err != nil {
+		return params.ImageParams{}, err
+	}
+	return ParseValues(values), nil
+}
+
+// documentDefaults returns the query parameters giving the default values of a render document, which depend on its type, IFS, flame and size
+func documentDefaults(document []byte) url.Values {
+	var head struct {
+		Type   string          `json:"type"`
+		Width  int             `json:"width"`
+		Height int             `json:"height"`
+		IFS    *params.IFS     `json:"ifs"`
+		Flame  json.RawMessage `json:"flame"`
+	}
+	defaults := url.Values{}
+	if err := json.Unmarshal(document, &head); err != nil {
+		return defaults
+	}
+
+	if head.Type != "" {
+		defaults.Set("type", head.Type)
+	}
+	if head.Width > 0 {
+		defaults.Set("width", strconv.Itoa(head.Width))
+	}
+	if head.Height > 0 {
+		defaults.Set("height", strconv.Itoa(head.Height))
+	}
+	if head.IFS != nil {
+		description := params.Description{IFS: head.IFS}
+		for _, key := range []string{"ifs", "transform"} {
+			defaults[key] = description.Values()[key]
+		}
+	}
+	if len(head.Flame) > 0 {
+		flame := fractales.DefaultFlame()
+		flame.Transforms = nil
+		if err := json.Unmarshal(head.Flame, &flame); err == nil {
+			if len(flame.Transforms) == 0 {
+				flame.Transforms = fractales.DefaultFlame().Transforms
+			}
+			description := params.Description{Flame: &flame}
+			for _, key := range []string{"xform", "finalxform", "gamma", "vibrancy", "brightness", "estimator", "estimatormin", "estimatorcurve"} {
+				defaults[key] = description.Values()[key]
+			}
+		}
+	}
+	return defaults
+}
+
+// validate checks the value against the subset of JSON Schema used by RenderSchema
+func validate(root map[string]interface{}, schema map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		definitions, _ := root["definitions"].(map[string]interface{})
+		definition, ok := definitions[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unknown schema reference %s", path, ref)
+		}
+		return validate(root, definition, value, path)
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		reasons := make([]string, 0, len(anyOf))
+		for _, alternative := range anyOf {
+			err := validate(root, alternative.(map[string]interface{}), value, path)
+			if err == nil {
+				reasons = nil
+				break
+			}
+			reasons = append(reasons, strings.TrimPrefix(err.Error(), path+": "))
+		}
+		if len(reasons) > 0 {
+			return fmt.Errorf("%s: %s", path, strings.Join(reasons, ", or "))
+		}
+	}
+
+	if expected, ok := schema["type"].(string); ok && !hasType(value, expected) {
+		return fmt.Errorf("%s: should be of type %s", path, expected)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: should be one of %v", path, enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if minimum, ok := schema["minimum"].(float64); ok && f < minimum {
+			return fmt.Errorf("%s: should be at least %v", path, minimum)
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && f > maximum {
+			return fmt.Errorf("%s: should be at most %v", path, maximum)
+		}
+	case string:
+		if pattern, ok := schema["pattern"].(string); ok {
+			if matched, err := regexp.MatchString(pattern, v); err != nil || !matched {
+				return fmt.Errorf("%s: should match %s", path, pattern)
+			}
+		}
+	case []interface{}:
+		if minItems, ok := schema["minItems"].(float64); ok && float64(len(v)) < minItems {
+			return fmt.Errorf("%s: should have at least %v items", path, minItems)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validate(root, items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing property %s", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if !additional {
+						return fmt.Errorf("%s: unknown property %s", path, name)
+					}
+					continue
+				case map[string]interface{}:
+					property = additional
+				default:
+					continue
+				}
+			}
+			if err := validate(root, property, v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasType(value interface{}, expected string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return expected == "object"
+	case []interface{}:
+		return expected == "array"
+	case string:
+		return expected == "string"
+	case bool:
+		return expected == "boolean"
+	case nil:
+		return expected == "null"
+	case json.Number:
+		if expected == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return expected == "integer" && err == nil && f == math.Trunc(f)
+	}
+	return false
+}
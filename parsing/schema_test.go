@@ -0,0 +1,72 @@
+package parsing
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRenderDocumentMatchesQuery(t *testing.T) {
+	document := `{"width": 300, "height": 200, "type": "julia", "palette": {"colors": ["red", "#00ff00"], "interior": "period"}, "orbits": [{"type": "point", "args": [0, 0, 50]}]}`
+	fromDocument, err := ParseRenderDocument([]byte(document))
+	if err != nil {
+		t.Fatalf("Valid document rejected: %v", err)
+	}
+
+	values, _ := url.ParseQuery("width=300&height=200&type=julia&palette=black,red,%2300ff00&interior=period&orbit=point(0,0,50)")
+	fromQuery := ParseValues(values)
+	if !reflect.DeepEqual(fromDocument.Describe(), fromQuery.Describe()) {
+		t.Errorf("Document and query should describe the same render, got %v and %v", fromDocument.Describe(), fromQuery.Describe())
+	}
+}
+
+func TestRenderDocumentValidation(t *testing.T) {
+	invalid := []string{
+		`{"width": 0}`,
+		`{"width": 2.5}`,
+		`{"type": "buddhabrot"}`,
+		`{"zoom": 2}`,
+		`{"palette": {"colors": ["not a color"]}}`,
+		`{"palette": {"colors": ["mauve"]}}`,
+		`{"orbits": [{"args": [1, 2, 3]}]}`,
+		`[]`,
+		`{"type": "ifs", "ifs": {"transforms": [{"a": 1}]}}`,
+		`{"type": "flame", "flame": {"transforms": [{"affine": {"a": 1, "b": 0, "c": 0, "d": 1, "e": 0, "f": 0}, "variations": {"julia": "one"}}]}}`,
+	}
+	for _, document := range invalid {
+		if _, err := ParseRenderDocument([]byte(document)); err == nil {
+			t.Errorf("Invalid document %s accepted", document)
+		}
+	}
+}
+
+func TestIFSDocumentMatchesQuery(t *testing.T) {
+	document := `{"type": "ifs", "width": 300, "height": 100, "ifs": {"transforms": [{"a": 0.5, "b": 0, "c": 0, "d": 0.5, "e": 0, "f": 0}, {"a": 0.5, "b": 0, "c": 0, "d": 0.5, "e": 0.5, "f": 0, "weight": 2}]}}`
+	fromDocument, err := ParseRenderDocument([]byte(document))
+	if err != nil {
+		t.Fatalf("Valid document rejected: %v", err)
+	}
+
+	values, _ := url.ParseQuery("type=ifs&width=300&height=100&transform=0.5,0,0,0.5,0,0&transform=0.5,0,0,0.5,0.5,0,2")
+	fromQuery := ParseValues(values)
+	if !reflect.DeepEqual(fromDocument.Describe(), fromQuery.Describe()) {
+		t.Errorf("Document and query should describe the same render, got %v and %v", fromDocument.Describe(), fromQuery.Describe())
+	}
+}
+
+func TestFlameDocumentMatchesQuery(t *testing.T) {
+	document := `{"type": "flame", "width": 200, "height": 100, "flame": {"transforms": [{"weight": 1, "color": 0.5, "affine": {"a": 0.5, "b": 0, "c": 0, "d": 0.5, "e": 0, "f": 0}, "variations": {"julia": 1, "swirl": 0.5}, "post": {"a": 1, "b": 0, "c": 0, "d": 1, "e": 0.2, "f": 0}}], "gamma": 2}}`
+	fromDocument, err := ParseRenderDocument([]byte(document))
+	if err != nil {
+		t.Fatalf("Valid document rejected: %v", err)
+	}
+
+	values, _ := url.ParseQuery("type=flame&width=200&height=100&xform=1|0.5|0.5,0,0,0.5,0,0|swirl:0.5,julia|1,0,0,1,0.2,0&gamma=2")
+	fromQuery := ParseValues(values)
+	if !reflect.DeepEqual(fromDocument.Describe(), fromQuery.Describe()) {
+		t.Errorf("Document and query should describe the same render, got %v and %v", fromDocument.Describe(), fromQuery.Describe())
+	}
+	if len(fromQuery.Flame.Transforms) != 1 || fromQuery.Flame.Transforms[0].Post == nil || fromQuery.Flame.Gamma != 2 {
+		t.Errorf("Query should give a flame with a post transform, got %v", fromQuery.Flame)
+	}
+}
@@ -0,0 +1,111 @@
+package parsing
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/Balise42/marzipango/fractales/orbits"
+	"github.com/Balise42/marzipango/params"
+)
+
+// parseCall splits type(args) into its type and its raw arguments
+func parseCall(raw string) (string, string, bool) {
+	open := strings.Index(raw, "(")
+	if open <= 0 || !strings.HasSuffix(raw, ")") {
+		return "", "", false
+	}
+	return raw[:open], raw[open+1 : len(raw)-1], true
+}
+
+// splitArgs splits raw arguments on the commas which are not between parentheses
+func splitArgs(raw string) []string {
+	var args []string
+	depth := 0
+	start := 0
+	for i, c := range raw {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, raw[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, raw[start:])
+}
+
+// parseShapeOrbit parses a shape trap, a shape expression whose last argument is the maximum value of the trap
+func parseShapeOrbit(raw string, coords string, window params.Window) (params.Orbit, error) {
+	shapeType, rawArgs, _ := parseCall(raw)
+
+	var fields []string
+	if shapeType == "path" {
+		// path data may contain commas, the maximum value is after the last one
+		last := strings.LastIndex(rawArgs, ",")
+		if last < 0 {
+			return nil, errors.New("path trap without a maximum value")
+		}
+		fields = []string{rawArgs[:last], rawArgs[last+1:]}
+	} else {
+		fields = splitArgs(rawArgs)
+	}
+
+	maxvalue, err := strconv.ParseFloat(strings.TrimSpace(fields[len(fields)-1]), 64)
+	if err != nil {
+		return nil, err
+	}
+	shape, err := buildShape(shapeType, fields[:len(fields)-1])
+	if err != nil {
+		return nil, err
+	}
+	return orbits.CreateShapeOrbit(shape, maxvalue, coords, window), nil
+}
+
+// parseShape parses a shape expression: type(args), path(data) or a combinator type(shapes, args)
+func parseShape(raw string) (orbits.Shape, error) {
+	shapeType, rawArgs, ok := parseCall(strings.TrimSpace(raw))
+	if !ok {
+		return orbits.Shape{}, errors.New("invalid shape " + raw)
+	}
+	if shapeType == "path" {
+		return buildShape(shapeType, []string{rawArgs})
+	}
+	if strings.TrimSpace(rawArgs) == "" {
+		return buildShape(shapeType, nil)
+	}
+	return buildShape(shapeType, splitArgs(rawArgs))
+}
+
+// buildShape returns the shape of the type whose fields are shapes or numbers, or the path data for paths
+func buildShape(shapeType string, fields []string) (orbits.Shape, error) {
+	if shapeType == "path" {
+		if len(fields) != 1 {
+			return orbits.Shape{}, errors.New("path takes its data")
+		}
+		return orbits.NewShape(shapeType, nil, fields[0], nil)
+	}
+
+	var args []float64
+	var shapes []orbits.Shape
+	for _, field := range fields {
+		if strings.Contains(field, "(") {
+			shape, err := parseShape(field)
+			if err != nil {
+				return orbits.Shape{}, err
+			}
+			shapes = append(shapes, shape)
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return orbits.Shape{}, err
+		}
+		args = append(args, f)
+	}
+	return orbits.NewShape(shapeType, args, "", shapes)
+}
@@ -0,0 +1,119 @@
+package render
+
+import (
+	"context"
+
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// isIFS tells whether the fractal type is an iterated function system, computed as a whole before filling in the image
+func isIFS(fractaleType string) bool {
+	return fractaleType == "fern" || fractaleType == "flame" || fractaleType == "sierp" || fractaleType == "ifs"
+}
+
+// isOrbitTrapped tells whether the fractal is computed with orbit traps
+func isOrbitTrapped(imageParams params.ImageParams) bool {
+	trappable := imageParams.Type == "julia" || (imageParams.Type == "mandelbrot" && imageParams.Power == 2)
+	return trappable && len(imageParams.Orbits) > 0 && !highPrecision(imageParams)
+}
+
+func highPrecision(params params.ImageParams) bool {
+	coords := make(map[float64]bool)
+	for x := 0; x < params.Width; x++ {
+		coords[params.Left+float64(x)/float64(params.Width)*(params.Right-params.Left)] = true
+	}
+	return len(coords) < params.Width-5
+}
+
+// Computer returns the Computation filling in the image described by the parameters
+func Computer(imageParams params.ImageParams) fractales.Computation {
+	return computer(context.Background(), imageParams, nil)
+}
+
+// computer returns the Computation filling in the image described by the parameters, reporting the progress of the precomputations of IFS fractals
+func computer(ctx context.Context, imageParams params.ImageParams, progress fractales.ProgressFunction) fractales.Computation {
+	valueComputer, comp := valueComputer(ctx, imageParams, progress)
+	if comp != nil {
+		return comp
+	}
+	return colorComputer(imageParams, valueComputer)
+}
+
+// colorComputer returns the Computation coloring the values of the image described by the parameters, resolving its palette first if needed
+func colorComputer(imageParams params.ImageParams, valueComputer fractales.ValueComputation) fractales.Computation {
+	palette := imageParams.Palette
+	needsHistogram := palette.Coloring == palettes.ColoringHistogram && palette.Histogram == nil
+	if valueComputer != nil && (needsHistogram || palette.MaxValue == palettes.AutoSize) {
+		step := 8
+		if needsHistogram {
+			step = 1
+		}
+		grid := fractales.ComputeValueGrid(valueComputer, imageParams, step)
+		values := grid.EscapedValues()
+		if needsHistogram {
+			if imageParams.AA.Mode == params.AANone {
+				valueComputer = grid.Lookup()
+			}
+			palette.Histogram = values
+		}
+		if palette.MaxValue == palettes.AutoSize {
+			palette.MaxValue = palettes.AutoMaxValue(values)
+		}
+	}
+	colorPixel := palettes.ContinuousColoring(palette)
+
+	if imageParams.Trap.Mode == params.TrapTexture && isOrbitTrapped(imageParams) {
+		return fractales.CreateColorComputer(fractales.OrbitTextureComputer(imageParams, imageParams.Orbits, colorPixel), imageParams)
+	}
+
+	if imageParams.AA.Mode != params.AANone {
+		return fractales.CreateAntialiasedComputer(valueComputer, colorPixel, imageParams)
+	}
+	return fractales.CreateComputer(valueComputer, colorPixel, imageParams)
+}
+
+// valueComputer returns the ValueComputation of the fractal described by the parameters, or the Computation directly for fractals colored without a palette
+func valueComputer(ctx context.Context, imageParams params.ImageParams, progress fractales.ProgressFunction) (fractales.ValueComputation, fractales.Computation) {
+	var valueComputer fractales.ValueComputation
+
+	fractaleType := imageParams.Type
+	orbits := imageParams.Orbits
+	hasOrbits := len(orbits) > 0
+	power := imageParams.Power
+
+	if fractaleType == "ifs" {
+		valueComputer = fractales.IFSValueComputeLow(ctx, imageParams, progress)
+	} else if !highPrecision(imageParams) {
+		if fractaleType == "julia" {
+			if hasOrbits {
+				valueComputer = fractales.JuliaOrbitValueComputerLow(imageParams, orbits)
+			} else {
+				valueComputer = fractales.JuliaContinuousValueComputerLow(imageParams)
+			}
+		} else if fractaleType == "mandelbrot" && power == 2 {
+			if hasOrbits {
+				valueComputer = fractales.MandelbrotOrbitValueComputerLow(imageParams, orbits)
+			} else {
+				valueComputer = fractales.MandelbrotContinuousValueComputerLow(imageParams)
+			}
+		} else if fractaleType == "fern" {
+			valueComputer = fractales.FernValueComputeLow(ctx, imageParams, progress)
+		} else if fractaleType == "flame" {
+			return nil, fractales.CreateFlameComputer(ctx, imageParams, progress)
+		} else if fractaleType == "sierp" {
+			valueComputer = fractales.SierpValueComputeLow(ctx, imageParams, progress)
+		} else if power != 2 {
+			valueComputer = fractales.MultibrotContinuousValueComputerLow(imageParams)
+		}
+	} else {
+		if fractaleType == "julia" {
+			valueComputer = fractales.JuliaContinuousValueComputerHigh(imageParams)
+		} else if fractaleType == "mandelbrot" && power == 2 {
+			valueComputer = fractales.MandelbrotContinuousValueComputerHigh(imageParams)
+		}
+	}
+
+	return valueComputer, nil
+}
@@ -0,0 +1,164 @@
+package render
+
+import (
+	"context"
+	"errors"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// maxPaletteSamples bounds the number of values sampled across a poster to share its palette between the strips
+const maxPaletteSamples = 1 << 22
+
+// posterBandBytes bounds the number of bytes held by the chaos game of a band of rows of the poster of an IFS fractal
+var posterBandBytes int64 = 1 << 30
+
+// SubViewport returns the parameters of the part of the image covered by the rectangle
+func SubViewport(imageParams params.ImageParams, rect image.Rectangle) params.ImageParams {
+	width := float64(imageParams.Width)
+	height := float64(imageParams.Height)
+
+	subParams := imageParams
+	subParams.Left = imageParams.Left + float64(rect.Min.X)/width*(imageParams.Right-imageParams.Left)
+	subParams.Right = imageParams.Left + float64(rect.Max.X)/width*(imageParams.Right-imageParams.Left)
+	subParams.Top = imageParams.Top + float64(rect.Min.Y)/height*(imageParams.Bottom-imageParams.Top)
+	subParams.Bottom = imageParams.Top + float64(rect.Max.Y)/height*(imageParams.Bottom-imageParams.Top)
+	subParams.Width = rect.Dx()
+	subParams.Height = rect.Dy()
+	return subParams
+}
+
+// Poster renders the image in horizontal strips of at most stripHeight rows and calls strip with each of them from top to bottom,
+// so that only one strip of the image is held in memory at a time. The histogram and automatic size of the palette are resolved once for the whole image.
+// IFS fractals play their chaos game again for each band of rows whose histogram holds at most posterBandBytes, keeping only the points falling in it,
+// so that their posters take as many chaos games as there are bands, twice as many if the palette needs the values of the whole image.
+// They cannot be given a time budget, which would stop the chaos game of each band at a different point.
+func Poster(ctx context.Context, imageParams params.ImageParams, stripHeight int, strip func(img *image.RGBA64) error, opts ...Option) error {
+	o := newOptions(opts)
+	stripOptions := o
+	stripOptions.progress = nil
+
+	if isIFS(imageParams.Type) && imageParams.Budget > 0 {
+		return errors.New("posters of IFS fractals cannot be given a time budget")
+	}
+	if stripHeight <= 0 {
+		stripHeight = imageParams.Height
+	}
+	strips := posterStrips(ctx, imageParams, stripHeight)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	for y := 0; y < imageParams.Height; y += stripHeight {
+		bottom := y + stripHeight
+		if bottom > imageParams.Height {
+			bottom = imageParams.Height
+		}
+
+		stripParams := SubViewport(imageParams, image.Rect(0, y, imageParams.Width, bottom))
+		img, err := generateImage(ctx, stripParams, strips(y, bottom), stripOptions)
+		if err != nil {
+			return err
+		}
+		if err := strip(img); err != nil {
+			return err
+		}
+		if o.progress != nil {
+			o.progress(bottom, imageParams.Height)
+		}
+	}
+	return nil
+}
+
+// posterStrips returns the StripComputation of the strips of stripHeight rows of the image: flames are played, density estimated and tone mapped band by band,
+// the other IFS fractals played band by band and colored strip by strip, while the other fractals are computed strip by strip
+func posterStrips(ctx context.Context, imageParams params.ImageParams, stripHeight int) fractales.StripComputation {
+	if imageParams.Type == "flame" {
+		return fractales.CreateFlameStripComputer(ctx, imageParams, posterBandBytes)
+	}
+
+	if bands := bandValueComputer(ctx, imageParams); bands != nil {
+		imageParams.Palette = sharedPalette(imageParams, func(step int) []float64 {
+			return sampleBands(imageParams, bands, stripHeight, step)
+		})
+		return func(top int, bottom int) fractales.Computation {
+			values := bands(top, bottom)
+			stripValues := func(x float64, y float64) (float64, bool, float64) {
+				return values(x, y+float64(top))
+			}
+			return colorComputer(SubViewport(imageParams, image.Rect(0, top, imageParams.Width, bottom)), stripValues)
+		}
+	}
+
+	if values, _ := valueComputer(ctx, imageParams, nil); values != nil {
+		imageParams.Palette = sharedPalette(imageParams, func(step int) []float64 {
+			return fractales.ComputeValueGrid(values, imageParams, step).EscapedValues()
+		})
+	}
+	return func(top int, bottom int) fractales.Computation {
+		return computer(ctx, SubViewport(imageParams, image.Rect(0, top, imageParams.Width, bottom)), nil)
+	}
+}
+
+// bandValueComputer returns the BandValueComputation of the IFS fractals colored from a palette, nil for the other fractals
+func bandValueComputer(ctx context.Context, imageParams params.ImageParams) fractales.BandValueComputation {
+	switch imageParams.Type {
+	case "fern":
+		return fractales.FernBandValueComputer(ctx, imageParams, posterBandBytes)
+	case "sierp":
+		return fractales.SierpBandValueComputer(ctx, imageParams, posterBandBytes)
+	case "ifs":
+		return fractales.IFSBandValueComputer(ctx, imageParams, posterBandBytes)
+	}
+	return nil
+}
+
+// sampleBands returns the sorted values of the points that escaped among one pixel every step pixels of the image, computed strip by strip from the bands
+func sampleBands(imageParams params.ImageParams, bands fractales.BandValueComputation, stripHeight int, step int) []float64 {
+	var escaped []float64
+	for top := 0; top < imageParams.Height; top += stripHeight {
+		bottom := top + stripHeight
+		if bottom > imageParams.Height {
+			bottom = imageParams.Height
+		}
+
+		values := bands(top, bottom)
+		for y := (top + step - 1) / step * step; y < bottom; y += step {
+			for x := 0; x < imageParams.Width; x += step {
+				if value, ok, _ := values(float64(x)+0.5, float64(y)+0.5); ok {
+					escaped = append(escaped, value)
+				}
+			}
+		}
+	}
+	sort.Float64s(escaped)
+	return escaped
+}
+
+// sharedPalette resolves the histogram and automatic size of the palette from at most maxPaletteSamples values sampled across the whole image,
+// sample returning the sorted values of the points that escaped among one pixel every step pixels
+func sharedPalette(imageParams params.ImageParams, sample func(step int) []float64) palettes.Colors {
+	palette := imageParams.Palette
+	needsHistogram := palette.Coloring == palettes.ColoringHistogram && palette.Histogram == nil
+	if !needsHistogram && palette.MaxValue != palettes.AutoSize {
+		return palette
+	}
+
+	step := int(math.Ceil(math.Sqrt(float64(imageParams.Width) * float64(imageParams.Height) / maxPaletteSamples)))
+	if !needsHistogram && step < 8 {
+		step = 8
+	}
+	values := sample(step)
+	if needsHistogram {
+		palette.Histogram = values
+	}
+	if palette.MaxValue == palettes.AutoSize {
+		palette.MaxValue = palettes.AutoMaxValue(values)
+	}
+	return palette
+}
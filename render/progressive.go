@@ -0,0 +1,146 @@
+package render
+
+import (
+	"context"
+	"image"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/palettes"
+	"github.com/Balise42/marzipango/params"
+)
+
+// progressiveSteps are the block sizes of the successive passes of a progressive render
+var progressiveSteps = []int{8, 4, 2, 1}
+
+// Progressive renders the image in passes of decreasing block size and calls frame with the image after each of them.
+// Each pass computes the top left pixel of every block that the previous passes have not computed yet and fills the block with it,
+// so that all the passes together compute each pixel once and cost no more than a single render; the last pass is the same image as the one returned by Render.
+// IFS fractals, whose cost does not depend on the resolution, are rendered in a single pass.
+// Images whose coloring needs the whole image, with histogram coloring or adaptive antialiasing, are previewed from a coarse grid of values
+// and computed again in full by the last pass, so that their first passes are not held up by it.
+func Progressive(ctx context.Context, imageParams params.ImageParams, frame func(img image.Image, pass int, passes int) error, opts ...Option) error {
+	o := newOptions(opts)
+
+	if isIFS(imageParams.Type) {
+		img, err := renderImage(ctx, imageParams, o)
+		if err != nil {
+			return err
+		}
+		return frame(img, 1, 1)
+	}
+
+	whole := needsWholeImage(imageParams)
+	var comp fractales.Computation
+	if whole {
+		comp = previewComputer(ctx, imageParams)
+	} else {
+		comp = computer(ctx, imageParams, nil)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	total := 0
+	for _, step := range progressiveSteps {
+		total += (imageParams.Width + step - 1) / step
+	}
+	var done int64
+
+	img := image.NewRGBA64(image.Rect(0, 0, imageParams.Width, imageParams.Height))
+	preview := image.NewRGBA64(img.Bounds())
+	previous := 0
+	for pass, step := range progressiveSteps {
+		// the last pass of images needing the whole image computes all of it, with the computer of Render
+		if whole && step == 1 {
+			comp = computer(ctx, imageParams, nil)
+			previous = 0
+		}
+		err := refine(ctx, comp, img, step, previous, o.workers, func() {
+			if o.progress != nil {
+				o.progress(int(atomic.AddInt64(&done, 1)), total)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		previous = step
+
+		shown := img
+		if step > 1 {
+			upscale(img, preview, step)
+			shown = preview
+		}
+		if err := frame(shown, pass+1, len(progressiveSteps)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// needsWholeImage tells whether the pixels of the image can only be colored once all of them have been computed
+func needsWholeImage(imageParams params.ImageParams) bool {
+	histogram := imageParams.Palette.Coloring == palettes.ColoringHistogram && imageParams.Palette.Histogram == nil
+	return histogram || imageParams.AA.Mode == params.AAAdaptive
+}
+
+// previewComputer returns the Computation of the first passes of images needing the whole image:
+// they are not antialiased, and their histogram is estimated from the values of the top left pixels of the blocks of the first pass
+func previewComputer(ctx context.Context, imageParams params.ImageParams) fractales.Computation {
+	preview := imageParams
+	preview.AA = params.Antialiasing{Mode: params.AANone}
+	valueComputer, comp := valueComputer(ctx, preview, nil)
+	if comp != nil {
+		return comp
+	}
+	if valueComputer != nil && preview.Palette.Coloring == palettes.ColoringHistogram && preview.Palette.Histogram == nil {
+		preview.Palette.Histogram = fractales.ComputeValueGrid(valueComputer, preview, progressiveSteps[0]).EscapedValues()
+	}
+	return colorComputer(preview, valueComputer)
+}
+
+// refine computes the pixels of img whose coordinates are multiples of step but not both multiples of previous, the step of the previous pass, if any,
+// calling column after each column
+func refine(ctx context.Context, comp fractales.Computation, img *image.RGBA64, step int, previous int, workers int, column func()) error {
+	bounds := img.Bounds()
+	columns := make(chan int, (bounds.Dx()+step-1)/step)
+	for x := 0; x < bounds.Dx(); x += step {
+		columns <- x
+	}
+	close(columns)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var pixels sync.WaitGroup
+			for x := range columns {
+				if ctx.Err() != nil {
+					continue
+				}
+				for y := 0; y < bounds.Dy(); y += step {
+					if previous > 0 && x%previous == 0 && y%previous == 0 {
+						continue
+					}
+					pixels.Add(1)
+					comp(x, y, y+1, img, &pixels)
+				}
+				column()
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// upscale fills each block of step x step pixels of preview with the top left pixel of the block in img
+func upscale(img *image.RGBA64, preview *image.RGBA64, step int) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			preview.SetRGBA64(x, y, img.RGBA64At(x-x%step, y-y%step))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package render renders fractal images and videos from their parameters, independently of any server
+package render
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Balise42/marzipango/fractales"
+	"github.com/Balise42/marzipango/params"
+	"github.com/icza/mjpeg"
+)
+
+// VideoFrames is the number of frames of a zoom video
+const VideoFrames = 200
+
+type options struct {
+	workers  int
+	progress func(done int, total int)
+}
+
+// Option configures a render
+type Option func(*options)
+
+// WithWorkers sets the number of goroutines computing the image, the number of CPUs by default
+func WithWorkers(workers int) Option {
+	return func(o *options) {
+		if workers > 0 {
+			o.workers = workers
+		}
+	}
+}
+
+// WithProgress sets a function called with the amount of work done so far and the total: chaos game iterations then columns
+// for IFS fractals, columns for the other fractals, frames for videos and rows for posters. It can be called concurrently from several goroutines.
+func WithProgress(progress func(done int, total int)) Option {
+	return func(o *options) {
+		o.progress = progress
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{workers: runtime.NumCPU()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Render renders the image described by the parameters. It stops early and returns the context error if the context is done.
+func Render(ctx context.Context, imageParams params.ImageParams, opts ...Option) (image.Image, error) {
+	o := newOptions(opts)
+	return renderImage(ctx, imageParams, o)
+}
+
+// renderImage computes and generates the image, counting the precomputations of IFS fractals in the progress before the columns
+func renderImage(ctx context.Context, imageParams params.ImageParams, o options) (*image.RGBA64, error) {
+	var setup int
+	var setupProgress fractales.ProgressFunction
+	if o.progress != nil {
+		setupProgress = func(done int, total int) {
+			setup = total
+			o.progress(done, total+imageParams.Width)
+		}
+	}
+	comp := computer(ctx, imageParams, setupProgress)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	columnOptions := o
+	if o.progress != nil {
+		columnOptions.progress = func(done int, total int) {
+			o.progress(setup+done, setup+total)
+		}
+	}
+	return generateImage(ctx, imageParams, comp, columnOptions)
+}
+
+func generateImage(ctx context.Context, imageParams params.ImageParams, comp fractales.Computation, o options) (*image.RGBA64, error) {
+	img := image.NewRGBA64(image.Rect(0, 0, imageParams.Width, imageParams.Height))
+
+	columns := make(chan int, imageParams.Width)
+	for x := 0; x < imageParams.Width; x++ {
+		columns <- x
+	}
+	close(columns)
+
+	var wg sync.WaitGroup
+	var done int64
+	wg.Add(imageParams.Width)
+	for worker := 0; worker < o.workers; worker++ {
+		go func() {
+			for x := range columns {
+				if ctx.Err() != nil {
+					wg.Done()
+					continue
+				}
+				comp(x, 0, imageParams.Height, img, &wg)
+				if o.progress != nil {
+					o.progress(int(atomic.AddInt64(&done, 1)), imageParams.Width)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return img, ctx.Err()
+}
+
+// ZoomFrame returns the parameters of the given frame of the zoom video starting from the parameters, each frame zooming in by a tenth
+func ZoomFrame(imageParams params.ImageParams, frame int) params.ImageParams {
+	for i := 0; i <= frame; i++ {
+		deltaX := math.Abs(imageParams.Left - imageParams.Right)
+		deltaY := math.Abs(imageParams.Top - imageParams.Bottom)
+
+		imageParams.Left = imageParams.Left + 1.0/2*deltaX/20
+		imageParams.Right = imageParams.Right - 1.0/2*deltaX/20
+		imageParams.Top = imageParams.Top + 1.0/2*deltaY/20
+		imageParams.Bottom = imageParams.Bottom - 1.0/2*deltaY/20
+	}
+	return imageParams
+}
+
+// Video renders a zoom video starting from the parameters to an MJPEG AVI file
+func Video(ctx context.Context, path string, imageParams params.ImageParams, opts ...Option) error {
+	o := newOptions(opts)
+	imageOptions := o
+	imageOptions.progress = nil
+
+	aw, err := mjpeg.New(path, int32(imageParams.Width), int32(imageParams.Height), 25)
+
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < VideoFrames; i++ {
+		if o.progress != nil {
+			o.progress(i, VideoFrames)
+		}
+
+		img, err := renderImage(ctx, ZoomFrame(imageParams, i), imageOptions)
+		if err != nil {
+			aw.Close()
+			return err
+		}
+
+		buf := &bytes.Buffer{}
+		err = jpeg.Encode(buf, img, nil)
+		if err != nil {
+			aw.Close()
+			return err
+		}
+
+		err = aw.AddFrame(buf.Bytes())
+		if err != nil {
+			aw.Close()
+			return err
+		}
+	}
+
+	err = aw.Close()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
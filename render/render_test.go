@@ -0,0 +1,125 @@
+package render
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Balise42/marzipango/parsing"
+)
+
+func TestRender(t *testing.T) {
+	values, _ := url.ParseQuery("width=60&height=40&type=julia")
+	done := 0
+	img, err := Render(context.Background(), parsing.ParseValues(values), WithWorkers(1), WithProgress(func(d int, total int) {
+		done = d
+	}))
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if img.Bounds().Dx() != 60 || img.Bounds().Dy() != 40 {
+		t.Errorf("Image should be 60x40, got %v", img.Bounds())
+	}
+	if done != 60 {
+		t.Errorf("Progress should reach 60 columns, got %d", done)
+	}
+}
+
+func TestRenderCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	values, _ := url.ParseQuery("width=60&height=40")
+	if _, err := Render(ctx, parsing.ParseValues(values)); err != context.Canceled {
+		t.Errorf("Cancelled render should return context.Canceled, got %v", err)
+	}
+}
+
+func TestProgressive(t *testing.T) {
+	for _, query := range []string{"width=61&height=37&type=julia", "width=61&height=37&type=julia&aa=jitter2", "width=61&height=37&coloring=histogram", "width=61&height=37&type=julia&aa=adaptive2&palettesize=auto"} {
+		values, _ := url.ParseQuery(query)
+		imageParams := parsing.ParseValues(values)
+		expected, _ := Render(context.Background(), imageParams)
+
+		frames := 0
+		err := Progressive(context.Background(), imageParams, func(img image.Image, pass int, passes int) error {
+			frames++
+			if pass == passes && !reflect.DeepEqual(img, expected) {
+				t.Errorf("Last pass of %s should be the rendered image", query)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Progressive failed: %v", err)
+		}
+		if frames != len(progressiveSteps) {
+			t.Errorf("Progressive should send %d frames, got %d", len(progressiveSteps), frames)
+		}
+	}
+}
+
+func TestRefineComputesEachPixelOnce(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 61, 37))
+	counts := make([]int32, 61*37)
+	comp := func(x int, ymin int, ymax int, img *image.RGBA64, wg *sync.WaitGroup) {
+		for y := ymin; y < ymax; y++ {
+			atomic.AddInt32(&counts[y*61+x], 1)
+		}
+		wg.Done()
+	}
+
+	previous := 0
+	for _, step := range progressiveSteps {
+		if err := refine(context.Background(), comp, img, step, previous, 3, func() {}); err != nil {
+			t.Fatalf("Refining failed: %v", err)
+		}
+		previous = step
+	}
+	for i, count := range counts {
+		if count != 1 {
+			t.Fatalf("Pixel %d,%d should be computed once, got %d", i%61, i/61, count)
+		}
+	}
+}
+
+func TestPoster(t *testing.T) {
+	// bands of a single row, or of a strip and the margin of its density estimation for flames
+	defer func(bandBytes int64) {
+		posterBandBytes = bandBytes
+	}(posterBandBytes)
+	posterBandBytes = 1
+
+	for _, query := range []string{"width=50&height=33&type=julia&palettesize=auto", "width=50&height=33&type=flame&spp=40&seed=3", "width=50&height=33&type=sierp&left=1&right=4&top=-1&bottom=-3&spp=20&seed=3&palettesize=auto&coloring=histogram", "width=50&height=33&type=fern&spp=20&seed=3&aa=grid2"} {
+		values, _ := url.ParseQuery(query)
+		imageParams := parsing.ParseValues(values)
+		expected, _ := Render(context.Background(), imageParams)
+
+		poster := image.NewRGBA64(expected.Bounds())
+		rows := 0
+		err := Poster(context.Background(), imageParams, 7, func(img *image.RGBA64) error {
+			draw.Draw(poster, image.Rect(0, rows, 50, rows+img.Bounds().Dy()), img, image.Point{}, draw.Src)
+			rows += img.Bounds().Dy()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Poster failed: %v", err)
+		}
+		if rows != 33 || !reflect.DeepEqual(poster, expected) {
+			t.Errorf("Strips of the poster of %s should make up the rendered image", query)
+		}
+	}
+}
+
+func TestPosterBudget(t *testing.T) {
+	values, _ := url.ParseQuery("width=50&height=33&type=fern&budget=1s")
+	err := Poster(context.Background(), parsing.ParseValues(values), 7, func(img *image.RGBA64) error {
+		return nil
+	})
+	if err == nil {
+		t.Errorf("Posters of IFS fractals with a time budget should fail")
+	}
+}